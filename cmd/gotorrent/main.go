@@ -1,32 +1,179 @@
 package main
+
 import (
+	"flag"
 	"fmt"
-	"os"
 	"github.com/HrishabhMittal/gotorrent/pkg/torrent"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 )
 
+// parsePriorities reads "index:priority" pairs, where index may be a range
+// like 3-7, e.g. "0:high,3-7:skip".
+func parsePriorities(spec string, def torrent.FilePriority, numFiles int) ([]torrent.FilePriority, error) {
+	prios := make([]torrent.FilePriority, numFiles)
+	for i := range prios {
+		prios[i] = def
+	}
+	if spec == "" {
+		return prios, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		idx, prio, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid priority entry %q", entry)
+		}
+		p, err := torrent.ParseFilePriority(prio)
+		if err != nil {
+			return nil, err
+		}
+		lo, hi, isRange := strings.Cut(idx, "-")
+		if !isRange {
+			hi = lo
+		}
+		start, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file index %q", lo)
+		}
+		end, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file index %q", hi)
+		}
+		if start < 0 || end >= numFiles || start > end {
+			return nil, fmt.Errorf("file index %q out of range", idx)
+		}
+		for i := start; i <= end; i++ {
+			prios[i] = p
+		}
+	}
+	return prios, nil
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run . <torrent_file>")
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "repair" {
+		os.Exit(runRepair(os.Args[2:]))
+	}
+	cfg := torrent.DefaultConfig()
+	flag.StringVar(&cfg.DownloadDir, "dir", cfg.DownloadDir, "directory to download into")
+	flag.BoolVar(&cfg.Sequential, "sequential", false, "download pieces in order for streaming")
+	flag.IntVar(&cfg.ReadAhead, "read-ahead", cfg.ReadAhead, "number of pieces in the sequential read-ahead window")
+	flag.IntVar(&cfg.DiskWorkers, "disk-workers", cfg.DiskWorkers, "number of goroutines hashing and writing pieces")
+	flag.IntVar(&cfg.WriteCacheSize, "write-cache", cfg.WriteCacheSize, "bytes of writes to buffer before flushing to disk (0 disables)")
+	flag.IntVar(&cfg.OpenFiles, "open-files", cfg.OpenFiles, "maximum number of file handles kept open")
+	flag.StringVar(&cfg.IncompleteDir, "incomplete-dir", "", "directory to keep files in until they are verified")
+	flag.BoolVar(&cfg.PartSuffix, "part-suffix", false, "add "+torrent.PART_SUFFIX+" to files until they are verified")
+	flag.BoolVar(&cfg.MoveEachFile, "move-each", false, "move each file as soon as it completes rather than when the torrent does")
+	flag.StringVar(&cfg.ResumeDir, "resume-dir", "", "directory for resume data (defaults to -dir)")
+	flag.StringVar(&cfg.BlocklistFile, "blocklist", "", "P2P, DAT or CIDR list of addresses to refuse")
+	flag.IntVar(&cfg.ListenPort, "port", 0, "accept incoming peers on this port (0 disables)")
+	flag.BoolVar(&cfg.UTP, "utp", cfg.UTP, "also connect to peers over uTP")
+	flag.BoolVar(&cfg.Seed, "seed", false, "keep seeding after the download completes")
+	flag.BoolVar(&cfg.SuperSeed, "superseed", false, "seed revealing pieces to one peer at a time (implies -seed)")
+	encryption := flag.String("encryption", cfg.Encryption.String(), "peer connection encryption: disabled, prefer or require")
+	allocMode := flag.String("alloc", "sparse", "file allocation mode: sparse, full or none")
+	httpAddr := flag.String("http", "", "serve torrent contents over HTTP on this address, e.g. localhost:8080")
+	list := flag.Bool("list", false, "list the files in the torrent and exit")
+	prioSpec := flag.String("prio", "", "per-file priorities as index:priority pairs, e.g. 0:high,3-7:skip")
+	defaultPrio := flag.String("default-prio", "normal", "priority for files not named in -prio (skip, low, normal, high)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gotorrent [flags] <torrent_file>")
+		fmt.Fprintln(os.Stderr, "       gotorrent verify [flags] <torrent_file>")
+		fmt.Fprintln(os.Stderr, "       gotorrent repair [flags] <torrent_file>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
 		return
-	}	
+	}
 
-	args := os.Args
-	tf, err := torrent.NewTorrentFile(args[1])
+	tf, err := torrent.NewTorrentFile(flag.Arg(0))
+	if err != nil {
+		fmt.Println("couldnt load torrent:", err)
+		return
+	}
+	if *list {
+		for i, f := range tf.Files {
+			if !f.Padding {
+				fmt.Printf("%4d  %12d  %s\n", i, f.Length, f.Path)
+			}
+		}
+		return
+	}
+	cfg.Encryption, err = torrent.ParseEncryptionPolicy(*encryption)
+	if err != nil {
+		fmt.Println("invalid -encryption:", err)
+		return
+	}
+	cfg.Allocation, err = torrent.ParseAllocMode(*allocMode)
+	if err != nil {
+		fmt.Println("invalid -alloc:", err)
+		return
+	}
+	def, err := torrent.ParseFilePriority(*defaultPrio)
+	if err != nil {
+		fmt.Println("invalid -default-prio:", err)
+		return
+	}
+	cfg.FilePriorities, err = parsePriorities(*prioSpec, def, len(tf.Files))
+	if err != nil {
+		fmt.Println("invalid -prio:", err)
+		return
+	}
 	fmt.Printf("Downloading: %s\n", tf.Name)
 
-	dn,err := torrent.NewDownloader(tf)
+	dn, err := torrent.NewDownloader(tf, cfg)
 	if err != nil {
 		fmt.Println("couldnt start download:", err)
 		return
 	}
-	go dn.PrintLogs()
-	dn.Wait()
-	fmt.Println("Exiting...")
-	err = torrent.Verify(tf)
-	if err != nil {
-		fmt.Println("Error:", err)
+	if *httpAddr != "" {
+		srv := torrent.NewServer()
+		key := srv.Add(dn)
+		go func() {
+			if err := http.ListenAndServe(*httpAddr, srv); err != nil {
+				fmt.Println("http server stopped:", err)
+			}
+		}()
+		fmt.Printf("Serving on http://%s/%s/\n", *httpAddr, key)
 	} else {
+		go dn.PrintLogs()
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		dn.Wait()
+		close(done)
+	}()
+	interrupted := false
+	select {
+	case <-done:
+		if cfg.Seed {
+			fmt.Println("Download finished, seeding. Press Ctrl+C to exit.")
+			<-sig
+		} else if *httpAddr != "" {
+			fmt.Println("Download finished, still serving. Press Ctrl+C to exit.")
+			<-sig
+		}
+	case <-sig:
+		interrupted = true
+	}
+	if err := dn.Close(); err != nil {
+		fmt.Println("couldnt close storage:", err)
+	}
+	if interrupted {
+		fmt.Println("\nInterrupted, progress saved.")
+		return
+	}
+	fmt.Println("Exiting...")
+	if verifyAndReport(tf, cfg, &torrent.VerifyOptions{}) {
 		fmt.Println("Files verified successfully.")
 	}
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/HrishabhMittal/gotorrent/pkg/torrent"
+)
+
+// runRepair implements "gotorrent repair": it verifies the download and
+// fetches only the pieces that failed.
+func runRepair(args []string) int {
+	cfg := torrent.DefaultConfig()
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	fs.StringVar(&cfg.DownloadDir, "dir", cfg.DownloadDir, "directory the torrent was downloaded into")
+	fs.StringVar(&cfg.IncompleteDir, "incomplete-dir", "", "directory holding files that were not moved yet")
+	fs.BoolVar(&cfg.PartSuffix, "part-suffix", false, "look for unfinished files with the "+torrent.PART_SUFFIX+" suffix")
+	fs.StringVar(&cfg.ResumeDir, "resume-dir", "", "directory for resume data (defaults to -dir)")
+	workers := fs.Int("workers", cfg.DiskWorkers, "number of goroutines hashing pieces")
+	applyPrio := prioFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gotorrent repair [flags] <torrent_file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+	tf, err := torrent.NewTorrentFile(fs.Arg(0))
+	if err != nil {
+		fmt.Println("couldnt load torrent:", err)
+		return 1
+	}
+	if err := applyPrio(cfg, len(tf.Files)); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	opts := &torrent.VerifyOptions{
+		Workers: *workers,
+		Progress: func(checked, total int) {
+			fmt.Printf("\rVerified: %d/%d pieces", checked, total)
+		},
+	}
+	dn, report, err := torrent.StartRepair(tf, cfg, opts)
+	fmt.Println()
+	if report != nil {
+		printReport(report)
+	}
+	if err != nil {
+		fmt.Println("couldnt start repair:", err)
+		return 1
+	}
+	if dn == nil {
+		fmt.Println("Nothing to repair.")
+		return 0
+	}
+	fmt.Printf("Re-downloading %d damaged pieces...\n", report.Count(torrent.PIECE_BAD)+report.Count(torrent.PIECE_MISSING))
+	go dn.PrintLogs()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		dn.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-sig:
+	}
+	if err := dn.Close(); err != nil {
+		fmt.Println("couldnt close storage:", err)
+	}
+	fixed := dn.RepairReport()
+	fmt.Printf("\nFixed %d pieces, %d still damaged.\n", len(fixed.Fixed), len(fixed.Remaining))
+	printPieces("fixed", fixed.Fixed)
+	printPieces("still damaged", fixed.Remaining)
+	if len(fixed.Remaining) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/HrishabhMittal/gotorrent/pkg/torrent"
+)
+
+const maxListedPieces = 20
+
+// runVerify implements "gotorrent verify" and returns the exit status.
+func runVerify(args []string) int {
+	cfg := torrent.DefaultConfig()
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.StringVar(&cfg.DownloadDir, "dir", cfg.DownloadDir, "directory the torrent was downloaded into")
+	fs.StringVar(&cfg.IncompleteDir, "incomplete-dir", "", "directory holding files that were not moved yet")
+	fs.BoolVar(&cfg.PartSuffix, "part-suffix", false, "look for unfinished files with the "+torrent.PART_SUFFIX+" suffix")
+	workers := fs.Int("workers", cfg.DiskWorkers, "number of goroutines hashing pieces")
+	readAhead := fs.Int("read-ahead", torrent.VERIFY_READ_AHEAD, "number of pieces read ahead of the hashers")
+	applyPrio := prioFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gotorrent verify [flags] <torrent_file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+	tf, err := torrent.NewTorrentFile(fs.Arg(0))
+	if err != nil {
+		fmt.Println("couldnt load torrent:", err)
+		return 1
+	}
+	if err := applyPrio(cfg, len(tf.Files)); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if !verifyAndReport(tf, cfg, &torrent.VerifyOptions{Workers: *workers, ReadAhead: *readAhead}) {
+		return 1
+	}
+	return 0
+}
+
+// prioFlags adds the -prio and -default-prio flags of a download to fs, so
+// files a partial download skipped are not reported missing. The returned
+// function sets cfg.FilePriorities from them once the torrent is known.
+func prioFlags(fs *flag.FlagSet) func(cfg *torrent.Config, numFiles int) error {
+	spec := fs.String("prio", "", "per-file priorities the download used, e.g. 0:high,3-7:skip")
+	def := fs.String("default-prio", "normal", "priority for files not named in -prio (skip, low, normal, high)")
+	return func(cfg *torrent.Config, numFiles int) error {
+		p, err := torrent.ParseFilePriority(*def)
+		if err != nil {
+			return fmt.Errorf("invalid -default-prio: %v", err)
+		}
+		cfg.FilePriorities, err = parsePriorities(*spec, p, numFiles)
+		if err != nil {
+			return fmt.Errorf("invalid -prio: %v", err)
+		}
+		return nil
+	}
+}
+
+func verifyAndReport(tf *torrent.TorrentFile, cfg *torrent.Config, opts *torrent.VerifyOptions) bool {
+	opts.Progress = func(checked, total int) {
+		fmt.Printf("\rVerified: %d/%d pieces", checked, total)
+	}
+	report, err := torrent.VerifyTorrent(tf, cfg, opts)
+	fmt.Println()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return false
+	}
+	printReport(report)
+	return report.OK()
+}
+
+func printReport(report *torrent.VerifyReport) {
+	fmt.Printf("Good: %d  Bad: %d  Missing: %d  Skipped: %d\n",
+		report.Count(torrent.PIECE_GOOD), report.Count(torrent.PIECE_BAD),
+		report.Count(torrent.PIECE_MISSING), report.Count(torrent.PIECE_SKIPPED))
+	for _, state := range []torrent.PieceState{torrent.PIECE_BAD, torrent.PIECE_MISSING} {
+		printPieces(state.String(), report.List(state))
+	}
+	for _, f := range report.Files {
+		fmt.Printf("%6.2f%%  %12d  %s\n", f.Percent(), f.Length, f.Path)
+	}
+}
+
+func printPieces(label string, list []int) {
+	if len(list) == 0 {
+		return
+	}
+	fmt.Printf("%s pieces:", label)
+	for _, i := range list[:min(len(list), maxListedPieces)] {
+		fmt.Printf(" %d", i)
+	}
+	if len(list) > maxListedPieces {
+		fmt.Printf(" ... (%d more)", len(list)-maxListedPieces)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"testing"
+
+	"github.com/HrishabhMittal/gotorrent/pkg/torrent"
+)
+
+func TestPrioFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []torrent.FilePriority
+		err  bool
+	}{
+		{nil, []torrent.FilePriority{torrent.PRIORITY_NORMAL, torrent.PRIORITY_NORMAL, torrent.PRIORITY_NORMAL}, false},
+		{[]string{"-prio", "2:skip"}, []torrent.FilePriority{torrent.PRIORITY_NORMAL, torrent.PRIORITY_NORMAL, torrent.PRIORITY_SKIP}, false},
+		{[]string{"-default-prio", "skip", "-prio", "0:high"}, []torrent.FilePriority{torrent.PRIORITY_HIGH, torrent.PRIORITY_SKIP, torrent.PRIORITY_SKIP}, false},
+		{[]string{"-prio", "3:skip"}, nil, true},
+		{[]string{"-default-prio", "bogus"}, nil, true},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+		apply := prioFlags(fs)
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		cfg := torrent.DefaultConfig()
+		err := apply(cfg, 3)
+		if (err != nil) != tt.err {
+			t.Errorf("%v: error %v", tt.args, err)
+			continue
+		}
+		if !tt.err && !slices.Equal(cfg.FilePriorities, tt.want) {
+			t.Errorf("%v: priorities %v, want %v", tt.args, cfg.FilePriorities, tt.want)
+		}
+	}
+}
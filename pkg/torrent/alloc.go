@@ -0,0 +1,105 @@
+package torrent
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type AllocMode int
+
+const (
+	ALLOC_SPARSE AllocMode = iota
+	ALLOC_FULL
+	ALLOC_NONE
+)
+
+func (m AllocMode) String() string {
+	switch m {
+	case ALLOC_SPARSE:
+		return "sparse"
+	case ALLOC_FULL:
+		return "full"
+	case ALLOC_NONE:
+		return "none"
+	}
+	return fmt.Sprintf("alloc(%d)", int(m))
+}
+
+func ParseAllocMode(s string) (AllocMode, error) {
+	switch strings.ToLower(s) {
+	case "sparse":
+		return ALLOC_SPARSE, nil
+	case "full":
+		return ALLOC_FULL, nil
+	case "none":
+		return ALLOC_NONE, nil
+	}
+	return ALLOC_SPARSE, fmt.Errorf("unknown allocation mode %q", s)
+}
+
+func allocateFile(f *os.File, size int64, mode AllocMode) error {
+	switch mode {
+	case ALLOC_NONE:
+		return nil
+	case ALLOC_FULL:
+		if err := fallocate(f, size); err != nil {
+			return err
+		}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == size {
+		return nil
+	}
+	return f.Truncate(size)
+}
+
+// writeZeros is the portable way to reserve blocks: it fills everything past
+// the current end of the file with zeros.
+func writeZeros(f *os.File, size int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, 1<<20)
+	for off := fi.Size(); off < size; {
+		n := min(int64(len(zeros)), size-off)
+		if _, err := f.WriteAt(zeros[:n], off); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+// requiredSpace is how many more bytes the wanted files need on disk, taking
+// into account blocks already allocated by a previous run.
+func requiredSpace(tf *TorrentFile, cfg *Config, paths []string) int64 {
+	need := int64(0)
+	for i, f := range tf.Files {
+		if f.Padding || f.SymlinkPath != "" || cfg.filePriority(i) == PRIORITY_SKIP {
+			continue
+		}
+		have := int64(0)
+		if fi, err := os.Stat(paths[i]); err == nil {
+			have = min(allocatedSize(fi), int64(f.Length))
+		}
+		need += int64(f.Length) - have
+	}
+	return need
+}
+
+func checkFreeSpace(dir string, need int64) error {
+	free, err := diskFree(dir)
+	if err != nil || free < 0 {
+		return nil
+	}
+	if need > free {
+		return fmt.Errorf("not enough disk space in %s: need %s, only %s available",
+			dir, formatBytes(float64(need)), formatBytes(float64(free)))
+	}
+	return nil
+}
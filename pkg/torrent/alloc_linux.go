@@ -0,0 +1,19 @@
+//go:build linux
+
+package torrent
+
+import (
+	"os"
+	"syscall"
+)
+
+func fallocate(f *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return writeZeros(f, size)
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package torrent
+
+import "os"
+
+func fallocate(f *os.File, size int64) error {
+	return writeZeros(f, size)
+}
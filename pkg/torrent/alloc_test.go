@@ -0,0 +1,40 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A fully allocated staged file still needs its whole length in the
+// download directory, where it will be copied to when the two differ.
+func TestRequiredSpaceCountsPendingMoves(t *testing.T) {
+	tf, _ := makeTorrent(t, "t", 16384, []testFile{{nil, randomBytes(40000)}})
+	cfg := DefaultConfig()
+	cfg.DownloadDir = t.TempDir()
+	cfg.IncompleteDir = t.TempDir()
+	cfg.Allocation = ALLOC_FULL
+	w, err := NewTorrentWriter(tf, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if need := requiredSpace(tf, cfg, w.paths); need != 0 {
+		t.Errorf("staging area needs %d more bytes, want 0", need)
+	}
+	if need := requiredSpace(tf, cfg, w.finals); need != 40000 {
+		t.Errorf("download directory needs %d bytes, want 40000", need)
+	}
+}
+
+func TestSameDevice(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	os.Mkdir(sub, 0755)
+	if !sameDevice(dir, sub) {
+		t.Fatal("a directory and its child reported on different devices")
+	}
+	if sameDevice(dir, filepath.Join(dir, "missing")) {
+		t.Fatal("a missing path reported on the same device")
+	}
+}
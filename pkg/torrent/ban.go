@@ -0,0 +1,149 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// suspectPiece keeps a copy of a piece that failed its hash check while
+// several peers had contributed to it. Once the piece verifies, each
+// block is compared against the good data to find who sent the bad one.
+type suspectPiece struct {
+	data    []byte
+	sources []*PeerCon
+}
+
+func (d *Downloader) banPath() string {
+	if d.cfg.BanFile != "" {
+		return d.cfg.BanFile
+	}
+	dir := d.cfg.ResumeDir
+	if dir == "" {
+		dir = d.cfg.DownloadDir
+	}
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Join(dir, BAN_FILE)
+}
+
+// loadBans reads the ban list, one address per line. Blank lines and lines
+// starting with # are ignored.
+func (d *Downloader) loadBans() error {
+	f, err := os.Open(d.banPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	d.banMu.Lock()
+	defer d.banMu.Unlock()
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if ip := net.ParseIP(line); ip != nil {
+			d.banned[ip.String()] = true
+		}
+	}
+	return scanner.Err()
+}
+
+func (d *Downloader) isBanned(ip net.IP) bool {
+	d.banMu.Lock()
+	defer d.banMu.Unlock()
+	return d.banned[ip.String()]
+}
+
+// ban disconnects the peer and refuses its address from now on, including
+// in later runs.
+func (d *Downloader) ban(p *PeerCon, reason string) {
+	p.con.Close()
+	ip := p.p.IP.String()
+	d.banMu.Lock()
+	if d.banned[ip] {
+		d.banMu.Unlock()
+		return
+	}
+	d.banned[ip] = true
+	d.banMu.Unlock()
+	d.Stats.PeersBanned.Add(1)
+	f, err := os.OpenFile(d.banPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Println("\nfailed to save ban list:", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "# %s\n%s\n", reason, ip)
+}
+
+// blame is called with a piece that failed its hash check. A lone
+// contributor is banned outright. When several peers, or resume data, added
+// blocks, each peer gets a strike and the data is kept so the culprit can
+// be found once the piece verifies.
+func (d *Downloader) blame(piece Piece) {
+	var peers []*PeerCon
+	unknown := false
+	for _, p := range piece.sources {
+		if p == nil {
+			unknown = true
+		} else if !containsPeer(peers, p) {
+			peers = append(peers, p)
+		}
+	}
+	if len(peers) == 0 {
+		return
+	}
+	if len(peers) == 1 && !unknown {
+		d.ban(peers[0], fmt.Sprintf("sent corrupt piece %d", piece.id))
+		return
+	}
+	d.mu.Lock()
+	d.suspects[int(piece.id)] = &suspectPiece{data: piece.data, sources: piece.sources}
+	d.mu.Unlock()
+	for _, p := range peers {
+		if p.hashFailures.Add(1) >= MAX_HASH_FAILURES {
+			d.ban(p, fmt.Sprintf("contributed to %d corrupt pieces", MAX_HASH_FAILURES))
+		}
+	}
+}
+
+// clearSuspects compares a piece that verified against the failed copy kept
+// for it and bans the peers whose blocks differed.
+func (d *Downloader) clearSuspects(piece Piece) {
+	d.mu.Lock()
+	sp, ok := d.suspects[int(piece.id)]
+	delete(d.suspects, int(piece.id))
+	d.mu.Unlock()
+	if !ok {
+		return
+	}
+	for b, p := range sp.sources {
+		if p == nil {
+			continue
+		}
+		start := b * REQUEST_BLOCK_SIZE
+		end := min(start+REQUEST_BLOCK_SIZE, len(piece.data))
+		if !bytes.Equal(sp.data[start:end], piece.data[start:end]) {
+			d.ban(p, fmt.Sprintf("sent a corrupt block of piece %d", piece.id))
+		}
+	}
+}
+
+func containsPeer(peers []*PeerCon, p *PeerCon) bool {
+	for _, q := range peers {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
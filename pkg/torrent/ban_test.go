@@ -0,0 +1,103 @@
+package torrent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// banPeers returns a downloader over two-block pieces and n peers on
+// distinct addresses, with the ban list kept in a temporary directory.
+func banPeers(t *testing.T, n int) (*Downloader, []byte, []*PeerCon) {
+	t.Helper()
+	tf, all := makeTorrent(t, "t", 2*REQUEST_BLOCK_SIZE, []testFile{{nil, randomBytes(4 * REQUEST_BLOCK_SIZE)}})
+	d := testDownloader(t, tf)
+	d.cfg.BanFile = filepath.Join(t.TempDir(), BAN_FILE)
+	var peers []*PeerCon
+	for i := range n {
+		p, _ := pipePeer(t, d)
+		p.p.IP = net.IPv4(10, 0, 0, byte(i+1))
+		peers = append(peers, p)
+	}
+	return d, all, peers
+}
+
+func corrupt(data []byte, at int) []byte {
+	bad := append([]byte{}, data...)
+	bad[at] ^= 1
+	return bad
+}
+
+func TestBlameLoneContributor(t *testing.T) {
+	d, all, peers := banPeers(t, 2)
+	piece := all[:2*REQUEST_BLOCK_SIZE]
+	d.storePiece(Piece{id: 0, data: corrupt(piece, 10), sources: []*PeerCon{peers[0], peers[0]}})
+	if !d.isBanned(peers[0].p.IP) {
+		t.Fatal("lone sender of a corrupt piece not banned")
+	}
+	if d.isBanned(peers[1].p.IP) {
+		t.Fatal("uninvolved peer banned")
+	}
+	list, err := os.ReadFile(d.cfg.BanFile)
+	if err != nil || !strings.Contains(string(list), "10.0.0.1\n") {
+		t.Fatalf("ban not saved: %q, %v", list, err)
+	}
+	// A later run starts with the saved ban.
+	d2, _, _ := banPeers(t, 0)
+	d2.cfg.BanFile = d.cfg.BanFile
+	if err := d2.loadBans(); err != nil || !d2.isBanned(peers[0].p.IP) {
+		t.Fatalf("ban not restored: %v", err)
+	}
+}
+
+// With several contributors nobody is banned for the failed piece; once
+// it verifies the failed copy shows whose block was bad.
+func TestBlameSharedPieceClearedByGoodPiece(t *testing.T) {
+	d, all, peers := banPeers(t, 3)
+	piece := all[:2*REQUEST_BLOCK_SIZE]
+	d.storePiece(Piece{id: 0, data: corrupt(piece, REQUEST_BLOCK_SIZE+5), sources: []*PeerCon{peers[0], peers[1]}})
+	for _, p := range peers {
+		if d.isBanned(p.p.IP) {
+			t.Fatalf("%v banned for a piece with several contributors", p.p.IP)
+		}
+	}
+	if peers[0].hashFailures.Load() != 1 || peers[1].hashFailures.Load() != 1 || peers[2].hashFailures.Load() != 0 {
+		t.Fatal("strikes not given to exactly the contributors")
+	}
+	d.storePiece(Piece{id: 0, data: piece, sources: []*PeerCon{peers[2], peers[2]}})
+	if !d.havePiece(0) {
+		t.Fatal("good piece not stored")
+	}
+	if !d.isBanned(peers[1].p.IP) {
+		t.Fatal("sender of the corrupt block not banned")
+	}
+	if d.isBanned(peers[0].p.IP) || d.isBanned(peers[2].p.IP) {
+		t.Fatal("honest peer banned")
+	}
+	d.mu.Lock()
+	left := len(d.suspects)
+	d.mu.Unlock()
+	if left != 0 {
+		t.Fatal("suspect copy kept after the piece verified")
+	}
+}
+
+// Blocks of unknown origin, as from resume data, keep a single peer from
+// taking the blame alone; it gets a strike and is banned only after
+// MAX_HASH_FAILURES of them.
+func TestBlameUnknownSource(t *testing.T) {
+	d, all, peers := banPeers(t, 1)
+	for i := range MAX_HASH_FAILURES {
+		if d.isBanned(peers[0].p.IP) {
+			t.Fatalf("banned after %d strikes", i)
+		}
+		index := i % 2
+		piece := all[index*2*REQUEST_BLOCK_SIZE : (index+1)*2*REQUEST_BLOCK_SIZE]
+		d.storePiece(Piece{id: int64(index), data: corrupt(piece, 0), sources: []*PeerCon{nil, peers[0]}})
+	}
+	if !d.isBanned(peers[0].p.IP) {
+		t.Fatalf("not banned after %d strikes", MAX_HASH_FAILURES)
+	}
+}
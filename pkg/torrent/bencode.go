@@ -86,8 +86,8 @@ func (b *bencodeObject) valAtIndex(index int) (bencodeObject, error) {
 }
 func readOneByte(r io.Reader) int {
 	buf := make([]byte, 1)
-	n, err := r.Read(buf)
-	if n == 0 || err != nil {
+	// A reader may return the last byte together with io.EOF.
+	if n, _ := r.Read(buf); n == 0 {
 		return -1
 	}
 	return int(buf[0])
@@ -175,3 +175,18 @@ func Unmarshal(r io.Reader, ben *bencodeObject) error {
 	}
 	return nil
 }
+func bencodeString(s string) bencodeObject {
+	return bencodeObject{objType: STRING, str: s}
+}
+func bencodeInt(v int64) bencodeObject {
+	return bencodeObject{objType: INT, val: v}
+}
+func bencodeList(items ...bencodeObject) bencodeObject {
+	return bencodeObject{objType: LIST, list: items}
+}
+
+// bencodeDict builds a dictionary from pairs, which must already be sorted
+// by key as bencode requires.
+func bencodeDict(pairs ...pair) bencodeObject {
+	return bencodeObject{objType: DICT, dict: pairs}
+}
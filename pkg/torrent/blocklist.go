@@ -0,0 +1,249 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ipRange struct {
+	start [16]byte
+	end   [16]byte
+}
+
+// Blocklist is a sorted set of non-overlapping address ranges. IPv4
+// addresses are kept in their IPv4-mapped IPv6 form so both families share
+// one table.
+type Blocklist struct {
+	mu      sync.RWMutex
+	ranges  []ipRange
+	path    string
+	modTime time.Time
+	size    int64
+	skipped int
+}
+
+// LoadBlocklist reads a blocklist in PeerGuardian P2P ("name:1.2.3.0-1.2.3.255"),
+// eMule DAT ("001.002.003.000 - 001.002.003.255 , 000 , name") or CIDR
+// ("1.2.3.0/24") format. Formats may be mixed line by line. Lines that fit
+// none of them are skipped and counted, see Skipped.
+func LoadBlocklist(path string) (*Blocklist, error) {
+	b := &Blocklist{path: path}
+	if err := b.reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Blocklist) reload() error {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	ranges, skipped, err := parseBlocklist(f)
+	if err != nil {
+		return fmt.Errorf("couldnt read blocklist %s: %v", b.path, err)
+	}
+	b.mu.Lock()
+	b.ranges = ranges
+	b.skipped = skipped
+	b.modTime = fi.ModTime()
+	b.size = fi.Size()
+	b.mu.Unlock()
+	return nil
+}
+
+// ReloadIfChanged rereads the file when its size or modification time
+// changed since the last load.
+func (b *Blocklist) ReloadIfChanged() (bool, error) {
+	fi, err := os.Stat(b.path)
+	if err != nil {
+		return false, err
+	}
+	b.mu.RLock()
+	same := fi.ModTime().Equal(b.modTime) && fi.Size() == b.size
+	b.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	return true, b.reload()
+}
+
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.ranges)
+}
+
+// Skipped is the number of malformed lines ignored by the last load.
+func (b *Blocklist) Skipped() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.skipped
+}
+
+func (b *Blocklist) Contains(ip net.IP) bool {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	var key [16]byte
+	copy(key[:], ip16)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	i := sort.Search(len(b.ranges), func(i int) bool {
+		return bytes.Compare(b.ranges[i].end[:], key[:]) >= 0
+	})
+	return i < len(b.ranges) && bytes.Compare(b.ranges[i].start[:], key[:]) <= 0
+}
+
+// parseBlocklist reads every range in r. Published lists often carry a few
+// broken lines, which are counted in skipped rather than failing the load.
+func parseBlocklist(r io.Reader) (ranges []ipRange, skipped int, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rng, ok, err := parseBlocklistLine(line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if ok {
+			ranges = append(ranges, rng)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return mergeRanges(ranges), skipped, nil
+}
+
+// parseBlocklistLine returns ok=false for DAT entries whose access level
+// allows the range. A line is DAT when an address range comes before its
+// first comma; P2P names may hold commas and dashes of their own.
+func parseBlocklistLine(line string) (ipRange, bool, error) {
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		if rng, err := parseIPRange(fields[0]); err == nil {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return ipRange{}, false, fmt.Errorf("invalid access level %q", fields[1])
+			}
+			return rng, level < DAT_ALLOW_LEVEL, nil
+		}
+	}
+	if strings.Contains(line, "/") {
+		_, ipnet, err := net.ParseCIDR(line)
+		if err != nil {
+			return ipRange{}, false, err
+		}
+		var rng ipRange
+		copy(rng.start[:], ipnet.IP.To16())
+		copy(rng.end[:], ipnet.IP.To16())
+		mask := ipnet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12:12], mask...)
+		}
+		for i := range rng.end {
+			rng.end[i] |= ^mask[i]
+		}
+		return rng, true, nil
+	}
+	if strings.Contains(line, "-") {
+		// P2P lines put the name first, and names may contain colons.
+		spec := line
+		if i := strings.LastIndex(line, ":"); i >= 0 && strings.Count(line[i+1:], ".") >= 6 {
+			spec = line[i+1:]
+		}
+		rng, err := parseIPRange(spec)
+		return rng, true, err
+	}
+	ip := parseLooseIP(line)
+	if ip == nil {
+		return ipRange{}, false, fmt.Errorf("unrecognised entry %q", line)
+	}
+	var rng ipRange
+	copy(rng.start[:], ip)
+	rng.end = rng.start
+	return rng, true, nil
+}
+
+func parseIPRange(spec string) (ipRange, error) {
+	lo, hi, ok := strings.Cut(spec, "-")
+	if !ok {
+		return ipRange{}, fmt.Errorf("invalid range %q", spec)
+	}
+	start, end := parseLooseIP(lo), parseLooseIP(hi)
+	if start == nil || end == nil || bytes.Compare(start, end) > 0 {
+		return ipRange{}, fmt.Errorf("invalid range %q", spec)
+	}
+	var rng ipRange
+	copy(rng.start[:], start)
+	copy(rng.end[:], end)
+	return rng, nil
+}
+
+// parseLooseIP accepts the zero-padded IPv4 octets DAT files use, which
+// net.ParseIP rejects, and returns a 16-byte address.
+func parseLooseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.Count(s, ".") == 3 && !strings.Contains(s, ":") {
+		parts := strings.Split(s, ".")
+		for i, part := range parts {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 || n > 255 {
+				return nil
+			}
+			parts[i] = strconv.Itoa(n)
+		}
+		s = strings.Join(parts, ".")
+	}
+	return net.ParseIP(s).To16()
+}
+
+func mergeRanges(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start[:], ranges[j].start[:]) < 0
+	})
+	var merged []ipRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && !after(r.start, merged[n-1].end) {
+			if bytes.Compare(r.end[:], merged[n-1].end[:]) > 0 {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// after reports whether a comes later than b+1, i.e. the two ranges ending
+// at b and starting at a cannot be joined.
+func after(a, b [16]byte) bool {
+	for i := 15; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			break
+		}
+		if i == 0 {
+			return false
+		}
+	}
+	return bytes.Compare(a[:], b[:]) > 0
+}
@@ -0,0 +1,76 @@
+package torrent
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseBlocklistLine(t *testing.T) {
+	tests := []struct {
+		line       string
+		start, end string
+		block      bool
+		bad        bool
+	}{
+		{"Some ISP:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255", true, false},
+		{"Foo-Bar, Inc.:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255", true, false},
+		{"a:b, c-d:10.0.0.1-10.0.0.9", "10.0.0.1", "10.0.0.9", true, false},
+		{"001.002.003.000 - 001.002.003.255 , 000 , name", "1.2.3.0", "1.2.3.255", true, false},
+		{"001.002.003.000 - 001.002.003.255 , 200 , allowed", "1.2.3.0", "1.2.3.255", false, false},
+		{"1.2.3.4 - 1.2.3.5 , x , name", "", "", false, true},
+		{"10.0.0.0/8", "10.0.0.0", "10.255.255.255", true, false},
+		{"192.168.1.7", "192.168.1.7", "192.168.1.7", true, false},
+		{"2001:db8::-2001:db8::ff", "2001:db8::", "2001:db8::ff", true, false},
+		{"name:1.2.3.9-1.2.3.0", "", "", false, true},
+		{"not an address", "", "", false, true},
+	}
+	for _, tt := range tests {
+		rng, ok, err := parseBlocklistLine(tt.line)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("%q: accepted", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if ok != tt.block {
+			t.Errorf("%q: block %v, want %v", tt.line, ok, tt.block)
+		}
+		if got := net.IP(rng.start[:]); !got.Equal(net.ParseIP(tt.start)) {
+			t.Errorf("%q: start %v, want %s", tt.line, got, tt.start)
+		}
+		if got := net.IP(rng.end[:]); !got.Equal(net.ParseIP(tt.end)) {
+			t.Errorf("%q: end %v, want %s", tt.line, got, tt.end)
+		}
+	}
+}
+
+func TestParseBlocklistSkipsMalformed(t *testing.T) {
+	list := strings.Join([]string{
+		"# comment",
+		"good:1.2.3.0-1.2.3.255",
+		"garbage line",
+		"bad:1.2.3.300-1.2.3.4",
+		"5.6.7.8",
+	}, "\n")
+	ranges, skipped, err := parseBlocklist(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 2 {
+		t.Errorf("skipped %d lines, want 2", skipped)
+	}
+	if len(ranges) != 2 {
+		t.Errorf("got %d ranges, want 2", len(ranges))
+	}
+	b := &Blocklist{ranges: ranges}
+	for ip, want := range map[string]bool{"1.2.3.4": true, "5.6.7.8": true, "5.6.7.9": false} {
+		if b.Contains(net.ParseIP(ip)) != want {
+			t.Errorf("Contains(%s) = %v, want %v", ip, !want, want)
+		}
+	}
+}
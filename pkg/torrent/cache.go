@@ -0,0 +1,324 @@
+package torrent
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type handleEntry struct {
+	path string
+	f    *os.File
+	refs int
+	elem *list.Element
+}
+
+// handleCache keeps up to max files open, closing the least recently used
+// idle handle when a new one is needed. Handles in use are never closed, so
+// the cache may briefly grow past max.
+type handleCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*handleEntry
+	lru     *list.List
+}
+
+func newHandleCache(max int) *handleCache {
+	if max <= 0 {
+		max = MAX_OPEN_FILES
+	}
+	return &handleCache{
+		max:     max,
+		entries: make(map[string]*handleEntry),
+		lru:     list.New(),
+	}
+}
+
+func (c *handleCache) acquire(path string, flag int) (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[path]; ok {
+		e.refs++
+		c.lru.MoveToFront(e.elem)
+		return e.f, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|flag|openNoFollow, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := &handleEntry{path: path, f: f, refs: 1}
+	e.elem = c.lru.PushFront(e)
+	c.entries[path] = e
+	c.evict()
+	return f, nil
+}
+
+func (c *handleCache) release(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[path]; ok {
+		e.refs--
+	}
+	c.evict()
+}
+
+func (c *handleCache) evict() {
+	for el := c.lru.Back(); el != nil && len(c.entries) > c.max; {
+		prev := el.Prev()
+		e := el.Value.(*handleEntry)
+		if e.refs == 0 {
+			e.f.Close()
+			c.lru.Remove(el)
+			delete(c.entries, e.path)
+		}
+		el = prev
+	}
+}
+
+// forget closes the handle for path so the file can be renamed or removed.
+func (c *handleCache) forget(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[path]; ok {
+		e.f.Close()
+		c.lru.Remove(e.elem)
+		delete(c.entries, path)
+	}
+}
+
+func (c *handleCache) closeAll() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var firstErr error
+	for path, e := range c.entries {
+		if err := e.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.entries, path)
+	}
+	c.lru.Init()
+	return firstErr
+}
+
+type dirtyBlock struct {
+	off  int64
+	data []byte
+}
+
+type dirtyFile struct {
+	mu     sync.Mutex
+	blocks []dirtyBlock
+	// flag is what the file is opened with when it is flushed to make
+	// room for writes to other files.
+	flag int
+}
+
+func (df *dirtyFile) size() int {
+	n := 0
+	for _, b := range df.blocks {
+		n += len(b.data)
+	}
+	return n
+}
+
+// add merges data into the sorted block list, joining it with every block it
+// overlaps or touches so that a flush issues one write per contiguous run.
+// It returns how much the buffered size grew.
+func (df *dirtyFile) add(off int64, data []byte) int {
+	end := off + int64(len(data))
+	lo := sort.Search(len(df.blocks), func(i int) bool {
+		b := df.blocks[i]
+		return b.off+int64(len(b.data)) >= off
+	})
+	hi := lo
+	start, stop := off, end
+	for hi < len(df.blocks) && df.blocks[hi].off <= end {
+		b := df.blocks[hi]
+		start = min(start, b.off)
+		stop = max(stop, b.off+int64(len(b.data)))
+		hi++
+	}
+	merged := make([]byte, stop-start)
+	old := 0
+	for _, b := range df.blocks[lo:hi] {
+		copy(merged[b.off-start:], b.data)
+		old += len(b.data)
+	}
+	copy(merged[off-start:], data)
+	blocks := append([]dirtyBlock{}, df.blocks[:lo]...)
+	blocks = append(blocks, dirtyBlock{off: start, data: merged})
+	df.blocks = append(blocks, df.blocks[hi:]...)
+	return len(merged) - old
+}
+
+func (df *dirtyFile) overlay(buf []byte, off int64) {
+	end := off + int64(len(buf))
+	for _, b := range df.blocks {
+		bEnd := b.off + int64(len(b.data))
+		if bEnd <= off || b.off >= end {
+			continue
+		}
+		s := max(b.off, off)
+		e := min(bEnd, end)
+		copy(buf[s-off:e-off], b.data[s-b.off:e-b.off])
+	}
+}
+
+// writeCache buffers writes per file until the total passes limit, a piece
+// completes or the storage is closed. Past the limit the files holding the
+// most are flushed first.
+type writeCache struct {
+	mu      sync.Mutex
+	files   map[string]*dirtyFile
+	total   atomic.Int64
+	limit   int64
+	handles *handleCache
+}
+
+func newWriteCache(limit int, handles *handleCache) *writeCache {
+	return &writeCache{
+		files:   make(map[string]*dirtyFile),
+		limit:   int64(limit),
+		handles: handles,
+	}
+}
+
+func (c *writeCache) file(path string) *dirtyFile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	df, ok := c.files[path]
+	if !ok {
+		df = &dirtyFile{}
+		c.files[path] = df
+	}
+	return df
+}
+
+func (c *writeCache) write(path string, data []byte, off int64, flag int) error {
+	if c.limit <= 0 {
+		f, err := c.handles.acquire(path, flag)
+		if err != nil {
+			return err
+		}
+		defer c.handles.release(path)
+		_, err = f.WriteAt(data, off)
+		return err
+	}
+	df := c.file(path)
+	df.mu.Lock()
+	grown := df.add(off, append([]byte{}, data...))
+	df.flag = flag
+	df.mu.Unlock()
+	c.total.Add(int64(grown))
+	for c.total.Load() > c.limit {
+		path, flag, ok := c.largest()
+		if !ok {
+			break
+		}
+		if err := c.flush(path, flag, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// largest returns the file with the most buffered data, if any.
+func (c *writeCache) largest() (string, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var path string
+	var flag, most int
+	for p, df := range c.files {
+		df.mu.Lock()
+		if n := df.size(); n > most {
+			path, flag, most = p, df.flag, n
+		}
+		df.mu.Unlock()
+	}
+	return path, flag, most > 0
+}
+
+// read fills buf from disk and then lays any buffered writes over it. A
+// missing file, or bytes past its end, read as zeros when allowMissing is
+// set; any other error is returned.
+func (c *writeCache) read(path string, buf []byte, off int64, allowMissing bool) error {
+	// Reading must not add an entry, or every file ever read would be
+	// synced on Flush.
+	c.mu.Lock()
+	df, ok := c.files[path]
+	c.mu.Unlock()
+	if !ok {
+		df = &dirtyFile{}
+	}
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	f, err := c.handles.acquire(path, 0)
+	if err != nil {
+		if !(allowMissing && os.IsNotExist(err)) {
+			return err
+		}
+	} else {
+		n, err := f.ReadAt(buf, off)
+		c.handles.release(path)
+		if err != nil && n != len(buf) && (err != io.EOF || !allowMissing) {
+			return err
+		}
+	}
+	df.overlay(buf, off)
+	return nil
+}
+
+func (c *writeCache) flush(path string, flag int, sync bool) error {
+	df := c.file(path)
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	if len(df.blocks) == 0 && !sync {
+		return nil
+	}
+	f, err := c.handles.acquire(path, flag)
+	if err != nil {
+		return err
+	}
+	defer c.handles.release(path)
+	for len(df.blocks) > 0 {
+		b := df.blocks[0]
+		if _, err := f.WriteAt(b.data, b.off); err != nil {
+			return err
+		}
+		df.blocks = df.blocks[1:]
+		c.total.Add(-int64(len(b.data)))
+	}
+	if sync {
+		return f.Sync()
+	}
+	return nil
+}
+
+// forget drops the entry for a path that has been flushed and is about to be
+// renamed.
+func (c *writeCache) forget(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if df, ok := c.files[path]; ok {
+		df.mu.Lock()
+		for _, b := range df.blocks {
+			c.total.Add(-int64(len(b.data)))
+		}
+		df.blocks = nil
+		df.mu.Unlock()
+		delete(c.files, path)
+	}
+}
+
+func (c *writeCache) paths() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	paths := make([]string, 0, len(c.files))
+	for p := range c.files {
+		paths = append(paths, p)
+	}
+	return paths
+}
@@ -0,0 +1,134 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type blockSpec struct {
+	off  int64
+	data string
+}
+
+func blocksOf(df *dirtyFile) []blockSpec {
+	var got []blockSpec
+	for _, b := range df.blocks {
+		got = append(got, blockSpec{b.off, string(b.data)})
+	}
+	return got
+}
+
+func TestDirtyFileAdd(t *testing.T) {
+	tests := []struct {
+		name  string
+		adds  []blockSpec
+		want  []blockSpec
+		grown int // by the last add
+	}{
+		{"apart", []blockSpec{{10, "bb"}, {0, "aa"}}, []blockSpec{{0, "aa"}, {10, "bb"}}, 2},
+		{"touch before", []blockSpec{{2, "bb"}, {0, "aa"}}, []blockSpec{{0, "aabb"}}, 2},
+		{"touch after", []blockSpec{{0, "aa"}, {2, "bb"}}, []blockSpec{{0, "aabb"}}, 2},
+		{"overlap", []blockSpec{{0, "aaaa"}, {2, "bbbb"}}, []blockSpec{{0, "aabbbb"}}, 2},
+		{"inside", []blockSpec{{0, "aaaaaa"}, {2, "bb"}}, []blockSpec{{0, "aabbaa"}}, 0},
+		{"covers", []blockSpec{{2, "aa"}, {0, "bbbbbb"}}, []blockSpec{{0, "bbbbbb"}}, 4},
+		{"bridges several", []blockSpec{{0, "aa"}, {4, "cc"}, {8, "ee"}, {12, "gg"}, {2, "BBxxDDyy"}},
+			[]blockSpec{{0, "aaBBxxDDyy"}, {12, "gg"}}, 4},
+		{"joins neighbours", []blockSpec{{0, "aa"}, {4, "cc"}, {2, "bb"}}, []blockSpec{{0, "aabbcc"}}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			df := &dirtyFile{}
+			grown := 0
+			for _, a := range tt.adds {
+				grown = df.add(a.off, []byte(a.data))
+			}
+			got := blocksOf(df)
+			if len(got) != len(tt.want) {
+				t.Fatalf("blocks %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("blocks %v, want %v", got, tt.want)
+				}
+			}
+			if grown != tt.grown {
+				t.Fatalf("grew by %d, want %d", grown, tt.grown)
+			}
+		})
+	}
+}
+
+func TestDirtyFileOverlay(t *testing.T) {
+	df := &dirtyFile{}
+	df.add(2, []byte("AB"))
+	df.add(8, []byte("CDE"))
+	tests := []struct {
+		off  int64
+		size int
+		want string
+	}{
+		{0, 12, "..AB....CDE."},
+		{3, 6, "B....C"},
+		{4, 4, "...."},
+		{9, 1, "D"},
+		{0, 2, ".."},
+	}
+	for _, tt := range tests {
+		buf := bytes.Repeat([]byte("."), tt.size)
+		df.overlay(buf, tt.off)
+		if string(buf) != tt.want {
+			t.Errorf("overlay at %d: %q, want %q", tt.off, buf, tt.want)
+		}
+	}
+}
+
+func TestWriteCacheReadAddsNoEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newWriteCache(1<<20, newHandleCache(0))
+	defer c.handles.closeAll()
+	buf := make([]byte, 5)
+	if err := c.read(path, buf, 0, false); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q: %v", buf, err)
+	}
+	if len(c.paths()) != 0 {
+		t.Fatalf("read added %v to the cache", c.paths())
+	}
+	if err := c.read(filepath.Join(t.TempDir(), "missing"), buf, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.paths()) != 0 {
+		t.Fatalf("read of a missing file added %v to the cache", c.paths())
+	}
+}
+
+// Passing the limit flushes whichever files hold the most until the total
+// is back under it, not just the file being written.
+func TestWriteCacheFlushesLargestPastLimit(t *testing.T) {
+	dir := t.TempDir()
+	c := newWriteCache(100, newHandleCache(0))
+	defer c.handles.closeAll()
+	big, small, next := filepath.Join(dir, "big"), filepath.Join(dir, "small"), filepath.Join(dir, "next")
+	if err := c.write(big, make([]byte, 90), 0, os.O_CREATE); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.write(small, make([]byte, 5), 0, os.O_CREATE); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.write(next, make([]byte, 10), 0, os.O_CREATE); err != nil {
+		t.Fatal(err)
+	}
+	if total := c.total.Load(); total > 100 {
+		t.Fatalf("%d bytes buffered past the limit", total)
+	}
+	if fi, err := os.Stat(big); err != nil || fi.Size() != 90 {
+		t.Fatalf("largest file not flushed: %v", err)
+	}
+	if _, err := os.Stat(next); !os.IsNotExist(err) {
+		t.Fatalf("small write flushed although the largest was enough: %v", err)
+	}
+}
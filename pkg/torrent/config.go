@@ -0,0 +1,64 @@
+package torrent
+
+import "time"
+
+type Config struct {
+	DownloadDir    string
+	FilePriorities []FilePriority
+	Sequential     bool
+	ReadAhead      int
+	Storage        Storage
+	OpenFiles      int
+	WriteCacheSize int
+	DiskWorkers    int
+	Allocation     AllocMode
+	// IncompleteDir, when set, holds files until they are verified and
+	// moved into DownloadDir. PartSuffix appends ".part" to them meanwhile.
+	// MoveEachFile moves every file as soon as it completes instead of
+	// waiting for the whole torrent.
+	IncompleteDir string
+	PartSuffix    bool
+	MoveEachFile  bool
+	// ResumeDir holds resume files, DownloadDir when empty. They are saved
+	// every ResumeInterval and when the downloader is closed.
+	ResumeDir      string
+	ResumeInterval time.Duration
+	// Repair, when set, has a bit for every piece to fetch again; all
+	// others are taken as good and resume data is ignored.
+	Repair Bitfield
+	// BanFile lists addresses banned for sending corrupt data. It defaults
+	// to a file in ResumeDir.
+	BanFile string
+	// BlocklistFile is a P2P, DAT or CIDR list of addresses never to talk
+	// to. It is reloaded when it changes.
+	BlocklistFile string
+	// ListenPort accepts incoming peers when non-zero.
+	ListenPort int
+	// Encryption decides whether peer connections use MSE, both ways.
+	Encryption EncryptionPolicy
+	// UTP dials peers over uTP as well as TCP, keeping whichever connects
+	// first, and accepts uTP peers on ListenPort.
+	UTP bool
+	// Extensions are custom BEP 10 extensions offered to peers alongside
+	// the built-in ones.
+	Extensions []Extension
+	// Seed keeps serving peers once the download is complete, until the
+	// downloader is closed. SuperSeed also seeds, revealing pieces to
+	// peers one at a time (BEP 16) once we have all we want.
+	Seed      bool
+	SuperSeed bool
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		DownloadDir:    ".",
+		ReadAhead:      READ_AHEAD_PIECES,
+		Storage:        FileStorage{},
+		OpenFiles:      MAX_OPEN_FILES,
+		WriteCacheSize: WRITE_CACHE_SIZE,
+		DiskWorkers:    DISK_WORKERS,
+		ResumeInterval: RESUME_INTERVAL,
+		Encryption:     ENCRYPTION_PREFER,
+		UTP:            true,
+	}
+}
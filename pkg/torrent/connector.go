@@ -64,9 +64,13 @@ func (c *UDPConnector) Close() error {
 	return nil
 }
 
+// TCPConnector carries a peer connection. con is a *net.TCPConn or a uTP
+// stream, possibly wrapped by stream encryption. When utp is set, dial
+// tries both transports at once.
 type TCPConnector struct {
 	addr *net.TCPAddr
-	con  *net.TCPConn
+	con  net.Conn
+	utp  *utpSocket
 }
 
 func NewTCPConnector(p *Peer) *TCPConnector {
@@ -78,6 +82,22 @@ func NewTCPConnector(p *Peer) *TCPConnector {
 	tcon.SetDestination(&addr)
 	return &tcon
 }
+
+// newAcceptedTCPConnector wraps a connection a peer opened to us.
+func newAcceptedTCPConnector(conn net.Conn) *TCPConnector {
+	ip, port, _ := remoteIPPort(conn)
+	return &TCPConnector{addr: &net.TCPAddr{IP: ip, Port: port}, con: conn}
+}
+
+func remoteIPPort(conn net.Conn) (net.IP, int, bool) {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP, addr.Port, true
+	case *net.UDPAddr:
+		return addr.IP, addr.Port, true
+	}
+	return nil, 0, false
+}
 func (c *TCPConnector) SetDestinationTo(remoteAddr string) error {
 	addr, err := net.ResolveTCPAddr("tcp", remoteAddr)
 	if err != nil {
@@ -93,14 +113,72 @@ func (c *TCPConnector) SetDestination(addr *net.TCPAddr) {
 	}
 	c.addr = addr
 }
-func (c *TCPConnector) Send(buf []byte) error {
-	if c.con == nil {
-		d := net.Dialer{Timeout: 5 * time.Second}
+func (c *TCPConnector) dial() error {
+	d := net.Dialer{Timeout: PEER_DIAL_TIMEOUT}
+	if c.utp == nil {
 		conn, err := d.Dial("tcp", c.addr.String())
 		if err != nil {
 			return err
 		}
-		c.con = conn.(*net.TCPConn)
+		c.con = conn
+		return nil
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	go func() {
+		conn, err := d.Dial("tcp", c.addr.String())
+		results <- result{conn, err}
+	}()
+	go func() {
+		conn, err := c.utp.Dial(&net.UDPAddr{IP: c.addr.IP, Port: c.addr.Port}, PEER_DIAL_TIMEOUT)
+		results <- result{conn, err}
+	}()
+	var firstErr error
+	for i := range 2 {
+		r := <-results
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		c.con = r.conn
+		if i == 0 {
+			// The slower transport is not needed; drop it if it connects.
+			go func() {
+				if late := <-results; late.err == nil {
+					late.conn.Close()
+				}
+			}()
+		}
+		return nil
+	}
+	return firstErr
+}
+
+// dialEncrypted connects and runs the MSE handshake, offering the methods
+// in provide.
+func (c *TCPConnector) dialEncrypted(skey [20]byte, provide uint32) error {
+	if err := c.dial(); err != nil {
+		return err
+	}
+	conn, err := mseInitiate(c.con, skey, provide)
+	if err != nil {
+		c.con.Close()
+		c.con = nil
+		return err
+	}
+	c.con = conn
+	return nil
+}
+func (c *TCPConnector) Send(buf []byte) error {
+	if c.con == nil {
+		if err := c.dial(); err != nil {
+			return err
+		}
 	}
 	_, err := c.con.Write(buf)
 	return err
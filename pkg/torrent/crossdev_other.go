@@ -0,0 +1,14 @@
+//go:build !windows
+
+package torrent
+
+import (
+	"errors"
+	"syscall"
+)
+
+// crossDevice reports whether a rename failed only because source and
+// destination are on different filesystems.
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
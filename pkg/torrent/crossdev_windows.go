@@ -0,0 +1,15 @@
+//go:build windows
+
+package torrent
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ERROR_NOT_SAME_DEVICE is what MoveFileEx reports across volumes.
+const errNotSameDevice = syscall.Errno(17)
+
+func crossDevice(err error) bool {
+	return errors.Is(err, errNotSameDevice)
+}
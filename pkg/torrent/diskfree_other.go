@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package torrent
+
+// without statfs the free space is unknown and the check is skipped.
+func diskFree(dir string) (int64, error) {
+	return -1, nil
+}
@@ -1,11 +1,8 @@
 package torrent
 
 import (
-	"bytes"
-	"crypto/sha1"
 	"fmt"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 )
@@ -13,6 +10,10 @@ import (
 type Piece struct {
 	id   int64
 	data []byte
+	// sources holds the peer each block came from, nil when unknown.
+	sources []*PeerCon
+	// verified is set when the piece already passed its hash check.
+	verified bool
 }
 
 type Downloader struct {
@@ -22,50 +23,170 @@ type Downloader struct {
 	requested    Bitfield
 	mu           sync.Mutex
 	downloadOver chan struct{}
+	closed       chan struct{}
+	closeOnce    sync.Once
 	tf           *TorrentFile
+	cfg          *Config
 	piecesDone   int
-	writer       *TorrentWriter
+	storage      TorrentStorage
 	pexCh        chan string
 	seenPeers    map[string]bool
 	seenMu       sync.Mutex
 	Stats        Stats
+	filePrio     []FilePriority
+	piecePrio    []FilePriority
+	completeOnce sync.Once
+	readers      map[*fileReader]struct{}
+	pieceCond    *sync.Cond
+	partial      map[int]*partialPiece
+	trackers     map[string]*trackerState
+	fixed        []int
+	suspects     map[int]*suspectPiece
+	banned       map[string]bool
+	banMu        sync.Mutex
+	blocklist    *Blocklist
+	listener     net.Listener
+	utp          *utpSocket
+	exts         *extensionRegistry
+	super        *superSeeder
+	// waiting has a channel for every claimed piece, closed once the piece
+	// is assembled from whichever peers' blocks completed it.
+	waiting map[int]chan struct{}
+	// diskMu is held shared while a piece is written and exclusively while
+	// resume data is captured, so the bitfield and file states agree.
+	diskMu sync.RWMutex
 }
 
-func NewDownloader(tf *TorrentFile) (*Downloader, error) {
-	writer, err := NewTorrentWriter(tf, nil)
+func NewDownloader(tf *TorrentFile, cfg *Config) (*Downloader, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = FileStorage{}
+	}
+	storage, err := cfg.Storage.OpenTorrent(tf, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create torrent writer: %v", err)
+		return nil, fmt.Errorf("failed to open storage: %v", err)
 	}
-	bfSize := len(tf.PieceHashes)/8 + 1
+	bfSize := tf.NumPieces()/8 + 1
 	down := &Downloader{
 		field:        make(Bitfield, bfSize),
 		requested:    make(Bitfield, bfSize),
 		pieceQueue:   make(chan Piece, PIECE_QUEUE),
 		downloadOver: make(chan struct{}),
+		closed:       make(chan struct{}),
 		tf:           tf,
-		writer:       writer,
+		cfg:          cfg,
+		storage:      storage,
 		pexCh:        make(chan string, PEX_CHANNEL),
 		seenPeers:    make(map[string]bool),
+		filePrio:     make([]FilePriority, len(tf.Files)),
+		readers:      make(map[*fileReader]struct{}),
+		partial:      make(map[int]*partialPiece),
+		waiting:      make(map[int]chan struct{}),
+		trackers:     make(map[string]*trackerState),
+		suspects:     make(map[int]*suspectPiece),
+		banned:       make(map[string]bool),
+	}
+	down.pieceCond = sync.NewCond(&down.mu)
+	if cfg.ReadAhead <= 0 {
+		cfg.ReadAhead = READ_AHEAD_PIECES
+	}
+	for i := range down.filePrio {
+		down.filePrio[i] = cfg.filePriority(i)
+	}
+	down.piecePrio = tf.piecePriorities(cfg.filePriority)
+	if cfg.ResumeInterval <= 0 {
+		cfg.ResumeInterval = RESUME_INTERVAL
+	}
+	if cfg.SuperSeed {
+		cfg.Seed = true
+		down.super = newSuperSeeder(tf.NumPieces())
+	}
+	if cfg.BlocklistFile != "" {
+		down.blocklist, err = LoadBlocklist(cfg.BlocklistFile)
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+		if n := down.blocklist.Skipped(); n > 0 {
+			fmt.Printf("skipped %d malformed blocklist lines\n", n)
+		}
+	}
+	down.exts, err = newExtensionRegistry(append(builtinExtensions(), cfg.Extensions...)...)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	if cfg.UTP {
+		down.utp, err = listenUTP(fmt.Sprintf(":%d", cfg.ListenPort))
+		if err != nil {
+			fmt.Println("failed to open utp socket:", err)
+		}
 	}
+	if err := down.loadBans(); err != nil {
+		fmt.Println("failed to load ban list:", err)
+	}
+	var knownPeers []string
+	if cfg.Repair != nil {
+		if err := down.applyRepair(); err != nil {
+			storage.Close()
+			return nil, err
+		}
+	} else {
+		knownPeers = down.restoreResume()
+	}
+	// Completion is settled before the first announce, so a partial seed
+	// says so from the start.
+	down.checkComplete()
 	limit := make(chan struct{}, DISCOVERY_LIMIT)
-	writer.d = down
 	down.Stats.StartTime = time.Now()
 	down.Stats.TotalSize = tf.DownloadLength()
-	go down.processResults()
+	if cfg.DiskWorkers <= 0 {
+		cfg.DiskWorkers = DISK_WORKERS
+	}
+	for range cfg.DiskWorkers {
+		go down.processResults()
+	}
 	confirm := make(chan *PeerCon, CONFIRMED_PEER_QUEUE)
 
 	go down.startDiscovery(confirm, limit)
 	go down.processPEX(confirm, limit)
 	go down.manageNewPeers(confirm)
+	go down.dialKnownPeers(knownPeers, confirm, limit)
+	for _, u := range tf.WebSeeds {
+		go down.runHTTPSource(newWebSeed(u, tf), WEBSEED_BACKOFF)
+	}
+	for _, u := range tf.HTTPSeeds {
+		go down.runHTTPSource(newHTTPSeed(u, tf), WEBSEED_BACKOFF)
+	}
+	if down.blocklist != nil {
+		go down.watchBlocklist()
+	}
+	if cfg.ListenPort > 0 {
+		if err := down.listen(confirm); err != nil {
+			fmt.Println("failed to accept incoming peers:", err)
+		}
+	}
+	if _, ok := storage.(FileStater); ok {
+		go down.saveResumeLoop()
+	}
 
 	return down, nil
 }
 
-func (d *Downloader) attemptConnection(p Peer, limit chan struct{}, confirm chan *PeerCon) {
+func (d *Downloader) attemptConnection(p Peer, infoHash [20]byte, limit chan struct{}, confirm chan *PeerCon) {
+	if d.isBanned(p.IP) {
+		return
+	}
+	if d.isBlocked(p.IP) {
+		d.Stats.BlockedOutbound.Add(1)
+		return
+	}
 	limit <- struct{}{}
 	defer func() { <-limit }()
 	d.Stats.PeersProcessed.Add(1)
-	n := NewPeerCon(d.tf, &p, d.field, d.pexCh)
+	n := d.newPeerCon(&p, infoHash)
 	if err := n.ShakeHands(); err == nil {
 		d.Stats.PeersConfirmed.Add(1)
 		confirm <- n
@@ -74,10 +195,19 @@ func (d *Downloader) attemptConnection(p Peer, limit chan struct{}, confirm chan
 	}
 }
 
+// newPeerCon sets up a peer connection with the downloader's settings.
+func (d *Downloader) newPeerCon(p *Peer, infoHash [20]byte) *PeerCon {
+	n := NewPeerCon(d.tf, p, infoHash, d.field, d.pexCh)
+	n.encryption = d.cfg.Encryption
+	n.con.utp = d.utp
+	n.exts = d.exts
+	return n
+}
+
 func (d *Downloader) startDiscovery(confirm chan *PeerCon, limit chan struct{}) {
 	for {
 		select {
-		case <-d.downloadOver:
+		case <-d.stopped():
 			return
 		default:
 		}
@@ -85,51 +215,78 @@ func (d *Downloader) startDiscovery(confirm chan *PeerCon, limit chan struct{})
 		d.Stats.ValidTrackers.Store(0)
 		for _, tier := range d.tf.AnnounceList {
 			for _, announceURL := range tier {
-				go func(url string) {
-					var peers []Peer
-					var err error
-					switch url[0] {
-					case 'h':
-						tracker := NewHTTPTracker(url)
-						peers, err = tracker.hc.getPeers(d.tf)
-					case 'u':
-						tracker, err := NewUDPTracker(url)
-						if err == nil {
-							peers, err = tracker.getPeers(d.tf)
-						}
-					}
-
-					if err != nil || len(peers) == 0 {
-						return
-					}
-
-					d.Stats.ValidTrackers.Add(1)
-
-					for _, v := range peers {
-						addr := fmt.Sprintf("%s:%d", v.IP.String(), v.port)
-
-						d.seenMu.Lock()
-						if d.seenPeers[addr] {
-							d.seenMu.Unlock()
-							continue
-						}
-						d.seenPeers[addr] = true
-						d.Stats.PeersProvided.Add(1)
-						d.seenMu.Unlock()
-
-						go d.attemptConnection(v, limit, confirm)
-					}
-				}(announceURL)
+				for _, infoHash := range d.tf.SwarmHashes() {
+					go d.announce(announceURL, infoHash, confirm, limit)
+				}
 			}
 		}
 		time.Sleep(1 * time.Minute)
 	}
 }
 
+func (d *Downloader) announce(url string, infoHash [20]byte, confirm chan *PeerCon, limit chan struct{}) {
+	if url == "" {
+		return
+	}
+	var peers []Peer
+	var err error
+	event := ""
+	if d.partialSeed() {
+		event = "paused"
+	}
+	switch url[0] {
+	case 'h':
+		tracker := NewHTTPTracker(url)
+		peers, err = tracker.hc.getPeers(d.bytesLeft(), infoHash, d.announcePort(), event)
+	case 'u':
+		var tracker *UDPTracker
+		tracker, err = NewUDPTracker(url)
+		if err == nil {
+			peers, err = tracker.getPeers(d.bytesLeft(), infoHash, d.announcePort(), event)
+		}
+	}
+
+	d.seenMu.Lock()
+	ts, ok := d.trackers[url]
+	if !ok {
+		ts = &trackerState{}
+		d.trackers[url] = ts
+	}
+	if err != nil {
+		ts.Failures++
+	} else {
+		ts.LastAnnounce = time.Now()
+		ts.Peers = len(peers)
+		ts.Failures = 0
+	}
+	d.seenMu.Unlock()
+
+	if err != nil || len(peers) == 0 {
+		return
+	}
+
+	d.Stats.ValidTrackers.Add(1)
+
+	for _, v := range peers {
+		addr := fmt.Sprintf("%s:%d", v.IP.String(), v.port)
+
+		d.seenMu.Lock()
+		if d.seenPeers[addr] {
+			d.seenMu.Unlock()
+			continue
+		}
+		d.seenPeers[addr] = true
+		d.Stats.PeersProvided.Add(1)
+		d.seenMu.Unlock()
+
+		go d.attemptConnection(v, infoHash, limit, confirm)
+	}
+}
+
 func (d *Downloader) processPEX(confirm chan *PeerCon, limit chan struct{}) {
 	for {
 		select {
-		case <-d.downloadOver:
+		case <-d.stopped():
 			return
 		case addr := <-d.pexCh:
 			d.Stats.PexProcessed.Add(1)
@@ -140,27 +297,42 @@ func (d *Downloader) processPEX(confirm chan *PeerCon, limit chan struct{}) {
 			}
 			d.seenPeers[addr] = true
 			d.seenMu.Unlock()
-			go func(address string) {
-				host, portStr, err := net.SplitHostPort(address)
-				if err != nil {
-					return
-				}
-				port, _ := strconv.Atoi(portStr)
-				p := Peer{
-					IP:   net.ParseIP(host),
-					port: uint16(port),
-				}
-				d.Stats.PexAdded.Add(1)
-				d.attemptConnection(p, limit, confirm)
-			}(addr)
+			p, err := parsePeerAddr(addr)
+			if err != nil {
+				continue
+			}
+			if d.isBlocked(p.IP) {
+				d.Stats.BlockedOutbound.Add(1)
+				continue
+			}
+			d.Stats.PexAdded.Add(1)
+			go d.attemptConnection(p, d.tf.InfoHash, limit, confirm)
 		}
 	}
 }
 
+// dialKnownPeers reconnects to the peers remembered in resume data.
+func (d *Downloader) dialKnownPeers(addrs []string, confirm chan *PeerCon, limit chan struct{}) {
+	for _, addr := range addrs {
+		d.seenMu.Lock()
+		if d.seenPeers[addr] {
+			d.seenMu.Unlock()
+			continue
+		}
+		d.seenPeers[addr] = true
+		d.seenMu.Unlock()
+		p, err := parsePeerAddr(addr)
+		if err != nil {
+			continue
+		}
+		go d.attemptConnection(p, d.tf.InfoHash, limit, confirm)
+	}
+}
+
 func (d *Downloader) manageNewPeers(confirm chan *PeerCon) {
 	for {
 		select {
-		case <-d.downloadOver:
+		case <-d.stopped():
 			return
 		case ans := <-confirm:
 			if ans != nil {
@@ -173,33 +345,96 @@ func (d *Downloader) manageNewPeers(confirm chan *PeerCon) {
 func (d *Downloader) AddPeer(p *PeerCon) {
 	d.peerMu.Lock()
 	defer d.peerMu.Unlock()
-	peerPieces := make(chan Piece)
+	peerDone := make(chan struct{})
 	go func() {
-		p.DownloadLoop(d, peerPieces)
-		close(peerPieces)
+		p.DownloadLoop(d)
+		close(peerDone)
 	}()
-	go d.startRequestWorker(p, peerPieces)
+	go d.startRequestWorker(p, peerDone)
 }
 
 func (d *Downloader) PickPiece(peerBitfield Bitfield) (int, bool) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	for i := 0; i < len(d.tf.PieceHashes); i++ {
-		if !d.field.HasPiece(i) && !d.requested.HasPiece(i) && peerBitfield.HasPiece(i) {
-			d.requested.SetPiece(i)
+	available := func(i int) bool {
+		return !d.field.HasPiece(i) && !d.requested.HasPiece(i) && peerBitfield.HasPiece(i)
+	}
+	for _, i := range d.urgentPieces() {
+		if available(i) {
+			d.claim(i)
+			return i, true
+		}
+	}
+	if d.cfg.Sequential {
+		if i := d.sequentialPiece(available); i >= 0 {
+			d.claim(i)
 			return i, true
 		}
 	}
-	return 0, false
+	best := -1
+	for i := 0; i < d.tf.NumPieces(); i++ {
+		if d.piecePrio[i] == PRIORITY_SKIP || (best >= 0 && d.piecePrio[i] <= d.piecePrio[best]) {
+			continue
+		}
+		if available(i) {
+			best = i
+			if d.piecePrio[i] == PRIORITY_HIGH {
+				break
+			}
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	d.claim(best)
+	return best, true
+}
+
+// claim marks a piece as requested. Caller must hold d.mu.
+func (d *Downloader) claim(index int) {
+	d.requested.SetPiece(index)
+	if _, ok := d.waiting[index]; !ok {
+		d.waiting[index] = make(chan struct{})
+	}
+}
+
+// assembled returns a channel that is closed once the claimed piece has
+// all its blocks.
+func (d *Downloader) assembled(index int) <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ch, ok := d.waiting[index]
+	if !ok {
+		ch = make(chan struct{})
+		close(ch)
+	}
+	return ch
+}
+
+// markAssembled wakes whoever claimed the piece. Caller must hold d.mu.
+func (d *Downloader) markAssembled(index int) {
+	if ch, ok := d.waiting[index]; ok {
+		close(ch)
+		delete(d.waiting, index)
+	}
 }
 
-func (d *Downloader) startRequestWorker(p *PeerCon, peerPieces chan Piece) {
+// startRequestWorker requests pieces from p until the download completes or
+// the peer goes away, which closes peerDone. Completed pieces reach the
+// disk workers straight from the message loop, so the worker only waits
+// for its piece to be assembled, possibly by blocks from other peers.
+func (d *Downloader) startRequestWorker(p *PeerCon, peerDone chan struct{}) {
 	d.Stats.NumPeers.Add(1)
 	defer d.Stats.NumPeers.Add(-1)
 
 	const BlockSize = REQUEST_BLOCK_SIZE
 
 	timeChoked := int64(0)
+	defer func() {
+		if d.uploadOnly() {
+			p.becomeUploadOnly(d)
+		}
+	}()
 
 	failPiece := func(index int) {
 		d.mu.Lock()
@@ -216,70 +451,160 @@ func (d *Downloader) startRequestWorker(p *PeerCon, peerPieces chan Piece) {
 		default:
 		}
 
-		for p.choked {
+		// A choked fast peer may still serve its allowed fast pieces.
+		index, found := d.pickFast(p, p.choked.Load())
+		for !found && p.choked.Load() {
 			time.Sleep(100 * time.Millisecond)
 			if timeChoked >= int64(MAX_CHOKED_TIME) {
 				p.con.Close()
 				return
 			}
 			timeChoked += int64(100 * time.Millisecond)
-			continue
+			index, found = d.pickFast(p, p.choked.Load())
 		}
 		timeChoked = 0
 
-		d.Stats.Searching.Add(1)
-		index, found := d.PickPiece(p.peerBitfield)
-		d.Stats.Searching.Add(-1)
+		if !found {
+			d.Stats.Searching.Add(1)
+			index, found = d.PickPiece(p.peerPieces())
+			d.Stats.Searching.Add(-1)
+		}
 
 		if !found {
 			d.Stats.NotFound.Add(1)
+			// Everything the peer had may be finished by now.
+			if p.updateInterest(d.wantsFrom(p.peerPieces())) != nil {
+				return
+			}
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		if !d.awaitPieceHash(p, index) {
+			d.mu.Lock()
+			d.requested.ClearPiece(index)
+			d.mu.Unlock()
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
 		d.Stats.CurrentlyDownloading.Add(1)
-		pieceSize := d.tf.PieceLength
-		if int64(index) == int64(len(d.tf.PieceHashes)-1) {
-			pieceSize = d.tf.Length - (int(index) * d.tf.PieceLength)
+		pieceSize := d.tf.PieceSize(index)
+		// Requests are gathered while backlog slots are free and sent
+		// together, so a piece usually costs a single write.
+		var batch [][3]int
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			err := p.SendRequests(batch)
+			batch = batch[:0]
+			return err
 		}
 		for offset := 0; offset < pieceSize; offset += BlockSize {
 			currentBlockSize := BlockSize
 			if offset+currentBlockSize > pieceSize {
 				currentBlockSize = pieceSize - offset
 			}
+			if d.hasBlock(index, offset) {
+				continue
+			}
 
 			select {
 			case <-p.backlog:
-			case <-time.After(15 * time.Second):
-				failPiece(index)
-				p.con.Close()
-				return
-			case <-d.downloadOver:
-				return
+			default:
+				if err := flush(); err != nil {
+					failPiece(index)
+					return
+				}
+				select {
+				case <-p.backlog:
+				case <-time.After(15 * time.Second):
+					failPiece(index)
+					p.con.Close()
+					return
+				case <-d.downloadOver:
+					return
+				}
 			}
+			batch = append(batch, [3]int{index, offset, currentBlockSize})
+		}
+		if err := flush(); err != nil {
+			failPiece(index)
+			return
+		}
 
-			if err := p.SendRequest(int(index), offset, currentBlockSize); err != nil {
+		done := d.assembled(index)
+		timeout := time.After(30 * time.Second)
+	wait:
+		for {
+			select {
+			case <-done:
+				d.Stats.CurrentlyDownloading.Add(-1)
+				break wait
+			case <-peerDone:
 				failPiece(index)
 				return
-			}
-		}
-
-		select {
-		case piece, ok := <-peerPieces:
-			d.Stats.CurrentlyDownloading.Add(-1)
-			if !ok {
+			case rejected := <-p.rejects:
+				// Rejects for pieces given up earlier are stale. Blocks
+				// already received stay in the partial piece for whoever
+				// picks it up next.
+				if rejected == index {
+					failPiece(index)
+					break wait
+				}
+			case <-timeout:
 				failPiece(index)
+				p.con.Close()
 				return
 			}
-			d.pieceQueue <- piece
-		case <-time.After(30 * time.Second):
-			failPiece(index)
-			p.con.Close()
-			return
 		}
 	}
 }
 
+// receiveBlock stores a block in its piece's partial buffer and hands back
+// the piece once every block has arrived.
+func (d *Downloader) receiveBlock(p *PeerCon, index int, begin int, block []byte) (Piece, bool) {
+	if index < 0 || index >= d.tf.NumPieces() {
+		return Piece{}, false
+	}
+	size := d.tf.PieceSize(index)
+	if begin%REQUEST_BLOCK_SIZE != 0 || begin+len(block) > size || len(block) != min(REQUEST_BLOCK_SIZE, size-begin) {
+		return Piece{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.field.HasPiece(index) {
+		return Piece{}, false
+	}
+	pp, ok := d.partial[index]
+	if !ok {
+		pp = newPartialPiece(size)
+		d.partial[index] = pp
+	}
+	b := begin / REQUEST_BLOCK_SIZE
+	if pp.blocks.HasPiece(b) {
+		return Piece{}, false
+	}
+	copy(pp.data[begin:], block)
+	pp.blocks.SetPiece(b)
+	pp.sources[b] = p
+	pp.received += len(block)
+	if pp.received < size {
+		return Piece{}, false
+	}
+	delete(d.partial, index)
+	d.markAssembled(index)
+	return Piece{id: int64(index), data: pp.data, sources: pp.sources}, true
+}
+
+func (d *Downloader) hasBlock(index int, begin int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pp, ok := d.partial[index]
+	return ok && pp.blocks.HasPiece(begin/REQUEST_BLOCK_SIZE)
+}
+
 func (d *Downloader) PrintLogs() {
 	logTicker := time.NewTicker(1 * time.Second)
 	defer logTicker.Stop()
@@ -289,51 +614,124 @@ func (d *Downloader) PrintLogs() {
 	}
 }
 
+// processResults is run by every disk worker; pieces are hashed and written
+// by whichever worker picks them off the queue.
 func (d *Downloader) processResults() {
 	for {
 		select {
 		case <-d.downloadOver:
 			return
 		case piece := <-d.pieceQueue:
-			d.mu.Lock()
-			if d.field.HasPiece(int(piece.id)) {
-				d.mu.Unlock()
-				continue
-			}
-			d.mu.Unlock()
+			d.storePiece(piece)
+		}
+	}
+}
 
-			hash := sha1.Sum(piece.data)
-			expected := d.tf.PieceHashes[piece.id]
-			if !bytes.Equal(hash[:], expected[:]) {
-				d.mu.Lock()
-				d.requested.ClearPiece(int(piece.id))
-				d.mu.Unlock()
-				d.Stats.Failed.Add(1)
-				continue
-			}
+func (d *Downloader) storePiece(piece Piece) {
+	d.mu.Lock()
+	if d.field.HasPiece(int(piece.id)) {
+		d.mu.Unlock()
+		return
+	}
+	d.mu.Unlock()
 
-			if err := d.writer.Write(int(piece.id), 0, piece.data); err != nil {
-				d.mu.Lock()
-				d.requested.ClearPiece(int(piece.id))
-				d.mu.Unlock()
-				d.Stats.Failed.Add(1)
-				continue
-			}
+	if !piece.verified && !d.tf.VerifyPiece(int(piece.id), piece.data) {
+		d.mu.Lock()
+		d.requested.ClearPiece(int(piece.id))
+		d.mu.Unlock()
+		d.Stats.Failed.Add(1)
+		// Without its hash a v2 piece could not be checked at all.
+		if d.tf.HasV1 || !d.tf.HasV2 || d.tf.pieceHashKnown(int(piece.id)) {
+			d.blame(piece)
+		}
+		return
+	}
+	d.clearSuspects(piece)
 
-			d.mu.Lock()
-			d.field.SetPiece(int(piece.id))
-			d.piecesDone++
-			d.mu.Unlock()
+	d.diskMu.RLock()
+	defer d.diskMu.RUnlock()
+	if _, err := d.storage.WriteAt(int(piece.id), piece.data, 0); err != nil {
+		d.mu.Lock()
+		d.requested.ClearPiece(int(piece.id))
+		d.mu.Unlock()
+		d.Stats.Failed.Add(1)
+		return
+	}
+	if err := d.storage.MarkComplete(int(piece.id)); err != nil {
+		d.mu.Lock()
+		d.requested.ClearPiece(int(piece.id))
+		d.mu.Unlock()
+		d.Stats.Failed.Add(1)
+		return
+	}
+	d.Stats.TotalWritten.Add(int64(len(piece.data)))
 
-			if d.piecesDone == len(d.tf.PieceHashes) {
-				fmt.Println("\nDownload Complete!")
-				close(d.downloadOver)
-				return
-			}
+	d.mu.Lock()
+	if !d.field.HasPiece(int(piece.id)) {
+		d.field.SetPiece(int(piece.id))
+		d.piecesDone++
+		if d.cfg.Repair != nil {
+			d.fixed = append(d.fixed, int(piece.id))
 		}
 	}
+	d.pieceCond.Broadcast()
+	d.mu.Unlock()
+
+	d.checkComplete()
+}
+
+func (d *Downloader) checkComplete() {
+	d.mu.Lock()
+	done, wanted := d.wantedPieces()
+	d.mu.Unlock()
+	if done < wanted {
+		return
+	}
+	d.completeOnce.Do(func() {
+		if f, ok := d.storage.(Finalizer); ok {
+			if err := f.Finalize(); err != nil {
+				fmt.Println("\nfailed to finalize storage:", err)
+			}
+		}
+		fmt.Println("\nDownload Complete!")
+		d.mu.Lock()
+		close(d.downloadOver)
+		d.pieceCond.Broadcast()
+		d.mu.Unlock()
+	})
 }
 
 func (d *Downloader) Wait() {
 	<-d.downloadOver
 }
+
+// stopped is closed when we stop talking to the swarm: once the download
+// completes, or, when seeding, once the downloader is closed.
+func (d *Downloader) stopped() <-chan struct{} {
+	if d.cfg.Seed {
+		return d.closed
+	}
+	return d.downloadOver
+}
+
+// Close saves resume data and closes the storage.
+func (d *Downloader) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	if d.listener != nil {
+		d.listener.Close()
+	}
+	if d.utp != nil {
+		d.utp.Close()
+	}
+	err := d.saveResume()
+	if cerr := d.storage.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (d *Downloader) Progress() (done int, wanted int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.wantedPieces()
+}
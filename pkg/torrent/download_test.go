@@ -0,0 +1,58 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+)
+
+// A piece completed by another peer's blocks must release the worker that
+// claimed it instead of leaving it to time out and drop its peer.
+func TestPieceCompletedByOtherPeer(t *testing.T) {
+	tf, all := makeTorrent(t, "t", 2*REQUEST_BLOCK_SIZE, []testFile{{nil, randomBytes(2 * REQUEST_BLOCK_SIZE)}})
+	d := testDownloader(t, tf)
+	owner, remote := pipePeer(t, d)
+	owner.choked.Store(false)
+	owner.peerBitfield.SetPiece(0)
+	other, _ := pipePeer(t, d)
+	peerDone := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		d.startRequestWorker(owner, peerDone)
+		close(finished)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for !isRequested(d, 0) {
+		if time.Now().After(deadline) {
+			t.Fatal("worker never claimed the piece")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for begin := 0; begin < len(all); begin += REQUEST_BLOCK_SIZE {
+		if piece, ok := d.receiveBlock(other, 0, begin, all[begin:begin+REQUEST_BLOCK_SIZE]); ok {
+			d.pieceQueue <- piece
+		}
+	}
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker still waiting for a piece another peer completed")
+	}
+	if !d.havePiece(0) {
+		t.Fatal("piece not stored")
+	}
+	remote.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := remote.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("owner's connection closed: %v", err)
+	}
+}
+
+func isRequested(d *Downloader, index int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.requested.HasPiece(index)
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(interface{ Timeout() bool })
+	return ok && ne.Timeout()
+}
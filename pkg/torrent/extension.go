@@ -0,0 +1,317 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Extension is a BEP 10 extension. Name is the key it is advertised under
+// in the extended handshake; HandleMessage gets every message the peer
+// sends for it, without the extended message ID. Returning an error drops
+// the peer.
+type Extension interface {
+	Name() string
+	HandleMessage(p *PeerCon, payload []byte) error
+}
+
+// HandshakeHandler is implemented by extensions that want to see the
+// peer's extended handshake. It may be called again if the peer sends an
+// updated one.
+type HandshakeHandler interface {
+	HandleHandshake(p *PeerCon, hs *ExtendedHandshake) error
+}
+
+// ExtendedHandshake is the decoded extended handshake of a peer. M maps
+// extension names to the IDs the peer wants to receive them under.
+type ExtendedHandshake struct {
+	M            map[string]int
+	Version      string
+	Port         int
+	Reqq         int
+	YourIP       net.IP
+	MetadataSize int
+	UploadOnly   bool
+}
+
+// extensionRegistry assigns local IDs to extensions in registration order,
+// starting at 1. Peers send us messages under these IDs.
+type extensionRegistry struct {
+	exts []Extension
+}
+
+func newExtensionRegistry(exts ...Extension) (*extensionRegistry, error) {
+	if len(exts) > 255 {
+		return nil, fmt.Errorf("too many extensions: %d", len(exts))
+	}
+	seen := make(map[string]bool)
+	for _, e := range exts {
+		if e.Name() == "" || seen[e.Name()] {
+			return nil, fmt.Errorf("invalid or duplicate extension name %q", e.Name())
+		}
+		seen[e.Name()] = true
+	}
+	return &extensionRegistry{exts: exts}, nil
+}
+
+func builtinExtensions() []Extension {
+	return []Extension{pexExtension{}, metadataExtension{}, donthaveExtension{}, uploadOnlyExtension{}}
+}
+
+var defaultExtensions, _ = newExtensionRegistry(builtinExtensions()...)
+
+func (r *extensionRegistry) byID(id uint8) Extension {
+	if id == 0 || int(id) > len(r.exts) {
+		return nil
+	}
+	return r.exts[id-1]
+}
+
+// handshake builds our extended handshake for peer. uploadOnly tells it we
+// want nothing from it.
+func (r *extensionRegistry) handshake(peer net.IP, port int, metadataSize int, uploadOnly bool) bencodeObject {
+	m := make([]pair, len(r.exts))
+	for i, e := range r.exts {
+		m[i] = pair{e.Name(), bencodeInt(int64(i + 1))}
+	}
+	sort.Slice(m, func(i, j int) bool { return m[i].key < m[j].key })
+	pairs := []pair{{"m", bencodeDict(m...)}}
+	if metadataSize > 0 {
+		pairs = append(pairs, pair{"metadata_size", bencodeInt(int64(metadataSize))})
+	}
+	if port > 0 {
+		pairs = append(pairs, pair{"p", bencodeInt(int64(port))})
+	}
+	pairs = append(pairs, pair{"reqq", bencodeInt(MAX_QUEUED_PIECES)})
+	if uploadOnly {
+		pairs = append(pairs, pair{"upload_only", bencodeInt(1)})
+	}
+	pairs = append(pairs, pair{"v", bencodeString(CLIENT_VERSION)})
+	if ip4 := peer.To4(); ip4 != nil {
+		pairs = append(pairs, pair{"yourip", bencodeString(string(ip4))})
+	} else if len(peer) == net.IPv6len {
+		pairs = append(pairs, pair{"yourip", bencodeString(string(peer))})
+	}
+	return bencodeDict(pairs...)
+}
+
+func parseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	ben := &bencodeObject{}
+	if err := Unmarshal(bytes.NewReader(payload), ben); err != nil {
+		return nil, err
+	}
+	if ben.objType != DICT {
+		return nil, fmt.Errorf("extended handshake is not a dictionary")
+	}
+	hs := &ExtendedHandshake{M: make(map[string]int)}
+	if m, err := ben.valAt("m"); err == nil {
+		for _, kv := range m.dict {
+			if kv.value.objType == INT && kv.value.val >= 0 && kv.value.val <= 255 {
+				hs.M[kv.key] = int(kv.value.val)
+			}
+		}
+	}
+	if v, err := ben.valAt("v"); err == nil {
+		hs.Version = v.str
+	}
+	if v, err := ben.valAt("p"); err == nil {
+		hs.Port = int(v.val)
+	}
+	if v, err := ben.valAt("reqq"); err == nil {
+		hs.Reqq = int(v.val)
+	}
+	if v, err := ben.valAt("yourip"); err == nil && (len(v.str) == 4 || len(v.str) == 16) {
+		hs.YourIP = net.IP(v.str)
+	}
+	if v, err := ben.valAt("metadata_size"); err == nil {
+		hs.MetadataSize = int(v.val)
+	}
+	if v, err := ben.valAt("upload_only"); err == nil {
+		hs.UploadOnly = v.val != 0
+	}
+	return hs, nil
+}
+
+func (p *PeerCon) SendExtendedHandshake(d *Downloader) error {
+	hs := p.exts.handshake(p.p.IP, d.cfg.ListenPort, len(p.tf.infoBytes), d.uploadOnly())
+	payload, err := hs.Marshal()
+	if err != nil {
+		return err
+	}
+	return p.SendMessage(&Message{ID: EXTENDED, Payload: append([]byte{ExtendedHandshakeID}, payload...)})
+}
+
+// handleExtended dispatches an extended message by the local ID the peer
+// sent it under.
+func (p *PeerCon) handleExtended(payload []byte) error {
+	if payload[0] == ExtendedHandshakeID {
+		hs, err := parseExtendedHandshake(payload[1:])
+		if err != nil {
+			return err
+		}
+		p.extMu.Lock()
+		// A later handshake only changes the names it mentions; ID 0
+		// turns an extension off.
+		for name, id := range hs.M {
+			if id == 0 {
+				delete(p.remoteExt, name)
+			} else {
+				p.remoteExt[name] = id
+			}
+		}
+		p.extMu.Unlock()
+		for _, e := range p.exts.exts {
+			if h, ok := e.(HandshakeHandler); ok {
+				if err := h.HandleHandshake(p, hs); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	e := p.exts.byID(payload[0])
+	if e == nil {
+		return nil
+	}
+	return e.HandleMessage(p, payload[1:])
+}
+
+// SupportsExtension reports whether the peer advertised the extension.
+func (p *PeerCon) SupportsExtension(name string) bool {
+	p.extMu.Lock()
+	defer p.extMu.Unlock()
+	return p.remoteExt[name] != 0
+}
+
+// SendExtended sends payload to the peer under the ID it assigned to the
+// named extension.
+func (p *PeerCon) SendExtended(name string, payload []byte) error {
+	p.extMu.Lock()
+	id := p.remoteExt[name]
+	p.extMu.Unlock()
+	if id == 0 {
+		return fmt.Errorf("peer does not support %s", name)
+	}
+	return p.SendMessage(&Message{ID: EXTENDED, Payload: append([]byte{byte(id)}, payload...)})
+}
+
+// pexExtension (ut_pex) learns about other peers in the swarm.
+type pexExtension struct{}
+
+func (pexExtension) Name() string { return "ut_pex" }
+
+func (pexExtension) HandleMessage(p *PeerCon, payload []byte) error {
+	ben := &bencodeObject{}
+	if err := Unmarshal(bytes.NewReader(payload), ben); err != nil {
+		return nil
+	}
+	if added, err := ben.valAt("added"); err == nil {
+		peersBytes := []byte(added.str)
+		for i := 0; i+6 <= len(peersBytes); i += 6 {
+			ip := net.IP(peersBytes[i : i+4])
+			port := binary.BigEndian.Uint16(peersBytes[i+4 : i+6])
+			offerPeer(p.pexCh, fmt.Sprintf("%s:%d", ip.String(), port))
+		}
+	}
+	if added, err := ben.valAt("added6"); err == nil {
+		peersBytes := []byte(added.str)
+		for i := 0; i+18 <= len(peersBytes); i += 18 {
+			addr := net.TCPAddr{IP: net.IP(peersBytes[i : i+16]), Port: int(binary.BigEndian.Uint16(peersBytes[i+16 : i+18]))}
+			offerPeer(p.pexCh, addr.String())
+		}
+	}
+	return nil
+}
+
+// offerPeer passes a peer learned over PEX on without blocking. When the
+// channel is full the address is dropped, so a peer flooding us with PEX
+// can not stall its own read loop.
+func offerPeer(ch chan string, addr string) {
+	select {
+	case ch <- addr:
+	default:
+	}
+}
+
+// metadataExtension (ut_metadata, BEP 9) serves our info dictionary to
+// peers that only have a magnet link.
+type metadataExtension struct{}
+
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+	metadataPiece   = 16384
+)
+
+func (metadataExtension) Name() string { return "ut_metadata" }
+
+func (metadataExtension) HandleMessage(p *PeerCon, payload []byte) error {
+	ben := &bencodeObject{}
+	if err := Unmarshal(bytes.NewReader(payload), ben); err != nil {
+		return nil
+	}
+	msgType, err := ben.valAt("msg_type")
+	if err != nil || msgType.val != metadataRequest {
+		return nil
+	}
+	piece, err := ben.valAt("piece")
+	if err != nil {
+		return nil
+	}
+	info := p.tf.infoBytes
+	start := int(piece.val) * metadataPiece
+	if piece.val < 0 || start >= len(info) {
+		reply := bencodeDict(pair{"msg_type", bencodeInt(metadataReject)}, pair{"piece", bencodeInt(piece.val)})
+		s, _ := reply.Marshal()
+		return p.SendExtended("ut_metadata", []byte(s))
+	}
+	reply := bencodeDict(
+		pair{"msg_type", bencodeInt(metadataData)},
+		pair{"piece", bencodeInt(piece.val)},
+		pair{"total_size", bencodeInt(int64(len(info)))},
+	)
+	s, _ := reply.Marshal()
+	return p.SendExtended("ut_metadata", append([]byte(s), info[start:min(start+metadataPiece, len(info))]...))
+}
+
+// donthaveExtension (lt_donthave) tells us a peer lost a piece it had
+// announced.
+type donthaveExtension struct{}
+
+func (donthaveExtension) Name() string { return "lt_donthave" }
+
+func (donthaveExtension) HandleMessage(p *PeerCon, payload []byte) error {
+	if len(payload) != 4 {
+		return fmt.Errorf("invalid lt_donthave payload")
+	}
+	index := int(binary.BigEndian.Uint32(payload))
+	if index >= p.tf.NumPieces() {
+		return fmt.Errorf("lt_donthave for piece %d out of range", index)
+	}
+	p.bitMu.Lock()
+	p.peerBitfield.ClearPiece(index)
+	p.bitMu.Unlock()
+	return nil
+}
+
+// uploadOnlyExtension (upload_only, BEP 21) tracks peers that will not
+// download from us, from the handshake flag or a later message.
+type uploadOnlyExtension struct{}
+
+func (uploadOnlyExtension) Name() string { return "upload_only" }
+
+func (uploadOnlyExtension) HandleHandshake(p *PeerCon, hs *ExtendedHandshake) error {
+	p.peerUploadOnly.Store(hs.UploadOnly)
+	return nil
+}
+
+func (uploadOnlyExtension) HandleMessage(p *PeerCon, payload []byte) error {
+	if len(payload) != 1 {
+		return fmt.Errorf("invalid upload_only payload")
+	}
+	p.peerUploadOnly.Store(payload[0] != 0)
+	return nil
+}
@@ -0,0 +1,189 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// namedExt is an extension that records the payloads it is sent.
+type namedExt struct {
+	name string
+	got  *[][]byte
+}
+
+func (e namedExt) Name() string { return e.name }
+
+func (e namedExt) HandleMessage(p *PeerCon, payload []byte) error {
+	if e.got != nil {
+		*e.got = append(*e.got, payload)
+	}
+	return nil
+}
+
+func extPeer(t *testing.T, pexCh chan string) *PeerCon {
+	t.Helper()
+	tf, _ := makeTorrent(t, "t", 16384, []testFile{{nil, randomBytes(1000)}})
+	return NewPeerCon(tf, &Peer{IP: net.IPv4(10, 0, 0, 1), port: 6881}, tf.InfoHash, nil, pexCh)
+}
+
+func extHandshakeMsg(t *testing.T, m ...pair) []byte {
+	t.Helper()
+	ben := bencodeDict(pair{"m", bencodeDict(m...)})
+	s, err := ben.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte{ExtendedHandshakeID}, s...)
+}
+
+func TestExtensionRegistry(t *testing.T) {
+	var got [][]byte
+	r, err := newExtensionRegistry(namedExt{name: "a"}, namedExt{name: "b", got: &got})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.byID(0) != nil || r.byID(3) != nil {
+		t.Fatal("extension found under an unassigned ID")
+	}
+	if r.byID(1).Name() != "a" || r.byID(2).Name() != "b" {
+		t.Fatal("IDs not assigned in registration order from 1")
+	}
+	p := extPeer(t, nil)
+	p.exts = r
+	if err := p.handleExtended([]byte{2, 'x', 'y'}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.handleExtended([]byte{9, 'z'}); err != nil {
+		t.Fatalf("message for an unknown ID dropped the peer: %v", err)
+	}
+	if len(got) != 1 || string(got[0]) != "xy" {
+		t.Fatalf("extension got %q, want [xy]", got)
+	}
+
+	for _, exts := range [][]Extension{
+		{namedExt{name: "a"}, namedExt{name: "a"}},
+		{namedExt{name: ""}},
+	} {
+		if _, err := newExtensionRegistry(exts...); err == nil {
+			t.Errorf("registry accepted %v", exts)
+		}
+	}
+	many := make([]Extension, 256)
+	for i := range many {
+		many[i] = namedExt{name: fmt.Sprintf("e%d", i)}
+	}
+	if _, err := newExtensionRegistry(many[:255]...); err != nil {
+		t.Fatalf("255 extensions rejected: %v", err)
+	}
+	if _, err := newExtensionRegistry(many...); err == nil {
+		t.Fatal("256 extensions accepted")
+	}
+}
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+	r, _ := newExtensionRegistry(namedExt{name: "z_last"}, namedExt{name: "a_first"})
+	tests := []struct {
+		peer         net.IP
+		port, size   int
+		uploadOnly   bool
+		wantYourIPv4 bool
+	}{
+		{net.IPv4(1, 2, 3, 4), 6881, 4000, true, true},
+		{net.ParseIP("2001:db8::1"), 0, 0, false, false},
+	}
+	for _, tt := range tests {
+		ben := r.handshake(tt.peer, tt.port, tt.size, tt.uploadOnly)
+		s, err := ben.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains([]byte(s), []byte("1:md7:a_firsti2e6:z_lasti1ee")) {
+			t.Errorf("m not sorted by name or IDs wrong: %q", s)
+		}
+		hs, err := parseExtendedHandshake([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hs.M["z_last"] != 1 || hs.M["a_first"] != 2 || len(hs.M) != 2 {
+			t.Errorf("m = %v", hs.M)
+		}
+		if hs.Port != tt.port || hs.MetadataSize != tt.size || hs.UploadOnly != tt.uploadOnly {
+			t.Errorf("got port %d, metadata size %d, upload only %v", hs.Port, hs.MetadataSize, hs.UploadOnly)
+		}
+		if hs.Reqq != MAX_QUEUED_PIECES || hs.Version != CLIENT_VERSION {
+			t.Errorf("got reqq %d, version %q", hs.Reqq, hs.Version)
+		}
+		if !hs.YourIP.Equal(tt.peer) || (len(hs.YourIP) == 4) != tt.wantYourIPv4 {
+			t.Errorf("yourip %v (%d bytes) for %v", hs.YourIP, len(hs.YourIP), tt.peer)
+		}
+	}
+}
+
+func TestParseExtendedHandshake(t *testing.T) {
+	for _, bad := range []string{"", "i5e", "l1:ae", "d1:m"} {
+		if _, err := parseExtendedHandshake([]byte(bad)); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+	hs, err := parseExtendedHandshake([]byte("d1:md3:bigi256e3:negi-1e2:oki7e3:str1:xe6:yourip3:abce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hs.M) != 1 || hs.M["ok"] != 7 {
+		t.Fatalf("m = %v, want only ok", hs.M)
+	}
+	if hs.YourIP != nil {
+		t.Fatalf("yourip of bad length parsed as %v", hs.YourIP)
+	}
+}
+
+// A later handshake only changes the names it mentions, and ID 0 turns an
+// extension off.
+func TestExtendedHandshakeDisables(t *testing.T) {
+	p := extPeer(t, nil)
+	msg := extHandshakeMsg(t, pair{"ut_metadata", bencodeInt(3)}, pair{"ut_pex", bencodeInt(4)})
+	if err := p.handleExtended(msg); err != nil {
+		t.Fatal(err)
+	}
+	if !p.SupportsExtension("ut_pex") || !p.SupportsExtension("ut_metadata") {
+		t.Fatal("advertised extensions not recorded")
+	}
+	if err := p.handleExtended(extHandshakeMsg(t, pair{"ut_pex", bencodeInt(0)})); err != nil {
+		t.Fatal(err)
+	}
+	if p.SupportsExtension("ut_pex") {
+		t.Fatal("ut_pex still enabled after ID 0")
+	}
+	if !p.SupportsExtension("ut_metadata") {
+		t.Fatal("ut_metadata dropped by a handshake that did not mention it")
+	}
+	if err := p.SendExtended("ut_pex", nil); err == nil {
+		t.Fatal("sent a disabled extension")
+	}
+}
+
+// A full PEX channel drops addresses instead of blocking the read loop.
+func TestPEXFullChannel(t *testing.T) {
+	pexCh := make(chan string, 1)
+	p := extPeer(t, pexCh)
+	added := []byte{1, 2, 3, 4, 0x1a, 0xe1, 5, 6, 7, 8, 0x1a, 0xe2}
+	added6 := append(net.ParseIP("2001:db8::1").To16(), 0x1a, 0xe3)
+	ben := bencodeDict(pair{"added", bencodeString(string(added))}, pair{"added6", bencodeString(string(added6))})
+	s, _ := ben.Marshal()
+	done := make(chan error)
+	go func() { done <- pexExtension{}.HandleMessage(p, []byte(s)) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PEX message blocked on a full channel")
+	}
+	if addr := <-pexCh; addr != "1.2.3.4:6881" {
+		t.Fatalf("got %s, want 1.2.3.4:6881", addr)
+	}
+}
@@ -0,0 +1,207 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"slices"
+)
+
+// Fast Extension (BEP 6) messages. They may only be exchanged when both
+// handshakes set bit 0x04 of the last reserved byte.
+const (
+	SUGGEST_PIECE  MessageID = 13
+	HAVE_ALL       MessageID = 14
+	HAVE_NONE      MessageID = 15
+	REJECT_REQUEST MessageID = 16
+	ALLOWED_FAST   MessageID = 17
+)
+
+// allowedFastSet picks the pieces a peer at ip may request while choked,
+// using the canonical BEP 6 generator so both sides agree on the set.
+func allowedFastSet(ip net.IP, infoHash [20]byte, numPieces int, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+	var set []int
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !slices.Contains(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// sendHaves opens the message stream with what we have. Fast peers get
+// HAVE_ALL or HAVE_NONE where they fit; others get no bitfield at all when
+// we have nothing, which the base protocol allows. Superseeded peers are
+// told we have nothing.
+func (p *PeerCon) sendHaves(d *Downloader) error {
+	n := p.tf.NumPieces()
+	d.mu.Lock()
+	bits := append(Bitfield{}, p.myBitfield[:(n+7)/8]...)
+	d.mu.Unlock()
+	have := 0
+	for i := range n {
+		if bits.HasPiece(i) {
+			have++
+		}
+	}
+	switch {
+	case p.superseed && p.peerFast:
+		return p.SendMessage(&Message{ID: HAVE_NONE})
+	case p.superseed:
+	case p.peerFast && have == n:
+		return p.SendMessage(&Message{ID: HAVE_ALL})
+	case p.peerFast && have == 0:
+		return p.SendMessage(&Message{ID: HAVE_NONE})
+	case have > 0:
+		return p.SendMessage(&Message{ID: BITFIELD, Payload: bits})
+	}
+	return nil
+}
+
+// sendAllowedFast grants a fast peer the pieces of its allowed fast set
+// that we have.
+func (p *PeerCon) sendAllowedFast(d *Downloader) error {
+	if !p.peerFast || p.superseed {
+		return nil
+	}
+	p.allowedFast = allowedFastSet(p.p.IP, p.infoHash, p.tf.NumPieces(), ALLOWED_FAST_COUNT)
+	for _, index := range p.allowedFast {
+		if !d.havePiece(index) {
+			continue
+		}
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(index))
+		if err := p.SendMessage(&Message{ID: ALLOWED_FAST, Payload: payload}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PeerCon) SendReject(index, begin, length int) error {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return p.SendMessage(&Message{ID: REJECT_REQUEST, Payload: payload})
+}
+
+// handleRequest serves a block, or rejects it when we are choking the peer
+// and the piece is not in its allowed fast set, when we lack the piece or
+// have not revealed it to a superseeded peer, when too many blocks are
+// already queued or when the request is malformed. Non-fast peers get no
+// answer to a request we will not serve.
+func (p *PeerCon) handleRequest(d *Downloader, index, begin, length int) error {
+	ok := p.out.queuedPieces() < MAX_QUEUED_PIECES &&
+		index >= 0 && index < p.tf.NumPieces() &&
+		length > 0 && length <= MAX_REQUEST_LEN &&
+		begin >= 0 && begin+length <= p.tf.PieceSize(index) &&
+		(!p.amChoking.Load() || slices.Contains(p.allowedFast, index)) &&
+		(!p.superseed || d.super.allowed(p, index)) &&
+		d.havePiece(index)
+	var data []byte
+	if ok {
+		data = make([]byte, length)
+		if _, err := d.storage.ReadAt(index, data, int64(begin)); err != nil {
+			ok = false
+		}
+	}
+	if !ok {
+		if p.peerFast {
+			return p.SendReject(index, begin, length)
+		}
+		return nil
+	}
+	return p.SendPiece(uint32(index), uint32(begin), data)
+}
+
+// handleFast processes a Fast Extension message that passed
+// validateMessage.
+func (p *PeerCon) handleFast(d *Downloader, msg *Message) {
+	switch msg.ID {
+	case HAVE_ALL:
+		p.bitMu.Lock()
+		for i := range p.tf.NumPieces() {
+			p.peerBitfield.SetPiece(i)
+		}
+		p.bitMu.Unlock()
+		d.Stats.BitfieldRecv.Add(1)
+		d.Stats.Seeders.Add(1)
+	case HAVE_NONE:
+		d.Stats.BitfieldRecv.Add(1)
+	case SUGGEST_PIECE, ALLOWED_FAST:
+		index := int(binary.BigEndian.Uint32(msg.Payload))
+		// Suggestions are only used up once we are unchoked, so a peer
+		// that keeps us choked can hold no more than MAX_SUGGESTED.
+		p.fastMu.Lock()
+		if msg.ID == SUGGEST_PIECE {
+			if len(p.suggested) < MAX_SUGGESTED && !slices.Contains(p.suggested, index) {
+				p.suggested = append(p.suggested, index)
+			}
+		} else if !slices.Contains(p.peerAllowedFast, index) {
+			p.peerAllowedFast = append(p.peerAllowedFast, index)
+		}
+		p.fastMu.Unlock()
+	case REJECT_REQUEST:
+		select {
+		case p.backlog <- struct{}{}:
+		default:
+		}
+		select {
+		case p.rejects <- int(binary.BigEndian.Uint32(msg.Payload[0:4])):
+		default:
+		}
+	}
+}
+
+// fastCandidates returns the pieces worth trying before the normal picker:
+// while choked only those the peer allows fast, otherwise its suggestions.
+// Suggestions are used up once handed out.
+func (p *PeerCon) fastCandidates(choked bool) []int {
+	p.fastMu.Lock()
+	defer p.fastMu.Unlock()
+	if choked {
+		return slices.Clone(p.peerAllowedFast)
+	}
+	s := p.suggested
+	p.suggested = nil
+	return s
+}
+
+// pickFast claims one of the peer's fast candidates that it has and we
+// still need.
+func (d *Downloader) pickFast(p *PeerCon, choked bool) (int, bool) {
+	candidates := p.fastCandidates(choked)
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	peerHas := p.peerPieces()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, i := range candidates {
+		if !d.field.HasPiece(i) && !d.requested.HasPiece(i) && peerHas.HasPiece(i) && d.piecePrio[i] != PRIORITY_SKIP {
+			d.claim(i)
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (d *Downloader) havePiece(index int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.field.HasPiece(index)
+}
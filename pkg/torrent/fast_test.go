@@ -0,0 +1,113 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// Choking a peer drops the blocks still queued for it; a fast peer is told
+// with REJECT_REQUEST, except for pieces in its allowed fast set.
+func TestChokeRejectsQueuedBlocks(t *testing.T) {
+	for _, fast := range []bool{false, true} {
+		name := "plain"
+		if fast {
+			name = "fast"
+		}
+		t.Run(name, func(t *testing.T) {
+			tf, all := makeTorrent(t, "t", 4*REQUEST_BLOCK_SIZE, []testFile{{nil, randomBytes(64 * 4 * REQUEST_BLOCK_SIZE)}})
+			d := testDownloader(t, tf)
+			storeAll(d, all)
+			p, remote := pipePeer(t, d)
+			p.peerFast = fast
+			go p.DownloadLoop(d)
+			readUntil(t, remote, UNCHOKE)
+			allowed := allowedFastSet(p.p.IP, p.infoHash, tf.NumPieces(), ALLOWED_FAST_COUNT)
+			index := 0
+			for slices.Contains(allowed, index) {
+				index++
+			}
+			msgs := []*Message{{ID: INTERESTED}}
+			for begin := 0; begin < tf.PieceLength; begin += REQUEST_BLOCK_SIZE {
+				msgs = append(msgs, requestMsg(REQUEST, index, begin, REQUEST_BLOCK_SIZE))
+			}
+			msgs = append(msgs, requestMsg(REQUEST, allowed[0], 0, REQUEST_BLOCK_SIZE))
+			// Nothing is read until the peer has lost and regained
+			// interest, so the writer is stuck on the first block and the
+			// rest are still queued when the choke comes.
+			msgs = append(msgs, &Message{ID: NOT_INTERESTED}, &Message{ID: INTERESTED})
+			writeWire(t, remote, msgs...)
+			served, rejected := 0, 0
+			choked := false
+			for _, msg := range readUntil(t, remote, UNCHOKE) {
+				switch {
+				case msg == nil:
+				case msg.ID == CHOKE:
+					choked = true
+				case msg.ID == PIECE && choked:
+					t.Fatal("block sent after the choke")
+				case msg.ID == PIECE:
+					served++
+				case msg.ID == REJECT_REQUEST:
+					if int(binary.BigEndian.Uint32(msg.Payload[0:4])) != index {
+						t.Fatal("allowed fast block rejected on choke")
+					}
+					rejected++
+				}
+			}
+			if !choked || served > 1 {
+				t.Fatalf("choked %v after serving %d blocks", choked, served)
+			}
+			if !fast {
+				if rejected != 0 || p.out.queuedPieces() != 0 {
+					t.Fatalf("plain peer got %d rejects, %d blocks still queued", rejected, p.out.queuedPieces())
+				}
+				return
+			}
+			if served+rejected != 4 {
+				t.Fatalf("%d blocks served and %d rejected out of 4", served, rejected)
+			}
+			msg := readWire(t, remote)
+			if msg == nil || msg.ID != PIECE || int(binary.BigEndian.Uint32(msg.Payload[0:4])) != allowed[0] {
+				t.Fatal("allowed fast block not kept through the choke")
+			}
+		})
+	}
+}
+
+// A peer spamming SUGGEST_PIECE while it keeps us choked holds at most
+// MAX_SUGGESTED distinct suggestions.
+func TestSuggestionsCapped(t *testing.T) {
+	tf, _ := makeTorrent(t, "t", REQUEST_BLOCK_SIZE, []testFile{{nil, randomBytes(100 * REQUEST_BLOCK_SIZE)}})
+	d := testDownloader(t, tf)
+	p, _ := pipePeer(t, d)
+	p.peerFast = true
+	suggest := func(index int) {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(index))
+		p.handleFast(d, &Message{ID: SUGGEST_PIECE, Payload: payload})
+	}
+	for range 5 {
+		suggest(7)
+	}
+	for i := range 1000 {
+		suggest(i % tf.NumPieces())
+	}
+	if got := p.fastCandidates(true); len(got) != 0 {
+		t.Fatalf("choked candidates %v include suggestions", got)
+	}
+	got := p.fastCandidates(false)
+	if len(got) != MAX_SUGGESTED || got[0] != 7 {
+		t.Fatalf("%d suggestions kept, want %d starting with 7", len(got), MAX_SUGGESTED)
+	}
+	seen := map[int]bool{}
+	for _, i := range got {
+		if seen[i] {
+			t.Fatalf("suggestion %d kept twice", i)
+		}
+		seen[i] = true
+	}
+	if len(p.fastCandidates(false)) != 0 {
+		t.Fatal("suggestions not used up")
+	}
+}
@@ -0,0 +1,197 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testFile is one file of a torrent built by torrentBytes.
+type testFile struct {
+	path []string
+	data []byte
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// torrentBytes encodes a v1 torrent over files. A single file without a
+// path makes a single file torrent. extra adds top level keys.
+func torrentBytes(name string, pieceLen int, files []testFile, extra ...pair) []byte {
+	var all []byte
+	for _, f := range files {
+		all = append(all, f.data...)
+	}
+	var hashes []byte
+	for i := 0; i < len(all); i += pieceLen {
+		h := sha1.Sum(all[i:min(i+pieceLen, len(all))])
+		hashes = append(hashes, h[:]...)
+	}
+	info := []pair{{"name", bencodeString(name)}, {"piece length", bencodeInt(int64(pieceLen))}, {"pieces", bencodeString(string(hashes))}}
+	if len(files) == 1 && files[0].path == nil {
+		info = append(info, pair{"length", bencodeInt(int64(len(files[0].data)))})
+	} else {
+		var list []bencodeObject
+		for _, f := range files {
+			var path []bencodeObject
+			for _, c := range f.path {
+				path = append(path, bencodeString(c))
+			}
+			list = append(list, bencodeDict(pair{"length", bencodeInt(int64(len(f.data)))}, pair{"path", bencodeList(path...)}))
+		}
+		info = append(info, pair{"files", bencodeList(list...)})
+	}
+	sort.Slice(info, func(i, j int) bool { return info[i].key < info[j].key })
+	top := append([]pair{{"info", bencodeDict(info...)}}, extra...)
+	sort.Slice(top, func(i, j int) bool { return top[i].key < top[j].key })
+	ben := bencodeDict(top...)
+	s, _ := ben.Marshal()
+	return []byte(s)
+}
+
+func parseTorrent(b []byte) (*TorrentFile, error) {
+	ben, err := Open(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	tf, err := ben.toTorrentFile()
+	if err != nil {
+		return nil, err
+	}
+	return &tf, nil
+}
+
+// makeTorrent builds a torrent over files and returns it with the
+// concatenated file contents.
+func makeTorrent(t *testing.T, name string, pieceLen int, files []testFile, extra ...pair) (*TorrentFile, []byte) {
+	t.Helper()
+	tf, err := parseTorrent(torrentBytes(name, pieceLen, files, extra...))
+	if err != nil {
+		t.Fatalf("couldnt parse test torrent: %v", err)
+	}
+	var all []byte
+	for _, f := range files {
+		all = append(all, f.data...)
+	}
+	return tf, all
+}
+
+func sha1Sum(data []byte) []byte {
+	h := sha1.Sum(data)
+	return h[:]
+}
+
+// testConfig is a config for in memory storage with no listener or uTP
+// socket, so a downloader built from it never touches the network on its
+// own as long as its torrent has no trackers.
+func testConfig(t *testing.T) *Config {
+	cfg := DefaultConfig()
+	cfg.Storage = MemoryStorage{}
+	cfg.DownloadDir = t.TempDir()
+	cfg.UTP = false
+	return cfg
+}
+
+// testDownloader is a Downloader over tf built from testConfig.
+func testDownloader(t *testing.T, tf *TorrentFile) *Downloader {
+	t.Helper()
+	return newTestDownloader(t, tf, testConfig(t))
+}
+
+// newTestDownloader is a Downloader over tf built from cfg, closed when the
+// test ends.
+func newTestDownloader(t *testing.T, tf *TorrentFile, cfg *Config) *Downloader {
+	t.Helper()
+	d, err := NewDownloader(tf, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// storeAll stores every piece of data except those in skip.
+func storeAll(d *Downloader, data []byte, skip ...int) {
+	for i := range d.tf.NumPieces() {
+		if slices.Contains(skip, i) {
+			continue
+		}
+		begin := i * d.tf.PieceLength
+		d.storePiece(Piece{id: int64(i), data: data[begin : begin+d.tf.PieceSize(i)]})
+	}
+}
+
+// pipePeer returns a PeerCon talking over one end of an in memory
+// connection, and the other end.
+func pipePeer(t *testing.T, d *Downloader) (*PeerCon, net.Conn) {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() {
+		ours.Close()
+		theirs.Close()
+	})
+	p := NewPeerCon(d.tf, &Peer{IP: net.IPv4(10, 0, 0, 1), port: 6881}, d.tf.InfoHash, d.field, nil)
+	p.con = newAcceptedTCPConnector(ours)
+	return p, theirs
+}
+
+// readWire reads one message the way a remote peer would, nil for a
+// keep-alive.
+func readWire(t *testing.T, conn net.Conn) *Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		t.Fatalf("reading message: %v", err)
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n == 0 {
+		return nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("reading message: %v", err)
+	}
+	return &Message{ID: MessageID(buf[0]), Payload: buf[1:]}
+}
+
+// readUntil reads messages up to and including the first with id.
+func readUntil(t *testing.T, conn net.Conn, id MessageID) []*Message {
+	t.Helper()
+	var msgs []*Message
+	for {
+		msg := readWire(t, conn)
+		msgs = append(msgs, msg)
+		if msg != nil && msg.ID == id {
+			return msgs
+		}
+	}
+}
+
+func writeWire(t *testing.T, conn net.Conn, msgs ...*Message) {
+	t.Helper()
+	for _, msg := range msgs {
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(msg.Serialize()); err != nil {
+			t.Fatalf("writing message: %v", err)
+		}
+	}
+}
+
+func requestMsg(id MessageID, index, begin, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &Message{ID: id, Payload: payload}
+}
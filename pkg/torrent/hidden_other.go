@@ -0,0 +1,8 @@
+//go:build !windows
+
+package torrent
+
+// unix has no hidden attribute; dotfiles are hidden by name alone.
+func setHidden(path string) error {
+	return nil
+}
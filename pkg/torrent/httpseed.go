@@ -0,0 +1,97 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpSeed is a Hoffman style HTTP seed (BEP 17): a script that serves a
+// piece, or byte ranges of one, given the info hash and piece index.
+type httpSeed struct {
+	url    string
+	tf     *TorrentFile
+	client *http.Client
+}
+
+func newHTTPSeed(u string, tf *TorrentFile) *httpSeed {
+	return &httpSeed{url: u, tf: tf, client: &http.Client{Timeout: WEBSEED_TIMEOUT}}
+}
+
+// retryAfterError is a busy seed asking to be left alone for wait.
+type retryAfterError struct {
+	wait time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("http seed busy, retry after %v", e.wait)
+}
+
+// fetchPiece asks for the whole piece. Seeds may send less than asked, so
+// the rest is requested with ranges until the piece is complete.
+func (hs *httpSeed) fetchPiece(ctx context.Context, index int) ([]byte, error) {
+	size := hs.tf.PieceSize(index)
+	data := make([]byte, 0, size)
+	for len(data) < size {
+		chunk, err := hs.fetch(ctx, index, len(data), size-1)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) == 0 || len(data)+len(chunk) > size {
+			return nil, fmt.Errorf("http seed sent %d bytes of piece %d", len(chunk), index)
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// fetch requests bytes first to last, inclusive, of the piece. The ranges
+// parameter is left out when the whole piece is wanted.
+func (hs *httpSeed) fetch(ctx context.Context, index, first, last int) ([]byte, error) {
+	base, err := url.Parse(hs.url)
+	if err != nil {
+		return nil, err
+	}
+	params := base.Query()
+	params.Set("info_hash", string(hs.tf.InfoHash[:]))
+	params.Set("piece", strconv.Itoa(index))
+	if first > 0 || last < hs.tf.PieceSize(index)-1 {
+		params.Set("ranges", fmt.Sprintf("%d-%d", first, last))
+	}
+	base.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(io.LimitReader(resp.Body, int64(last-first+1)))
+	case http.StatusServiceUnavailable:
+		return nil, &retryAfterError{wait: retryAfter(resp)}
+	}
+	return nil, fmt.Errorf("http seed responded with status %d", resp.StatusCode)
+}
+
+// retryAfter reads how long a busy seed wants us to wait: a number of
+// seconds in the body as BEP 17 specifies, or a Retry-After header.
+func retryAfter(resp *http.Response) time.Duration {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 32))
+	secs, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil {
+		secs, err = strconv.Atoi(resp.Header.Get("Retry-After"))
+	}
+	if err != nil || secs <= 0 {
+		return WEBSEED_BACKOFF
+	}
+	return min(time.Duration(secs)*time.Second, MAX_WEBSEED_BACKOFF)
+}
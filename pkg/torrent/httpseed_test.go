@@ -0,0 +1,140 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pieceServer is a BEP 17 seed for one torrent that sends at most max bytes
+// per response and records the query of every request.
+type pieceServer struct {
+	tf   *TorrentFile
+	data []byte
+	max  int
+	mu   sync.Mutex
+	reqs []string
+}
+
+func (ps *pieceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ps.mu.Lock()
+	ps.reqs = append(ps.reqs, "piece="+q.Get("piece")+" ranges="+q.Get("ranges"))
+	ps.mu.Unlock()
+	if q.Get("info_hash") != string(ps.tf.InfoHash[:]) {
+		http.NotFound(w, r)
+		return
+	}
+	index, err := strconv.Atoi(q.Get("piece"))
+	if err != nil || index < 0 || index >= ps.tf.NumPieces() {
+		http.Error(w, "bad piece", http.StatusBadRequest)
+		return
+	}
+	piece := ps.data[index*ps.tf.PieceLength:][:ps.tf.PieceSize(index)]
+	first, last := 0, len(piece)-1
+	if rng := q.Get("ranges"); rng != "" {
+		if _, err := fmt.Sscanf(rng, "%d-%d", &first, &last); err != nil {
+			http.Error(w, "bad ranges", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Write(piece[first:min(last+1, first+ps.max)])
+}
+
+func (ps *pieceServer) requests() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return append([]string{}, ps.reqs...)
+}
+
+// A seed sending less than a whole piece is asked for the rest by range.
+func TestHTTPSeedFetchPiece(t *testing.T) {
+	tf, all := makeTorrent(t, "t", 16384, []testFile{{nil, randomBytes(20000)}})
+	ps := &pieceServer{tf: tf, data: all, max: 10000}
+	srv := httptest.NewServer(ps)
+	defer srv.Close()
+	hs := newHTTPSeed(srv.URL+"/seed?key=1", tf)
+	data, err := hs.fetchPiece(context.Background(), 0)
+	if err != nil || !bytes.Equal(data, all[:16384]) {
+		t.Fatalf("piece 0: %v", err)
+	}
+	data, err = hs.fetchPiece(context.Background(), 1)
+	if err != nil || !bytes.Equal(data, all[16384:]) {
+		t.Fatalf("last piece: %v", err)
+	}
+	want := []string{"piece=0 ranges=", "piece=0 ranges=10000-16383", "piece=1 ranges="}
+	if got := ps.requests(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("requests %q, want %q", got, want)
+	}
+}
+
+func TestHTTPSeedEmptyReply(t *testing.T) {
+	tf, all := makeTorrent(t, "t", 16384, []testFile{{nil, randomBytes(20000)}})
+	srv := httptest.NewServer(&pieceServer{tf: tf, data: all, max: 0})
+	defer srv.Close()
+	if _, err := newHTTPSeed(srv.URL, tf).fetchPiece(context.Background(), 0); err == nil {
+		t.Fatal("empty reply accepted as a piece")
+	}
+}
+
+// A busy seed's wait comes from the body, then Retry-After, and is capped.
+func TestHTTPSeedRetryAfter(t *testing.T) {
+	tf, _ := makeTorrent(t, "t", 16384, []testFile{{nil, randomBytes(1000)}})
+	tests := []struct {
+		body, header string
+		want         time.Duration
+	}{
+		{"30", "", 30 * time.Second},
+		{" 7\n", "60", 7 * time.Second},
+		{"", "2", 2 * time.Second},
+		{"soon", "", WEBSEED_BACKOFF},
+		{"0", "", WEBSEED_BACKOFF},
+		{"100000", "", MAX_WEBSEED_BACKOFF},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.header != "" {
+				w.Header().Set("Retry-After", tt.header)
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(tt.body))
+		}))
+		_, err := newHTTPSeed(srv.URL, tf).fetchPiece(context.Background(), 0)
+		srv.Close()
+		var busy *retryAfterError
+		if !errors.As(err, &busy) {
+			t.Errorf("body %q, header %q: got %v, want a retry", tt.body, tt.header, err)
+			continue
+		}
+		if busy.wait != tt.want {
+			t.Errorf("body %q, header %q: wait %v, want %v", tt.body, tt.header, busy.wait, tt.want)
+		}
+	}
+}
+
+func TestHTTPSeedDownload(t *testing.T) {
+	tf, all := makeTorrent(t, "t", 16384, []testFile{{nil, randomBytes(40000)}})
+	srv := httptest.NewServer(&pieceServer{tf: tf, data: all, max: 5000})
+	defer srv.Close()
+	d := testDownloader(t, tf)
+	go d.runHTTPSource(newHTTPSeed(srv.URL, tf), 100*time.Millisecond)
+	select {
+	case <-d.downloadOver:
+	case <-time.After(10 * time.Second):
+		t.Fatal("download from the http seed did not complete")
+	}
+	for i := range tf.NumPieces() {
+		buf := make([]byte, tf.PieceSize(i))
+		if _, err := d.storage.ReadAt(i, buf, 0); err != nil || !bytes.Equal(buf, all[i*16384:][:len(buf)]) {
+			t.Fatalf("piece %d stored wrongly: %v", i, err)
+		}
+	}
+}
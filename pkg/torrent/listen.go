@@ -0,0 +1,106 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+func (d *Downloader) announcePort() uint16 {
+	if d.cfg.ListenPort > 0 {
+		return uint16(d.cfg.ListenPort)
+	}
+	return DEFAULT_PORT
+}
+
+func (d *Downloader) isBlocked(ip net.IP) bool {
+	return d.blocklist != nil && d.blocklist.Contains(ip)
+}
+
+func (d *Downloader) watchBlocklist() {
+	ticker := time.NewTicker(BLOCKLIST_POLL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopped():
+			return
+		case <-ticker.C:
+			changed, err := d.blocklist.ReloadIfChanged()
+			if err != nil {
+				fmt.Println("\nfailed to reload blocklist:", err)
+			} else if n := d.blocklist.Skipped(); changed && n > 0 {
+				fmt.Printf("\nskipped %d malformed blocklist lines\n", n)
+			}
+		}
+	}
+}
+
+// listen accepts peers that connect to us until we stop talking to the
+// swarm or the downloader is closed.
+func (d *Downloader) listen(confirm chan *PeerCon) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", d.cfg.ListenPort))
+	if err != nil {
+		return err
+	}
+	d.listener = ln
+	go func() {
+		<-d.stopped()
+		ln.Close()
+	}()
+	go d.acceptLoop(ln, confirm)
+	if d.utp != nil {
+		go d.acceptLoop(d.utp, confirm)
+	}
+	return nil
+}
+
+type acceptor interface {
+	Accept() (net.Conn, error)
+}
+
+func (d *Downloader) acceptLoop(ln acceptor, confirm chan *PeerCon) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case <-d.stopped():
+			conn.Close()
+			return
+		default:
+		}
+		go d.handleInbound(conn, confirm)
+	}
+}
+
+func (d *Downloader) handleInbound(conn net.Conn, confirm chan *PeerCon) {
+	ip, port, ok := remoteIPPort(conn)
+	if !ok || d.isBanned(ip) {
+		conn.Close()
+		return
+	}
+	if d.isBlocked(ip) {
+		d.Stats.BlockedInbound.Add(1)
+		conn.Close()
+		return
+	}
+	wrapped, err := acceptEncryption(conn, d.tf.SwarmHashes(), d.cfg.Encryption)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	p := &Peer{IP: ip, port: uint16(port)}
+	n := d.newPeerCon(p, d.tf.InfoHash)
+	n.con = newAcceptedTCPConnector(wrapped)
+	if err := n.AcceptHandshake(); err != nil {
+		conn.Close()
+		return
+	}
+	d.Stats.InboundPeers.Add(1)
+	select {
+	case confirm <- n:
+	case <-d.stopped():
+		conn.Close()
+	}
+}
@@ -0,0 +1,100 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestMoveFileKeepsSourceOnRenameError(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.WriteFile(src, []byte("data"), 0644)
+	// Renaming into a missing directory fails, and not because of another
+	// filesystem, so nothing may be copied.
+	dst := filepath.Join(dir, "missing", "dst")
+	if err := moveFile(src, dst); err == nil {
+		t.Fatal("move into a missing directory succeeded")
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Fatalf("source gone after a failed move: %v", err)
+	}
+	if _, err := os.Stat(dst + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("fell back to copying on a non cross-device error")
+	}
+}
+
+func TestMoveFileRenames(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	os.WriteFile(src, []byte("data"), 0644)
+	if err := moveFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "data" {
+		t.Fatalf("moved file holds %q", got)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatal("source still present after move")
+	}
+}
+
+func TestMoveFileKeepsExistingDestination(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	os.WriteFile(src, []byte("new"), 0644)
+	os.WriteFile(dst, []byte("old"), 0644)
+	if err := moveFile(src, dst); err == nil {
+		t.Fatal("moved onto an existing file")
+	}
+	if err := copyFile(src, dst); err == nil {
+		t.Fatal("copied onto an existing file")
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "old" {
+		t.Fatalf("destination overwritten with %q", got)
+	}
+	if got, _ := os.ReadFile(src); string(got) != "new" {
+		t.Fatalf("source changed to %q", got)
+	}
+}
+
+// A symlink planted at the temporary name is replaced, never written
+// through.
+func TestCopyFileIgnoresPlantedSymlink(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	victim := filepath.Join(dir, "victim")
+	os.WriteFile(src, []byte("data"), 0644)
+	os.WriteFile(victim, []byte("keep"), 0644)
+	if err := os.Symlink(victim, dst+".tmp"); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	if err := copyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(victim); string(got) != "keep" {
+		t.Fatalf("symlink target overwritten with %q", got)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "data" {
+		t.Fatalf("copy holds %q", got)
+	}
+}
+
+func TestCrossDevice(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows reports ERROR_NOT_SAME_DEVICE instead")
+	}
+	if !crossDevice(&os.LinkError{Op: "rename", Err: syscall.EXDEV}) {
+		t.Error("EXDEV not treated as a cross-device rename")
+	}
+	for _, errno := range []syscall.Errno{syscall.EACCES, syscall.ENOENT, syscall.EISDIR} {
+		if crossDevice(&os.LinkError{Op: "rename", Err: errno}) {
+			t.Errorf("%v treated as a cross-device rename", errno)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message Stream Encryption: a Diffie-Hellman exchange followed by RC4 on
+// both directions, which hides the BitTorrent handshake from traffic
+// shaping.
+
+type EncryptionPolicy int
+
+const (
+	ENCRYPTION_DISABLED EncryptionPolicy = iota
+	ENCRYPTION_PREFER
+	ENCRYPTION_REQUIRE
+)
+
+func (ep EncryptionPolicy) String() string {
+	switch ep {
+	case ENCRYPTION_DISABLED:
+		return "disabled"
+	case ENCRYPTION_PREFER:
+		return "prefer"
+	case ENCRYPTION_REQUIRE:
+		return "require"
+	}
+	return fmt.Sprintf("encryption(%d)", int(ep))
+}
+
+// provide is the set of crypto methods we offer when dialling, none when
+// we do not encrypt at all.
+func (ep EncryptionPolicy) provide() uint32 {
+	switch ep {
+	case ENCRYPTION_PREFER:
+		return CRYPTO_RC4 | CRYPTO_PLAINTEXT
+	case ENCRYPTION_REQUIRE:
+		return CRYPTO_RC4
+	}
+	return 0
+}
+
+func ParseEncryptionPolicy(s string) (EncryptionPolicy, error) {
+	switch strings.ToLower(s) {
+	case "disabled", "off":
+		return ENCRYPTION_DISABLED, nil
+	case "prefer", "on":
+		return ENCRYPTION_PREFER, nil
+	case "require", "forced":
+		return ENCRYPTION_REQUIRE, nil
+	}
+	return ENCRYPTION_DISABLED, fmt.Errorf("unknown encryption policy %q", s)
+}
+
+const (
+	CRYPTO_PLAINTEXT uint32 = 0x01
+	CRYPTO_RC4       uint32 = 0x02
+)
+
+const (
+	mseKeyLen  = 96
+	mseMaxPad  = 512
+	mseTimeout = 10 * time.Second
+)
+
+var (
+	mseP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG = big.NewInt(2)
+)
+
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func mseKeyPair() (*big.Int, []byte, error) {
+	priv := make([]byte, 20)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(priv)
+	return x, new(big.Int).Exp(mseG, x, mseP).FillBytes(make([]byte, mseKeyLen)), nil
+}
+
+func mseSecret(x *big.Int, remote []byte) []byte {
+	y := new(big.Int).SetBytes(remote)
+	return new(big.Int).Exp(y, x, mseP).FillBytes(make([]byte, mseKeyLen))
+}
+
+// mseCipher builds one direction's RC4 stream, dropping the first 1024
+// bytes of keystream as the spec requires.
+func mseCipher(name string, secret []byte, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash([]byte(name), secret, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func msePad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(mseMaxPad+1))
+	_, err := rand.Read(pad)
+	return pad, err
+}
+
+// mseSync reads until the stream ends with marker, giving up after limit
+// bytes.
+func mseSync(r io.Reader, marker []byte, limit int) error {
+	buf := make([]byte, 0, limit)
+	one := make([]byte, 1)
+	for len(buf) < limit {
+		if _, err := io.ReadFull(r, one); err != nil {
+			return err
+		}
+		buf = append(buf, one[0])
+		if bytes.HasSuffix(buf, marker) {
+			return nil
+		}
+	}
+	return fmt.Errorf("encryption handshake out of sync")
+}
+
+func mseReadEncrypted(r io.Reader, c *rc4.Cipher, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	c.XORKeyStream(buf, buf)
+	return buf, nil
+}
+
+// mseInitiate runs the connecting side of the handshake. skey is the info
+// hash of the torrent we want.
+func mseInitiate(conn net.Conn, skey [20]byte, provide uint32) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	x, ya, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := msePad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(ya, padA...)); err != nil {
+		return nil, err
+	}
+	yb := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(conn, yb); err != nil {
+		return nil, err
+	}
+	secret := mseSecret(x, yb)
+	enc := mseCipher("keyA", secret, skey[:])
+	dec := mseCipher("keyB", secret, skey[:])
+
+	msg := new(bytes.Buffer)
+	msg.Write(mseHash([]byte("req1"), secret))
+	req2 := mseHash([]byte("req2"), skey[:])
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		msg.WriteByte(req2[i] ^ req3[i])
+	}
+	plain := make([]byte, 16)
+	binary.BigEndian.PutUint32(plain[8:12], provide)
+	enc.XORKeyStream(plain, plain)
+	msg.Write(plain)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+
+	vc := make([]byte, 8)
+	dec.XORKeyStream(vc, vc)
+	if err := mseSync(conn, vc, mseMaxPad+len(vc)); err != nil {
+		return nil, err
+	}
+	head, err := mseReadEncrypted(conn, dec, 6)
+	if err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(head[:4])
+	if _, err := mseReadEncrypted(conn, dec, int(binary.BigEndian.Uint16(head[4:6]))); err != nil {
+		return nil, err
+	}
+	switch {
+	case selected == CRYPTO_RC4 && provide&CRYPTO_RC4 != 0:
+		return &rc4Conn{Conn: conn, enc: enc, dec: dec}, nil
+	case selected == CRYPTO_PLAINTEXT && provide&CRYPTO_PLAINTEXT != 0:
+		return conn, nil
+	}
+	return nil, fmt.Errorf("peer selected unsupported crypto method %d", selected)
+}
+
+// mseRespond runs the accepting side of the handshake. The peer proves
+// which of skeys it wants without revealing it on the wire. Any initial
+// payload it sent is returned at the start of the connection's stream.
+func mseRespond(conn net.Conn, skeys [][20]byte, policy EncryptionPolicy) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	ya := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(conn, ya); err != nil {
+		return nil, err
+	}
+	x, yb, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padB, err := msePad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(yb, padB...)); err != nil {
+		return nil, err
+	}
+	secret := mseSecret(x, ya)
+	req1 := mseHash([]byte("req1"), secret)
+	if err := mseSync(conn, req1, mseMaxPad+len(req1)); err != nil {
+		return nil, err
+	}
+	xored := make([]byte, 20)
+	if _, err := io.ReadFull(conn, xored); err != nil {
+		return nil, err
+	}
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range xored {
+		xored[i] ^= req3[i]
+	}
+	var skey []byte
+	for _, k := range skeys {
+		if bytes.Equal(mseHash([]byte("req2"), k[:]), xored) {
+			skey = append([]byte{}, k[:]...)
+			break
+		}
+	}
+	if skey == nil {
+		return nil, fmt.Errorf("encrypted handshake for unknown torrent")
+	}
+	dec := mseCipher("keyA", secret, skey)
+	enc := mseCipher("keyB", secret, skey)
+
+	head, err := mseReadEncrypted(conn, dec, 14)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head[:8], make([]byte, 8)) {
+		return nil, fmt.Errorf("bad verification constant")
+	}
+	provide := binary.BigEndian.Uint32(head[8:12])
+	if _, err := mseReadEncrypted(conn, dec, int(binary.BigEndian.Uint16(head[12:14]))); err != nil {
+		return nil, err
+	}
+	iaLen, err := mseReadEncrypted(conn, dec, 2)
+	if err != nil {
+		return nil, err
+	}
+	ia, err := mseReadEncrypted(conn, dec, int(binary.BigEndian.Uint16(iaLen)))
+	if err != nil {
+		return nil, err
+	}
+
+	var selected uint32
+	switch {
+	case provide&CRYPTO_RC4 != 0:
+		selected = CRYPTO_RC4
+	case provide&CRYPTO_PLAINTEXT != 0 && policy != ENCRYPTION_REQUIRE:
+		selected = CRYPTO_PLAINTEXT
+	default:
+		return nil, fmt.Errorf("no acceptable crypto method offered")
+	}
+	reply := make([]byte, 14)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	enc.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+	if selected == CRYPTO_RC4 {
+		return &rc4Conn{Conn: conn, enc: enc, dec: dec, prefix: ia}, nil
+	}
+	return &prefixConn{Conn: conn, prefix: ia}, nil
+}
+
+// acceptEncryption looks at the first bytes an incoming peer sends to tell
+// a plaintext handshake from an encrypted one and applies the policy.
+func acceptEncryption(conn net.Conn, skeys [][20]byte, policy EncryptionPolicy) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(mseTimeout))
+	head := make([]byte, 20)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	prefixed := &prefixConn{Conn: conn, prefix: head}
+	if head[0] == 19 && string(head[1:]) == "BitTorrent protocol" {
+		if policy == ENCRYPTION_REQUIRE {
+			return nil, fmt.Errorf("peer does not encrypt")
+		}
+		return prefixed, nil
+	}
+	if policy == ENCRYPTION_DISABLED {
+		return nil, fmt.Errorf("peer requires encryption")
+	}
+	return mseRespond(prefixed, skeys, policy)
+}
+
+// prefixConn replays bytes already read from the connection.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// rc4Conn encrypts everything written and decrypts everything read. Writes
+// are serialised so the keystream matches the order bytes hit the wire.
+type rc4Conn struct {
+	net.Conn
+	wmu    sync.Mutex
+	enc    *rc4.Cipher
+	dec    *rc4.Cipher
+	prefix []byte
+}
+
+func (c *rc4Conn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(p)
+	c.dec.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func (c *rc4Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
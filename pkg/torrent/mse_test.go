@@ -0,0 +1,174 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// wireTap records everything that crosses a bufferedPipe.
+type wireTap struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *wireTap) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *wireTap) Bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return bytes.Clone(w.buf.Bytes())
+}
+
+// bufferedPipe is net.Pipe with a buffer each way, as socket buffers give
+// a real connection: both sides of the MSE handshake write before reading,
+// which deadlocks a bare net.Pipe.
+func bufferedPipe(tap io.Writer) (net.Conn, net.Conn) {
+	a, aRelay := net.Pipe()
+	bRelay, b := net.Pipe()
+	relay := func(dst, src net.Conn) {
+		io.Copy(io.MultiWriter(dst, tap), src)
+		dst.Close()
+	}
+	go relay(bRelay, aRelay)
+	go relay(aRelay, bRelay)
+	return a, b
+}
+
+type mseResult struct {
+	err       error
+	encrypted bool
+}
+
+// mseAttempt connects a dialling peer offering provide to an accepting
+// peer with policy, then exchanges a handshake and a reply in each
+// direction.
+func mseAttempt(t *testing.T, skey [20]byte, provide uint32, policy EncryptionPolicy, tap io.Writer) (dial, accept mseResult) {
+	t.Helper()
+	a, b := bufferedPipe(tap)
+	defer a.Close()
+	defer b.Close()
+	var infoHash [20]byte
+	copy(infoHash[:], "the info hash       ")
+	hs := append([]byte("\x13BitTorrent protocol"), make([]byte, 48)...)
+	done := make(chan mseResult, 1)
+	go func() {
+		conn, err := acceptEncryption(b, [][20]byte{infoHash}, policy)
+		if err != nil {
+			b.Close()
+			done <- mseResult{err: err}
+			return
+		}
+		_, encrypted := conn.(*rc4Conn)
+		got := make([]byte, len(hs))
+		if _, err := io.ReadFull(conn, got); err == nil && !bytes.Equal(got, hs) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			_, err = conn.Write([]byte("reply"))
+		}
+		done <- mseResult{err: err, encrypted: encrypted}
+	}()
+	conn := net.Conn(a)
+	if provide != 0 {
+		c, err := mseInitiate(a, skey, provide)
+		if err != nil {
+			a.Close()
+			return mseResult{err: err}, <-done
+		}
+		conn = c
+		_, dial.encrypted = c.(*rc4Conn)
+	}
+	if _, err := conn.Write(hs); err != nil {
+		dial.err = err
+		return dial, <-done
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "reply" {
+		dial.err = io.ErrUnexpectedEOF
+	}
+	return dial, <-done
+}
+
+func TestEncryptionPolicies(t *testing.T) {
+	var infoHash [20]byte
+	copy(infoHash[:], "the info hash       ")
+	tests := []struct {
+		dial, accept EncryptionPolicy
+		// ok is whether the peers end up talking, encrypted whether they
+		// do so over RC4 and fallback whether the dialler had to retry
+		// in plaintext.
+		ok, encrypted, fallback bool
+	}{
+		{ENCRYPTION_DISABLED, ENCRYPTION_DISABLED, true, false, false},
+		{ENCRYPTION_DISABLED, ENCRYPTION_PREFER, true, false, false},
+		{ENCRYPTION_DISABLED, ENCRYPTION_REQUIRE, false, false, false},
+		{ENCRYPTION_PREFER, ENCRYPTION_DISABLED, true, false, true},
+		{ENCRYPTION_PREFER, ENCRYPTION_PREFER, true, true, false},
+		{ENCRYPTION_PREFER, ENCRYPTION_REQUIRE, true, true, false},
+		{ENCRYPTION_REQUIRE, ENCRYPTION_DISABLED, false, false, false},
+		{ENCRYPTION_REQUIRE, ENCRYPTION_PREFER, true, true, false},
+		{ENCRYPTION_REQUIRE, ENCRYPTION_REQUIRE, true, true, false},
+	}
+	for _, tt := range tests {
+		name := tt.dial.String() + "/" + tt.accept.String()
+		t.Run(name, func(t *testing.T) {
+			tap := &wireTap{}
+			// This mirrors PeerCon.connect, which redials in plaintext
+			// only when it prefers encryption.
+			dial, accept := mseAttempt(t, infoHash, tt.dial.provide(), tt.accept, tap)
+			fallback := false
+			if dial.err != nil && tt.dial == ENCRYPTION_PREFER {
+				fallback = true
+				tap = &wireTap{}
+				dial, accept = mseAttempt(t, infoHash, 0, tt.accept, tap)
+			}
+			ok := dial.err == nil && accept.err == nil
+			if ok != tt.ok {
+				t.Fatalf("connected %v, want %v (dial: %v, accept: %v)", ok, tt.ok, dial.err, accept.err)
+			}
+			if fallback != tt.fallback {
+				t.Errorf("fell back to plaintext %v, want %v", fallback, tt.fallback)
+			}
+			if !ok {
+				return
+			}
+			if dial.encrypted != tt.encrypted || accept.encrypted != tt.encrypted {
+				t.Errorf("encrypted dial %v accept %v, want %v", dial.encrypted, accept.encrypted, tt.encrypted)
+			}
+			if plain := bytes.Contains(tap.Bytes(), []byte("BitTorrent protocol")); plain == tt.encrypted {
+				t.Errorf("handshake visible on the wire %v with encryption %v", plain, tt.encrypted)
+			}
+		})
+	}
+}
+
+func TestEncryptionUnknownTorrent(t *testing.T) {
+	var other [20]byte
+	copy(other[:], "some other torrent  ")
+	dial, accept := mseAttempt(t, other, CRYPTO_RC4, ENCRYPTION_PREFER, io.Discard)
+	if dial.err == nil || accept.err == nil {
+		t.Fatalf("handshake for an unknown torrent accepted (dial: %v, accept: %v)", dial.err, accept.err)
+	}
+}
+
+// A dialler offering only plaintext through MSE is refused by a peer that
+// requires encryption but accepted by one that merely prefers it.
+func TestEncryptionPlaintextOffer(t *testing.T) {
+	var infoHash [20]byte
+	copy(infoHash[:], "the info hash       ")
+	dial, accept := mseAttempt(t, infoHash, CRYPTO_PLAINTEXT, ENCRYPTION_REQUIRE, io.Discard)
+	if dial.err == nil || accept.err == nil {
+		t.Fatal("plaintext offer accepted by a peer requiring encryption")
+	}
+	dial, accept = mseAttempt(t, infoHash, CRYPTO_PLAINTEXT, ENCRYPTION_PREFER, io.Discard)
+	if dial.err != nil || accept.err != nil || dial.encrypted || accept.encrypted {
+		t.Fatalf("plaintext offer not carried in plaintext (dial: %v, accept: %v)", dial.err, accept.err)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package torrent
+
+// openNoFollow is not available here; checkNotSymlink covers the gap.
+const openNoFollow = 0
@@ -0,0 +1,8 @@
+//go:build unix
+
+package torrent
+
+import "syscall"
+
+// openNoFollow makes opening a path fail if its last element is a symlink.
+const openNoFollow = syscall.O_NOFOLLOW
@@ -11,4 +11,31 @@ const (
 	MAX_CHOKED_TIME      = 16 * time.Second
 	MAX_BACKLOG          = 32
 	MAX_MSG_LEN          = 262144
+	READ_AHEAD_PIECES    = 8
+	MAX_OPEN_FILES       = 64
+	WRITE_CACHE_SIZE     = 16 << 20
+	DISK_WORKERS         = 4
+	PART_SUFFIX          = ".part"
+	RESUME_INTERVAL      = 30 * time.Second
+	MAX_RESUME_PEERS     = 200
+	VERIFY_READ_AHEAD    = 16
+	MAX_HASH_FAILURES    = 3
+	BAN_FILE             = ".gotorrent-banned"
+	DEFAULT_PORT         = 6881
+	PEER_DIAL_TIMEOUT    = 5 * time.Second
+	BLOCKLIST_POLL       = 30 * time.Second
+	DAT_ALLOW_LEVEL      = 128
+	MAX_REQUEST_LEN      = 131072
+	ALLOWED_FAST_COUNT   = 10
+	MAX_SUGGESTED        = 16
+	KEEPALIVE_INTERVAL   = 90 * time.Second
+	PEER_IDLE_TIMEOUT    = 2 * time.Minute
+	MAX_QUEUED_PIECES    = 64
+	CLIENT_VERSION       = "GoTorrent 0.0.1"
+	WEBSEED_TIMEOUT      = 60 * time.Second
+	WEBSEED_BACKOFF      = 5 * time.Second
+	MAX_WEBSEED_BACKOFF  = 10 * time.Minute
+	HASH_REQUEST_SPAN    = 512
+	HASH_WAIT            = 10 * time.Second
+	PART_COPY_CHUNK      = 1 << 20
 )
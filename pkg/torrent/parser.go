@@ -2,14 +2,21 @@ package torrent
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"path/filepath"
+	"sync"
 )
 
 type FileInfo struct {
-	Path   string
-	Length int
+	Path        string
+	Length      int
+	PiecesRoot  [32]byte
+	Padding     bool
+	Hidden      bool
+	Executable  bool
+	SymlinkPath string
 }
 
 func Open(r io.Reader) (*bencodeObject, error) {
@@ -24,25 +31,80 @@ func Open(r io.Reader) (*bencodeObject, error) {
 type TorrentFile struct {
 	Announce     string
 	AnnounceList [][]string
+	WebSeeds     []string
+	HTTPSeeds    []string
 	InfoHash     [20]byte
 	PieceHashes  [][20]byte
 	PieceLength  int
 	Length       int
 	Files        []FileInfo
 	Name         string
+	MetaVersion  int
+	HasV1        bool
+	HasV2        bool
+	InfoHashV2   [32]byte
+	PieceLayers  map[[32]byte][][32]byte
+	// layerMu guards PieceLayers, which fill in as peers send hashes the
+	// torrent file left out.
+	layerMu   *sync.RWMutex
+	v2Pieces  []v2PieceRef
+	infoBytes []byte
 }
-func (bto *TorrentFile) DownloadLength() (int64) {
-	if (bto.Length!=0) {
-		return int64(bto.Length);
-	} else {
-		total := int64(0)
-		for _,v := range bto.Files {
-			total+=int64(v.Length)
+
+func (bto *TorrentFile) DownloadLength() int64 {
+	total := int64(0)
+	for _, v := range bto.Files {
+		if !v.Padding {
+			total += int64(v.Length)
 		}
-		return total
 	}
+	return total
 }
 
+func (tf *TorrentFile) FileOffset(index int) int64 {
+	offset := int64(0)
+	for _, f := range tf.Files[:index] {
+		offset += int64(f.Length)
+	}
+	return offset
+}
+func (tf *TorrentFile) NumPieces() int {
+	if tf.HasV1 || tf.PieceLength == 0 {
+		return len(tf.PieceHashes)
+	}
+	return (tf.Length + tf.PieceLength - 1) / tf.PieceLength
+}
+func (tf *TorrentFile) PieceSize(index int) int {
+	if index == tf.NumPieces()-1 {
+		return tf.Length - index*tf.PieceLength
+	}
+	return tf.PieceLength
+}
+func (tf *TorrentFile) VerifyPiece(index int, data []byte) bool {
+	if index < 0 || index >= tf.NumPieces() || len(data) != tf.PieceSize(index) {
+		return false
+	}
+	if tf.HasV1 {
+		hash := sha1.Sum(data)
+		if hash != tf.PieceHashes[index] {
+			return false
+		}
+	}
+	// A hybrid piece whose v2 hash is still unknown is trusted to SHA-1.
+	if tf.HasV2 && (!tf.HasV1 || tf.pieceHashKnown(index)) {
+		return tf.verifyPieceV2(index, data)
+	}
+	return true
+}
+func (tf *TorrentFile) SwarmHashes() [][20]byte {
+	hashes := [][20]byte{tf.InfoHash}
+	if tf.HasV1 && tf.HasV2 {
+		var truncated [20]byte
+		copy(truncated[:], tf.InfoHashV2[:20])
+		hashes = append(hashes, truncated)
+	}
+	return hashes
+}
 
 func (bto *bencodeObject) toTorrentFile() (TorrentFile, error) {
 	infoObj, err := bto.valAt("info")
@@ -54,13 +116,87 @@ func (bto *bencodeObject) toTorrentFile() (TorrentFile, error) {
 		return TorrentFile{}, fmt.Errorf("failed to marshal info for hashing: %v", err)
 	}
 	infoHash := sha1.Sum([]byte(marshaledInfo))
+	infoHashV2 := sha256.Sum256([]byte(marshaledInfo))
 	nameObj, _ := infoObj.valAt("name")
 	pieceLengthObj, _ := infoObj.valAt("piece length")
+	if err := sanitizePathComponent(nameObj.str); err != nil {
+		return TorrentFile{}, fmt.Errorf("invalid torrent name: %v", err)
+	}
+	if pieceLengthObj.val <= 0 {
+		return TorrentFile{}, fmt.Errorf("invalid piece length")
+	}
+	tf := TorrentFile{
+		InfoHash:    infoHash,
+		infoBytes:   []byte(marshaledInfo),
+		PieceLength: int(pieceLengthObj.val),
+		Name:        nameObj.str,
+		MetaVersion: 1,
+	}
+	if mv, err := infoObj.valAt("meta version"); err == nil {
+		tf.MetaVersion = int(mv.val)
+	}
+	_, piecesErr := infoObj.valAt("pieces")
+	tf.HasV1 = piecesErr == nil
+	tf.HasV2 = tf.MetaVersion == 2
+	if !tf.HasV1 && !tf.HasV2 {
+		return TorrentFile{}, fmt.Errorf("unsupported meta version %d", tf.MetaVersion)
+	}
+	if tf.HasV1 {
+		if err := tf.parseV1(infoObj); err != nil {
+			return TorrentFile{}, err
+		}
+	}
+	if tf.HasV2 {
+		if err := tf.parseV2(bto, infoObj); err != nil {
+			return TorrentFile{}, err
+		}
+		copy(tf.InfoHashV2[:], infoHashV2[:])
+		if !tf.HasV1 {
+			copy(tf.InfoHash[:], infoHashV2[:20])
+		}
+	}
+	announceObj, _ := bto.valAt("announce")
+	announceListObj, _ := bto.valAt("announce-list")
+	var announceList [][]string
+	if announceListObj.list != nil {
+		for _, v := range announceListObj.list {
+			announceList = append(announceList, []string{})
+			for _, v2 := range v.list {
+				announceList[len(announceList)-1] = append(announceList[len(announceList)-1], v2.str)
+			}
+		}
+	} else {
+		announceList = [][]string{{announceObj.str}}
+	}
+	tf.Announce = announceObj.str
+	tf.AnnounceList = announceList
+	// url-list is a single URL or a list of them.
+	if urlList, err := bto.valAt("url-list"); err == nil {
+		if urlList.objType == STRING && urlList.str != "" {
+			tf.WebSeeds = []string{urlList.str}
+		}
+		for _, u := range urlList.list {
+			if u.objType == STRING && u.str != "" {
+				tf.WebSeeds = append(tf.WebSeeds, u.str)
+			}
+		}
+	}
+	if httpSeeds, err := bto.valAt("httpseeds"); err == nil {
+		for _, u := range httpSeeds.list {
+			if u.objType == STRING && u.str != "" {
+				tf.HTTPSeeds = append(tf.HTTPSeeds, u.str)
+			}
+		}
+	}
+	return tf, nil
+}
+
+func (tf *TorrentFile) parseV1(infoObj bencodeObject) error {
 	piecesObj, _ := infoObj.valAt("pieces")
 	const hashLen = 20
 	piecesBytes := []byte(piecesObj.str)
 	if len(piecesBytes)%hashLen != 0 {
-		return TorrentFile{}, fmt.Errorf("invalid pieces hash length")
+		return fmt.Errorf("invalid pieces hash length")
 	}
 	numPieces := len(piecesBytes) / hashLen
 	pieceHashes := make([][20]byte, numPieces)
@@ -70,49 +206,139 @@ func (bto *bencodeObject) toTorrentFile() (TorrentFile, error) {
 	var totalLength int64
 	var files []FileInfo
 	if lenObj, err := infoObj.valAt("length"); err == nil {
+		if lenObj.val < 0 {
+			return fmt.Errorf("invalid length %d", lenObj.val)
+		}
 		totalLength = lenObj.val
 		files = append(files, FileInfo{
-			Path:   nameObj.str,
+			Path:   tf.Name,
 			Length: int(lenObj.val),
 		})
 	} else if filesObj, err := infoObj.valAt("files"); err == nil {
-		baseDir := nameObj.str
 		for i := 0; i < len(filesObj.list); i++ {
 			fObj, _ := filesObj.valAtIndex(i)
-			fLen, _ := fObj.valAt("length")
+			fLen, err := fObj.valAt("length")
+			if err != nil || fLen.val < 0 {
+				return fmt.Errorf("invalid length in file %d", i)
+			}
 			pathListObj, _ := fObj.valAt("path")
-			fullPath := baseDir
+			components := []string{tf.Name}
 			for _, p := range pathListObj.list {
-				fullPath = filepath.Join(fullPath, p.str)
+				if p.objType != STRING {
+					return fmt.Errorf("invalid path in file %d", i)
+				}
+				components = append(components, p.str)
+			}
+			if len(components) == 1 {
+				return fmt.Errorf("empty path in file %d", i)
 			}
-			files = append(files, FileInfo{
+			fullPath, err := sanitizePath(components)
+			if err != nil {
+				return fmt.Errorf("invalid path in file %d: %v", i, err)
+			}
+			fi := FileInfo{
 				Path:   fullPath,
 				Length: int(fLen.val),
-			})
-			totalLength += fLen.val
+			}
+			if err := parseFileAttr(fObj, &fi); err != nil {
+				return fmt.Errorf("invalid attributes in file %d: %v", i, err)
+			}
+			if len(components) > 2 && components[1] == ".pad" {
+				fi.Padding = true
+			}
+			files = append(files, fi)
+			totalLength += int64(fi.Length)
 		}
 	}
-	announceObj, _ := bto.valAt("announce")
-	announceListObj, _ := bto.valAt("announce-list")
-	var announceList [][]string
-	if announceListObj.list != nil {
-		for _, v := range announceListObj.list {
-			announceList = append(announceList, []string{})
-			for _, v2 := range v.list {
-				announceList[len(announceList)-1] = append(announceList[len(announceList)-1], v2.str)
+	tf.PieceHashes = pieceHashes
+	tf.Length = int(totalLength)
+	tf.Files = files
+	return nil
+}
+
+func (tf *TorrentFile) parseV2(bto *bencodeObject, infoObj bencodeObject) error {
+	if tf.PieceLength < merkleBlockSize || tf.PieceLength&(tf.PieceLength-1) != 0 {
+		return fmt.Errorf("v2 piece length must be a power of two of at least 16 KiB")
+	}
+	treeObj, err := infoObj.valAt("file tree")
+	if err != nil {
+		return fmt.Errorf("missing file tree: %v", err)
+	}
+	var v2Files []FileInfo
+	if err := parseFileTree(treeObj, nil, &v2Files); err != nil {
+		return fmt.Errorf("invalid file tree: %v", err)
+	}
+	if len(v2Files) == 0 {
+		return fmt.Errorf("empty file tree")
+	}
+	layersObj, _ := bto.valAt("piece layers")
+	layers, err := parsePieceLayers(layersObj)
+	if err != nil {
+		return err
+	}
+	tf.PieceLayers = layers
+	tf.layerMu = &sync.RWMutex{}
+	single := len(v2Files) == 1 && len(treeObj.dict) == 1 && v2Files[0].Path == treeObj.dict[0].key
+	if !single {
+		for i := range v2Files {
+			v2Files[i].Path = filepath.Join(tf.Name, v2Files[i].Path)
+		}
+	}
+	if tf.HasV1 {
+		roots := make(map[string][32]byte)
+		for _, f := range v2Files {
+			roots[f.Path] = f.PiecesRoot
+		}
+		for i, f := range tf.Files {
+			if root, ok := roots[f.Path]; ok {
+				tf.Files[i].PiecesRoot = root
 			}
 		}
 	} else {
-		announceList = [][]string{{announceObj.str}}
+		tf.Files = layoutV2(v2Files, tf.PieceLength)
+		total := 0
+		for _, f := range tf.Files {
+			total += f.Length
+		}
+		tf.Length = total
+	}
+	if err := tf.buildV2Pieces(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseFileAttr(obj bencodeObject, fi *FileInfo) error {
+	attrObj, err := obj.valAt("attr")
+	if err != nil {
+		return nil
+	}
+	for _, c := range attrObj.str {
+		switch c {
+		case 'p':
+			fi.Padding = true
+		case 'h':
+			fi.Hidden = true
+		case 'x':
+			fi.Executable = true
+		case 'l':
+			targetObj, err := obj.valAt("symlink path")
+			if err != nil {
+				return fmt.Errorf("symlink without symlink path")
+			}
+			var components []string
+			for _, p := range targetObj.list {
+				components = append(components, p.str)
+			}
+			target, err := sanitizePath(components)
+			if err != nil {
+				return fmt.Errorf("invalid symlink path: %v", err)
+			}
+			fi.SymlinkPath = target
+		}
+	}
+	if fi.SymlinkPath != "" {
+		fi.Length = 0
 	}
-	return TorrentFile{
-		Announce:     announceObj.str,
-		AnnounceList: announceList,
-		InfoHash:     infoHash,
-		PieceHashes:  pieceHashes,
-		PieceLength:  int(pieceLengthObj.val),
-		Length:       int(totalLength),
-		Name:         nameObj.str,
-		Files:        files,
-	}, nil
+	return nil
 }
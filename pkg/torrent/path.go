@@ -0,0 +1,104 @@
+package torrent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func sanitizePathComponent(c string) error {
+	if c == "" {
+		return fmt.Errorf("empty path component")
+	}
+	if c == "." || c == ".." {
+		return fmt.Errorf("path component %q not allowed", c)
+	}
+	if !utf8.ValidString(c) {
+		return fmt.Errorf("path component %q is not valid utf-8", c)
+	}
+	if strings.ContainsAny(c, "/\\\x00") {
+		return fmt.Errorf("path component %q contains a separator or nul byte", c)
+	}
+	if filepath.IsAbs(c) || filepath.VolumeName(c) != "" || (len(c) >= 2 && c[1] == ':') {
+		return fmt.Errorf("path component %q is absolute", c)
+	}
+	base := strings.ToUpper(c)
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.TrimRight(base, " ")] {
+		return fmt.Errorf("path component %q is a reserved name", c)
+	}
+	return nil
+}
+
+func sanitizePath(components []string) (string, error) {
+	if len(components) == 0 {
+		return "", fmt.Errorf("empty path")
+	}
+	for _, c := range components {
+		if err := sanitizePathComponent(c); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(components...), nil
+}
+
+func confinePath(root, rel string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(absRoot, rel)
+	r, err := filepath.Rel(absRoot, full)
+	if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) || filepath.IsAbs(r) {
+		return "", fmt.Errorf("path %q escapes download directory %q", rel, root)
+	}
+	return full, nil
+}
+
+// checkNotSymlink refuses to open path when something planted a symlink
+// there, on systems without O_NOFOLLOW too.
+func checkNotSymlink(path string) error {
+	fi, err := os.Lstat(path)
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s is a symlink", path)
+	}
+	return nil
+}
+
+func checkNoSymlinkEscape(root, dir string) error {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	realRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return err
+	}
+	// Directories that do not exist yet are judged by their nearest
+	// existing ancestor, so the check can run before MkdirAll.
+	realDir, err := filepath.EvalSymlinks(dir)
+	for os.IsNotExist(err) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+		realDir, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return err
+	}
+	r, err := filepath.Rel(realRoot, realDir)
+	if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("directory %q resolves outside download directory %q", dir, root)
+	}
+	return nil
+}
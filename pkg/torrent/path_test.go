@@ -0,0 +1,95 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCraftedPathsRejected(t *testing.T) {
+	data := []byte("x")
+	tests := []struct {
+		name  string
+		tname string
+		path  []string
+	}{
+		{"dot dot component", "t", []string{"..", "evil"}},
+		{"dot dot name", "..", nil},
+		{"absolute component", "t", []string{"/etc/passwd"}},
+		{"drive letter", "t", []string{"C:", "evil"}},
+		{"backslash", "t", []string{`..\evil`}},
+		{"reserved name", "t", []string{"CON"}},
+		{"reserved name with extension", "t", []string{"nul.txt"}},
+		{"nul byte", "t", []string{"a\x00b"}},
+		{"empty component", "t", []string{"a", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := []testFile{{path: tt.path, data: data}}
+			if tt.path != nil {
+				files = append(files, testFile{path: []string{"ok"}, data: data})
+			}
+			if _, err := parseTorrent(torrentBytes(tt.tname, 16384, files)); err == nil {
+				t.Fatal("crafted torrent was accepted")
+			}
+		})
+	}
+}
+
+func TestSymlinkedDirectoryRejected(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "t")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	tf, _ := makeTorrent(t, "t", 16384, []testFile{
+		{path: []string{"sub", "a"}, data: []byte("a")},
+		{path: []string{"b"}, data: []byte("b")},
+	})
+	cfg := DefaultConfig()
+	cfg.DownloadDir = root
+	if _, err := NewTorrentWriter(tf, cfg); err == nil {
+		t.Fatal("writer followed a symlinked directory")
+	}
+	entries, _ := os.ReadDir(outside)
+	if len(entries) != 0 {
+		t.Fatalf("created %d entries outside the download directory", len(entries))
+	}
+}
+
+func TestPlantedSymlinkFileRejected(t *testing.T) {
+	root := t.TempDir()
+	target := filepath.Join(t.TempDir(), "target")
+	os.WriteFile(target, []byte("keep"), 0644)
+	os.MkdirAll(filepath.Join(root, "t"), 0755)
+	if err := os.Symlink(target, filepath.Join(root, "t", "a")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	tf, _ := makeTorrent(t, "t", 16384, []testFile{
+		{path: []string{"a"}, data: randomBytes(100)},
+		{path: []string{"b"}, data: randomBytes(100)},
+	})
+	cfg := DefaultConfig()
+	cfg.DownloadDir = root
+	cfg.Allocation = ALLOC_FULL
+	if _, err := NewTorrentWriter(tf, cfg); err == nil {
+		t.Fatal("writer opened a planted symlink")
+	}
+	if got, _ := os.ReadFile(target); string(got) != "keep" {
+		t.Fatalf("symlink target was modified: %q", got)
+	}
+}
+
+func TestCheckNoSymlinkEscapeMissingDir(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if err := checkNoSymlinkEscape(root, filepath.Join(root, "link", "not", "yet")); err == nil {
+		t.Fatal("missing directory below an escaping symlink passed")
+	}
+	if err := checkNoSymlinkEscape(root, filepath.Join(root, "plain", "not", "yet")); err != nil {
+		t.Fatalf("missing directory inside root rejected: %v", err)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
 )
 
 type MessageID uint8
@@ -21,10 +23,7 @@ const (
 	CANCEL
 	EXTENDED = 20
 )
-const (
-	ExtendedHandshakeID = 0
-	UtPexID             = 1
-)
+const ExtendedHandshakeID = 0
 
 type PeerCon struct {
 	myBitfield   Bitfield
@@ -33,39 +32,104 @@ type PeerCon struct {
 	tf           *TorrentFile
 	p            *Peer
 	con          *TCPConnector
-	choked       bool
-	pexCh        chan string
-	remotePexID  int
+	out          *sendQueue
+	choked       atomic.Bool
+	// bitMu guards peerBitfield, which the request worker reads while
+	// the message loop updates it.
+	bitMu sync.Mutex
+	pexCh chan string
+	// exts are the extensions we offer; remoteExt maps extension names to
+	// the IDs the peer wants them sent under.
+	exts           *extensionRegistry
+	extMu          sync.Mutex
+	remoteExt      map[string]int
+	peerUploadOnly atomic.Bool
+	infoHash       [20]byte
+	peerV2         bool
+	hashFailures   atomic.Int32
+	encryption     EncryptionPolicy
+	// amInterested is what we last told the peer, changed under
+	// interestMu so the messages queued match it; lastSend is the
+	// UnixNano time of our last message, for keep-alives.
+	amInterested atomic.Bool
+	interestMu   sync.Mutex
+	lastSend     atomic.Int64
+	// Fast Extension state. allowedFast is what we grant the peer;
+	// peerAllowedFast and suggested come from it and are read by the
+	// request worker under fastMu. peerFast is set by the handshake,
+	// before DownloadLoop starts, and allowedFast only by DownloadLoop's
+	// goroutine. amChoking is also read by whoever queues our messages.
+	peerFast        bool
+	amChoking       atomic.Bool
+	allowedFast     []int
+	fastMu          sync.Mutex
+	peerAllowedFast []int
+	suggested       []int
+	rejects         chan int
+	// superseed is set when the peer is being superseeded and only sees
+	// the pieces we reveal to it. It belongs to DownloadLoop's goroutine.
+	superseed bool
 }
 
-func NewPeerCon(tf *TorrentFile, p *Peer, bits Bitfield, pexCh chan string) *PeerCon {
+func NewPeerCon(tf *TorrentFile, p *Peer, infoHash [20]byte, bits Bitfield, pexCh chan string) *PeerCon {
 	con := NewTCPConnector(p)
-	numPieces := len(tf.PieceHashes)
+	numPieces := tf.NumPieces()
 	bitfieldSize := (numPieces + 7) / 8
 	bk := make(chan struct{}, MAX_BACKLOG)
 	for range MAX_BACKLOG {
 		bk <- struct{}{}
 	}
-	return &PeerCon{
+	pc := &PeerCon{
 		tf:           tf,
 		p:            p,
 		con:          con,
+		out:          newSendQueue(),
 		myBitfield:   bits,
 		peerBitfield: make(Bitfield, bitfieldSize),
-		choked:       true,
 		backlog:      bk,
 		pexCh:        pexCh,
-		remotePexID:  0,
+		exts:         defaultExtensions,
+		remoteExt:    make(map[string]int),
+		infoHash:     infoHash,
+		rejects:      make(chan int, MAX_BACKLOG),
 	}
+	pc.choked.Store(true)
+	pc.amChoking.Store(true)
+	return pc
 }
-func (p *PeerCon) ShakeHands() error {
+func (p *PeerCon) handshake() []byte {
 	req := new(bytes.Buffer)
 	binary.Write(req, binary.BigEndian, uint8(19))
 	req.Write([]byte("BitTorrent protocol"))
-	req.Write([]byte{0, 0, 0, 0, 0, 0x10, 0, 0x05})
-	req.Write(p.tf.InfoHash[:])
+	reserved := []byte{0, 0, 0, 0, 0, 0x10, 0, 0x05}
+	if p.tf.HasV2 {
+		reserved[7] |= 0x10
+	}
+	req.Write(reserved)
+	req.Write(p.infoHash[:])
 	req.Write([]byte(genPeerID("-GT0001-XXXXXXXXXXXX")))
-	if err := p.con.Send(req.Bytes()); err != nil {
+	return req.Bytes()
+}
+
+// connect dials the peer according to the encryption policy. With
+// ENCRYPTION_PREFER a peer that fails the encrypted handshake is dialled
+// again in plaintext.
+func (p *PeerCon) connect() error {
+	provide := p.encryption.provide()
+	if provide == 0 {
+		return p.con.dial()
+	}
+	err := p.con.dialEncrypted(p.infoHash, provide)
+	if err == nil || p.encryption == ENCRYPTION_REQUIRE {
+		return err
+	}
+	return p.con.dial()
+}
+func (p *PeerCon) ShakeHands() error {
+	if err := p.connect(); err != nil {
+		return err
+	}
+	if err := p.con.Send(p.handshake()); err != nil {
 		return err
 	}
 	resp, _, err := p.con.RecvAll(68, 2)
@@ -75,23 +139,43 @@ func (p *PeerCon) ShakeHands() error {
 	if len(resp) != 68 {
 		return fmt.Errorf("invalid handshake length")
 	}
-	if !bytes.Equal(p.tf.InfoHash[:], resp[28:48]) {
+	if !bytes.Equal(p.infoHash[:], resp[28:48]) {
 		return fmt.Errorf("info hash mismatch")
 	}
+	p.peerV2 = resp[27]&0x10 != 0
+	p.peerFast = resp[27]&0x04 != 0
 	return nil
 }
-func (p *PeerCon) SendExtendedHandshake() error {
-	payload := []byte("d1:md6:ut_pexi1eee")
-	buf := new(bytes.Buffer)
-	buf.WriteByte(byte(ExtendedHandshakeID))
-	buf.Write(payload)
-	return p.SendMessage(&Message{ID: EXTENDED, Payload: buf.Bytes()})
+
+// AcceptHandshake answers a peer that connected to us. The peer speaks
+// first, naming one of the torrent's swarm hashes.
+func (p *PeerCon) AcceptHandshake() error {
+	req, _, err := p.con.RecvAll(68, 5)
+	if err != nil {
+		return fmt.Errorf("handshake recv failed: %v", err)
+	}
+	if req[0] != 19 || string(req[1:20]) != "BitTorrent protocol" {
+		return fmt.Errorf("not a bittorrent handshake")
+	}
+	found := false
+	for _, h := range p.tf.SwarmHashes() {
+		if bytes.Equal(h[:], req[28:48]) {
+			p.infoHash = h
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("info hash mismatch")
+	}
+	p.peerV2 = req[27]&0x10 != 0
+	p.peerFast = req[27]&0x04 != 0
+	return p.con.Send(p.handshake())
 }
 func (p *PeerCon) SendBitfield() error {
 	return p.SendMessage(&Message{ID: BITFIELD, Payload: p.myBitfield})
 }
 func (p *PeerCon) ReadMessage() (*Message, error) {
-	lenBuf, _, err := p.con.RecvAll(4, 10)
+	lenBuf, _, err := p.con.RecvAll(4, float32(PEER_IDLE_TIMEOUT.Seconds()))
 	if err != nil {
 		return nil, err
 	}
@@ -111,43 +195,111 @@ func (p *PeerCon) ReadMessage() (*Message, error) {
 		Payload: msgBuf[1:],
 	}, nil
 }
+
+// SendMessage queues a message for the writer goroutine.
 func (p *PeerCon) SendMessage(msg *Message) error {
-	return p.con.Send(msg.Serialize())
+	return p.out.push(msg.Serialize())
+}
+func (p *PeerCon) SendHave(index int) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return p.SendMessage(&Message{ID: HAVE, Payload: payload})
 }
 func (p *PeerCon) SendInterested() error {
 	return p.SendMessage(&Message{ID: INTERESTED})
 }
 func (p *PeerCon) SendUnchoke() error {
+	if !p.amChoking.Swap(false) {
+		return nil
+	}
 	return p.SendMessage(&Message{ID: UNCHOKE})
 }
+
+// SendChoke chokes the peer and drops the blocks still queued for it. A
+// fast peer keeps the blocks of its allowed fast set and is sent
+// REJECT_REQUEST for the others, since it would otherwise wait for them;
+// other peers know a choke discards their requests.
+func (p *PeerCon) SendChoke() error {
+	if p.amChoking.Swap(true) {
+		return nil
+	}
+	if err := p.SendMessage(&Message{ID: CHOKE}); err != nil {
+		return err
+	}
+	dropped := p.out.purge(func(qp queuedPiece) bool {
+		return !p.peerFast || !slices.Contains(p.allowedFast, qp.index)
+	})
+	if !p.peerFast {
+		return nil
+	}
+	for _, qp := range dropped {
+		if err := p.SendReject(qp.index, qp.begin, qp.length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 func (p *PeerCon) SendRequest(index, begin, length int) error {
-	payload := make([]byte, 12)
-	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
-	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
-	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
-	return p.SendMessage(&Message{ID: REQUEST, Payload: payload})
+	return p.SendRequests([][3]int{{index, begin, length}})
 }
+
+// SendRequests queues several requests to go out in a single write.
+func (p *PeerCon) SendRequests(reqs [][3]int) error {
+	var buf []byte
+	for _, r := range reqs {
+		payload := make([]byte, 12)
+		binary.BigEndian.PutUint32(payload[0:4], uint32(r[0]))
+		binary.BigEndian.PutUint32(payload[4:8], uint32(r[1]))
+		binary.BigEndian.PutUint32(payload[8:12], uint32(r[2]))
+		buf = append(buf, (&Message{ID: REQUEST, Payload: payload}).Serialize()...)
+	}
+	return p.out.push(buf)
+}
+
+// SendPiece queues a block behind any control messages. It can still be
+// cancelled until the writer picks it up.
 func (p *PeerCon) SendPiece(index, begin uint32, data []byte) error {
 	payload := make([]byte, 8+len(data))
 	binary.BigEndian.PutUint32(payload[0:4], index)
 	binary.BigEndian.PutUint32(payload[4:8], begin)
 	copy(payload[8:], data)
-	return p.SendMessage(&Message{ID: PIECE, Payload: payload})
+	return p.out.pushPiece(queuedPiece{
+		index:  int(index),
+		begin:  int(begin),
+		length: len(data),
+		msg:    (&Message{ID: PIECE, Payload: payload}).Serialize(),
+	})
+}
+
+// peerPieces returns a copy of the peer's bitfield.
+func (p *PeerCon) peerPieces() Bitfield {
+	p.bitMu.Lock()
+	defer p.bitMu.Unlock()
+	return append(Bitfield{}, p.peerBitfield...)
 }
-func (p *PeerCon) DownloadLoop(d *Downloader, results chan Piece) {
+
+func (p *PeerCon) DownloadLoop(d *Downloader) {
 	defer p.con.Close()
+	defer p.out.close()
 	defer func() {
-		if !p.choked {
+		if !p.choked.Load() {
 			d.Stats.UnchokedPeers.Add(-1)
 		}
 	}()
-	p.SendExtendedHandshake()
+	go p.writeLoop()
+	stop := make(chan struct{})
+	defer close(stop)
+	go p.keepAlive(stop, KEEPALIVE_INTERVAL)
+	p.superseed = d.superSeeding()
+	p.sendHaves(d)
+	p.SendExtendedHandshake(d)
+	p.sendAllowedFast(d)
 	p.SendUnchoke()
-	// p.SendBitfield()
-	p.SendInterested()
-	pieceBuffers := make(map[uint32][]byte)
-	pieceProgress := make(map[uint32]int)
-	receivedBitfield := false
+	if p.superseed {
+		d.super.add(d, p)
+		defer d.super.remove(d, p)
+	}
+	first := true
 	for {
 		msg, err := p.ReadMessage()
 		if err != nil {
@@ -156,86 +308,105 @@ func (p *PeerCon) DownloadLoop(d *Downloader, results chan Piece) {
 		if msg == nil {
 			continue
 		}
-		if !receivedBitfield && msg.ID != BITFIELD && msg.ID != EXTENDED {
+		if err := p.validateMessage(msg, first); err != nil {
+			if msg.ID == BITFIELD {
+				d.Stats.BitfieldMiss.Add(1)
+			}
 			return
 		}
+		if msg.ID != EXTENDED {
+			first = false
+		}
 		switch msg.ID {
 		case UNCHOKE:
-			if p.choked {
+			if p.choked.Swap(false) {
 				d.Stats.UnchokedPeers.Add(1)
 			}
-			p.choked = false
 		case CHOKE:
-			if !p.choked {
+			if !p.choked.Swap(true) {
 				d.Stats.UnchokedPeers.Add(-1)
 			}
-			p.choked = true
-		// case REQUEST:
-		// 	if len(msg.Payload) < 12 {
-		// 	    continue
-		// 	}
-		// 	index := binary.BigEndian.Uint32(msg.Payload[0:4])
-		// 	begin := binary.BigEndian.Uint32(msg.Payload[4:8])
-		// 	length := binary.BigEndian.Uint32(msg.Payload[8:12])
-		// 	if d.field.HasPiece(int(index)) {
-		// 	    data, err := d.writer.Read(int(index), int(begin), int(length))
-		// 	    if err == nil {
-		// 	        p.SendPiece(index, begin, data)
-		// 	    }
-		// 	}
+		case INTERESTED:
+			if p.SendUnchoke() != nil {
+				return
+			}
+		case NOT_INTERESTED:
+			// A peer that wants nothing has no use for an upload slot.
+			if p.SendChoke() != nil {
+				return
+			}
+		case REQUEST:
+			index := binary.BigEndian.Uint32(msg.Payload[0:4])
+			begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+			length := binary.BigEndian.Uint32(msg.Payload[8:12])
+			if p.handleRequest(d, int(index), int(begin), int(length)) != nil {
+				return
+			}
+		case CANCEL:
+			index := binary.BigEndian.Uint32(msg.Payload[0:4])
+			begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+			length := binary.BigEndian.Uint32(msg.Payload[8:12])
+			p.out.cancel(int(index), int(begin), int(length))
+		case HAVE_ALL, HAVE_NONE, SUGGEST_PIECE, REJECT_REQUEST, ALLOWED_FAST:
+			p.handleFast(d, msg)
+			if msg.ID == HAVE_ALL || msg.ID == HAVE_NONE {
+				if p.superseed {
+					d.super.update(d, p, true)
+				}
+				if p.useless(d) || p.updateInterest(d.wantsFrom(p.peerPieces())) != nil {
+					return
+				}
+			}
 		case HAVE:
-			index := binary.BigEndian.Uint32(msg.Payload)
-			if int(index) < len(p.peerBitfield)*8 {
-				p.peerBitfield.SetPiece(int(index))
+			index := int(binary.BigEndian.Uint32(msg.Payload))
+			p.bitMu.Lock()
+			p.peerBitfield.SetPiece(index)
+			p.bitMu.Unlock()
+			if d.super != nil {
+				d.super.update(d, p, false)
+			}
+			// A piece we do not want changes nothing; one we do makes
+			// us interested.
+			if d.wantsPiece(index) && p.updateInterest(true) != nil {
+				return
 			}
 		case BITFIELD:
-			receivedBitfield = true
-			if len(msg.Payload) == len(p.peerBitfield) {
-				copy(p.peerBitfield, msg.Payload)
-				d.Stats.BitfieldRecv.Add(1)
-				seed := true
-				for _, v := range msg.Payload {
-					if v != 0xff {
-						seed = false
-						break
-					}
-				}
-				if seed {
-					d.Stats.Seeders.Add(1)
+			p.bitMu.Lock()
+			copy(p.peerBitfield, msg.Payload)
+			p.bitMu.Unlock()
+			d.Stats.BitfieldRecv.Add(1)
+			seed := true
+			for i := range p.tf.NumPieces() {
+				if !Bitfield(msg.Payload).HasPiece(i) {
+					seed = false
+					break
 				}
-			} else {
-				d.Stats.BitfieldMiss.Add(1)
+			}
+			if seed {
+				d.Stats.Seeders.Add(1)
+			}
+			if p.superseed {
+				d.super.update(d, p, true)
+			}
+			if p.useless(d) || p.updateInterest(d.wantsFrom(p.peerPieces())) != nil {
+				return
 			}
 		case EXTENDED:
-			if len(msg.Payload) < 2 {
-				continue
+			if p.handleExtended(msg.Payload) != nil {
+				return
 			}
-			extendedMsgID := msg.Payload[0]
-			payloadData := msg.Payload[1:]
-			switch extendedMsgID {
-			case 0:
-				reader := bytes.NewReader(payloadData)
-				ben := &bencodeObject{}
-				if err := Unmarshal(reader, ben); err == nil {
-					if m, err := ben.valAt("m"); err == nil {
-						if utPexObj, err := m.valAt("ut_pex"); err == nil {
-							p.remotePexID = int(utPexObj.val)
-						}
-					}
-				}
-			case UtPexID:
-				reader := bytes.NewReader(payloadData)
-				ben := &bencodeObject{}
-				if err := Unmarshal(reader, ben); err == nil {
-					if added, err := ben.valAt("added"); err == nil {
-						peersBytes := []byte(added.str)
-						for i := 0; i+6 <= len(peersBytes); i += 6 {
-							ip := net.IP(peersBytes[i : i+4])
-							port := binary.BigEndian.Uint16(peersBytes[i+4 : i+6])
-							p.pexCh <- fmt.Sprintf("%s:%d", ip.String(), port)
-						}
-					}
-				}
+			// Until the peer's pieces are known an upload only peer
+			// may still have something for us.
+			if !first && p.useless(d) {
+				return
+			}
+		case HASH_REQUEST:
+			if !p.tf.HasV2 || p.handleHashRequest(msg.Payload) != nil {
+				return
+			}
+		case HASHES:
+			if !p.tf.HasV2 || p.handleHashes(msg.Payload) != nil {
+				return
 			}
 		case PIECE:
 			select {
@@ -244,22 +415,11 @@ func (p *PeerCon) DownloadLoop(d *Downloader, results chan Piece) {
 			}
 			index := binary.BigEndian.Uint32(msg.Payload[0:4])
 			begin := binary.BigEndian.Uint32(msg.Payload[4:8])
-			block := msg.Payload[8:]
-			expectedSize := p.tf.PieceLength
-			if int(index) == len(p.tf.PieceHashes)-1 {
-				expectedSize = p.tf.Length - (int(index) * p.tf.PieceLength)
-			}
-			if _, exists := pieceBuffers[index]; !exists {
-				pieceBuffers[index] = make([]byte, expectedSize)
-			}
-			if int(begin)+len(block) <= expectedSize {
-				copy(pieceBuffers[index][begin:], block)
-				pieceProgress[index] += len(block)
-			}
-			if pieceProgress[index] == expectedSize {
-				results <- Piece{id: int64(index), data: pieceBuffers[index]}
-				delete(pieceBuffers, index)
-				delete(pieceProgress, index)
+			if piece, ok := d.receiveBlock(p, int(index), int(begin), msg.Payload[8:]); ok {
+				select {
+				case d.pieceQueue <- piece:
+				case <-d.downloadOver:
+				}
 			}
 		}
 	}
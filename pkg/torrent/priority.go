@@ -0,0 +1,149 @@
+package torrent
+
+import (
+	"fmt"
+	"strings"
+)
+
+type FilePriority int
+
+const (
+	PRIORITY_SKIP FilePriority = iota
+	PRIORITY_LOW
+	PRIORITY_NORMAL
+	PRIORITY_HIGH
+)
+
+func (fp FilePriority) String() string {
+	switch fp {
+	case PRIORITY_SKIP:
+		return "skip"
+	case PRIORITY_LOW:
+		return "low"
+	case PRIORITY_NORMAL:
+		return "normal"
+	case PRIORITY_HIGH:
+		return "high"
+	}
+	return fmt.Sprintf("priority(%d)", int(fp))
+}
+
+func ParseFilePriority(s string) (FilePriority, error) {
+	switch strings.ToLower(s) {
+	case "skip", "0":
+		return PRIORITY_SKIP, nil
+	case "low", "1":
+		return PRIORITY_LOW, nil
+	case "normal", "2":
+		return PRIORITY_NORMAL, nil
+	case "high", "3":
+		return PRIORITY_HIGH, nil
+	}
+	return PRIORITY_SKIP, fmt.Errorf("unknown priority %q", s)
+}
+
+func (cfg *Config) filePriority(index int) FilePriority {
+	if index < len(cfg.FilePriorities) {
+		return cfg.FilePriorities[index]
+	}
+	return PRIORITY_NORMAL
+}
+
+// piecePriorities gives every piece the highest priority of the files it
+// overlaps. Padding never makes a piece wanted on its own.
+func (tf *TorrentFile) piecePriorities(filePrio func(int) FilePriority) []FilePriority {
+	prio := make([]FilePriority, tf.NumPieces())
+	offset := int64(0)
+	for i, f := range tf.Files {
+		if f.Length == 0 || f.Padding {
+			offset += int64(f.Length)
+			continue
+		}
+		first := int(offset / int64(tf.PieceLength))
+		last := int((offset + int64(f.Length) - 1) / int64(tf.PieceLength))
+		fp := filePrio(i)
+		for p := first; p <= last && p < len(prio); p++ {
+			if fp > prio[p] {
+				prio[p] = fp
+			}
+		}
+		offset += int64(f.Length)
+	}
+	return prio
+}
+
+func (d *Downloader) FilePriority(index int) FilePriority {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.filePrio[index]
+}
+
+func (d *Downloader) SetFilePriority(index int, prio FilePriority) error {
+	if index < 0 || index >= len(d.tf.Files) {
+		return fmt.Errorf("file index %d out of range", index)
+	}
+	if prio < PRIORITY_SKIP || prio > PRIORITY_HIGH {
+		return fmt.Errorf("invalid priority %d", prio)
+	}
+	d.mu.Lock()
+	old := d.filePrio[index]
+	d.filePrio[index] = prio
+	d.piecePrio = d.tf.piecePriorities(func(i int) FilePriority { return d.filePrio[i] })
+	d.mu.Unlock()
+	if (old == PRIORITY_SKIP) != (prio == PRIORITY_SKIP) {
+		if fs, ok := d.storage.(FileSkipper); ok {
+			d.diskMu.RLock()
+			err := fs.SetSkipped(index, prio == PRIORITY_SKIP)
+			d.diskMu.RUnlock()
+			if err != nil {
+				return err
+			}
+			if prio == PRIORITY_SKIP {
+				d.dropInterior(index)
+			}
+		}
+	}
+	d.checkComplete()
+	return nil
+}
+
+// dropInterior forgets the pieces wholly inside a file that was just
+// skipped, since its data is gone from disk.
+func (d *Downloader) dropInterior(index int) {
+	first, last := d.tf.interiorPieces(index)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for p := first; p <= last; p++ {
+		if d.field.HasPiece(p) {
+			d.field.ClearPiece(p)
+			d.piecesDone--
+		}
+	}
+}
+
+func (d *Downloader) wantedPieces() (done int, wanted int) {
+	for i, p := range d.piecePrio {
+		if p == PRIORITY_SKIP {
+			continue
+		}
+		wanted++
+		if d.field.HasPiece(i) {
+			done++
+		}
+	}
+	return done, wanted
+}
+
+// bytesLeft is what we announce as left: the size of the wanted pieces we
+// do not have yet, so 0 once the download is complete.
+func (d *Downloader) bytesLeft() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var left int64
+	for i, p := range d.piecePrio {
+		if p != PRIORITY_SKIP && !d.field.HasPiece(i) {
+			left += int64(d.tf.PieceSize(i))
+		}
+	}
+	return left
+}
@@ -0,0 +1,78 @@
+package torrent
+
+import "fmt"
+
+// Damaged returns a bitfield of the pieces that are bad or missing and have
+// to be fetched again.
+func (r *VerifyReport) Damaged() Bitfield {
+	bf := make(Bitfield, len(r.Pieces)/8+1)
+	for i, ps := range r.Pieces {
+		if ps == PIECE_BAD || ps == PIECE_MISSING {
+			bf.SetPiece(i)
+		}
+	}
+	return bf
+}
+
+type RepairReport struct {
+	Fixed     []int
+	Remaining []int
+}
+
+// StartRepair verifies the torrent and starts a downloader that fetches
+// only the damaged pieces. The downloader is nil when nothing needs fixing.
+func StartRepair(tf *TorrentFile, cfg *Config, opts *VerifyOptions) (*Downloader, *VerifyReport, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	report, err := VerifyTorrent(tf, cfg, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if report.OK() {
+		return nil, report, nil
+	}
+	cfg.Repair = report.Damaged()
+	d, err := NewDownloader(tf, cfg)
+	if err != nil {
+		return nil, report, err
+	}
+	return d, report, nil
+}
+
+// applyRepair marks the pieces the check found good as already
+// downloaded: those outside cfg.Repair that were not skipped. Skipped
+// pieces were never checked and may not exist at all.
+func (d *Downloader) applyRepair() error {
+	if len(d.cfg.Repair) != d.tf.NumPieces()/8+1 {
+		return fmt.Errorf("repair bitfield has %d bytes, want %d", len(d.cfg.Repair), d.tf.NumPieces()/8+1)
+	}
+	for i := range d.tf.NumPieces() {
+		if !d.cfg.Repair.HasPiece(i) && d.piecePrio[i] != PRIORITY_SKIP {
+			d.field.SetPiece(i)
+			d.piecesDone++
+		}
+	}
+	if pr, ok := d.storage.(PieceRestorer); ok {
+		return pr.RestorePieces(d.field)
+	}
+	return nil
+}
+
+// RepairReport lists the damaged pieces fetched again so far and those
+// still missing.
+func (d *Downloader) RepairReport() RepairReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var report RepairReport
+	if d.cfg.Repair == nil {
+		return report
+	}
+	report.Fixed = append(report.Fixed, d.fixed...)
+	for i := range d.tf.NumPieces() {
+		if d.cfg.Repair.HasPiece(i) && !d.field.HasPiece(i) {
+			report.Remaining = append(report.Remaining, i)
+		}
+	}
+	return report
+}
@@ -0,0 +1,79 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// partialTree is a download whose last file was skipped and never
+// written. Every file fills whole pieces, so piece 2 belongs to c alone.
+func partialTree(t *testing.T) (*TorrentFile, *Config) {
+	t.Helper()
+	files := []testFile{
+		{[]string{"a"}, randomBytes(16384)},
+		{[]string{"b"}, randomBytes(16384)},
+		{[]string{"c"}, randomBytes(16384)},
+	}
+	tf, _ := makeTorrent(t, "t", 16384, files)
+	dir := t.TempDir()
+	for _, f := range files[:2] {
+		path := filepath.Join(dir, "t", f.path[0])
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, f.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.DownloadDir = dir
+	cfg.FilePriorities = []FilePriority{PRIORITY_NORMAL, PRIORITY_NORMAL, PRIORITY_SKIP}
+	return tf, cfg
+}
+
+func TestVerifyPartialDownload(t *testing.T) {
+	tf, cfg := partialTree(t)
+	report, err := VerifyTorrent(tf, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || !slices.Equal(report.List(PIECE_SKIPPED), []int{2}) {
+		t.Fatalf("skipped file reported as %v", report.Pieces)
+	}
+	cfg.FilePriorities = nil
+	if report, _ = VerifyTorrent(tf, cfg, nil); report.OK() {
+		t.Fatal("missing file not reported without its skip priority")
+	}
+}
+
+// Repair marks only the pieces the check found good, never skipped ones
+// it did not look at.
+func TestApplyRepairMarksOnlyGoodPieces(t *testing.T) {
+	tf, cfg := partialTree(t)
+	path := filepath.Join(cfg.DownloadDir, "t", "b")
+	data, _ := os.ReadFile(path)
+	data[100] ^= 1
+	os.WriteFile(path, data, 0644)
+	report, err := VerifyTorrent(tf, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.List(PIECE_BAD), []int{1}) {
+		t.Fatalf("bad pieces %v, want [1]", report.List(PIECE_BAD))
+	}
+	dcfg := testConfig(t)
+	dcfg.FilePriorities = cfg.FilePriorities
+	dcfg.Repair = report.Damaged()
+	d := newTestDownloader(t, tf, dcfg)
+	for i, want := range []bool{true, false, false} {
+		if d.field.HasPiece(i) != want {
+			t.Errorf("piece %d marked %v, want %v", i, d.field.HasPiece(i), want)
+		}
+	}
+	if d.piecesDone != 1 {
+		t.Errorf("%d pieces done, want 1", d.piecesDone)
+	}
+	if got := d.RepairReport().Remaining; !slices.Equal(got, []int{1}) {
+		t.Errorf("remaining %v, want [1]", got)
+	}
+}
@@ -0,0 +1,350 @@
+package torrent
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// partialPiece holds the blocks received so far for a piece that has not
+// been completed yet, whichever peer they came from.
+type partialPiece struct {
+	data     []byte
+	blocks   Bitfield
+	sources  []*PeerCon
+	received int
+}
+
+func newPartialPiece(size int) *partialPiece {
+	return &partialPiece{
+		data:    make([]byte, size),
+		blocks:  make(Bitfield, numBlocks(size)/8+1),
+		sources: make([]*PeerCon, numBlocks(size)),
+	}
+}
+
+func numBlocks(pieceSize int) int {
+	return (pieceSize + REQUEST_BLOCK_SIZE - 1) / REQUEST_BLOCK_SIZE
+}
+
+type trackerState struct {
+	LastAnnounce time.Time
+	Peers        int
+	Failures     int
+}
+
+type resumeData struct {
+	infoHash [20]byte
+	bitfield Bitfield
+	files    []FileState
+	partial  map[int]*partialPiece
+	peers    []string
+	trackers map[string]*trackerState
+}
+
+func (rd *resumeData) marshal() (string, error) {
+	files := make([]bencodeObject, len(rd.files))
+	for i, st := range rd.files {
+		files[i] = bencodeDict(
+			pair{"mtime", bencodeInt(st.ModTime)},
+			pair{"size", bencodeInt(st.Size)},
+		)
+	}
+	indices := make([]int, 0, len(rd.partial))
+	for index := range rd.partial {
+		indices = append(indices, index)
+	}
+	slices.Sort(indices)
+	partial := make([]bencodeObject, len(indices))
+	for i, index := range indices {
+		pp := rd.partial[index]
+		partial[i] = bencodeDict(
+			pair{"blocks", bencodeString(string(pp.blocks))},
+			pair{"data", bencodeString(string(pp.data))},
+			pair{"piece", bencodeInt(int64(index))},
+		)
+	}
+	peers := make([]bencodeObject, len(rd.peers))
+	for i, addr := range rd.peers {
+		peers[i] = bencodeString(addr)
+	}
+	urls := make([]string, 0, len(rd.trackers))
+	for url := range rd.trackers {
+		urls = append(urls, url)
+	}
+	slices.Sort(urls)
+	trackers := make([]bencodeObject, len(urls))
+	for i, url := range urls {
+		ts := rd.trackers[url]
+		last := int64(0)
+		if !ts.LastAnnounce.IsZero() {
+			last = ts.LastAnnounce.Unix()
+		}
+		trackers[i] = bencodeDict(
+			pair{"failures", bencodeInt(int64(ts.Failures))},
+			pair{"last announce", bencodeInt(last)},
+			pair{"peers", bencodeInt(int64(ts.Peers))},
+			pair{"url", bencodeString(url)},
+		)
+	}
+	root := bencodeDict(
+		pair{"bitfield", bencodeString(string(rd.bitfield))},
+		pair{"files", bencodeList(files...)},
+		pair{"info hash", bencodeString(string(rd.infoHash[:]))},
+		pair{"partial", bencodeList(partial...)},
+		pair{"peers", bencodeList(peers...)},
+		pair{"trackers", bencodeList(trackers...)},
+	)
+	return root.Marshal()
+}
+
+func loadResume(path string, tf *TorrentFile) (*resumeData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ben := &bencodeObject{}
+	if err := Unmarshal(bufio.NewReader(f), ben); err != nil {
+		return nil, fmt.Errorf("couldnt parse resume data: %v", err)
+	}
+	rd := &resumeData{
+		partial:  make(map[int]*partialPiece),
+		trackers: make(map[string]*trackerState),
+	}
+	ih, err := ben.valAt("info hash")
+	if err != nil || ih.str != string(tf.InfoHash[:]) {
+		return nil, fmt.Errorf("resume data belongs to another torrent")
+	}
+	rd.infoHash = tf.InfoHash
+	bf, err := ben.valAt("bitfield")
+	if err != nil || len(bf.str) != tf.NumPieces()/8+1 {
+		return nil, fmt.Errorf("resume data has an invalid bitfield")
+	}
+	rd.bitfield = Bitfield(bf.str)
+	files, err := ben.valAt("files")
+	if err != nil {
+		return nil, fmt.Errorf("resume data has no file list")
+	}
+	for _, obj := range files.list {
+		size, err1 := obj.valAt("size")
+		mtime, err2 := obj.valAt("mtime")
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("resume data has an invalid file entry")
+		}
+		rd.files = append(rd.files, FileState{Size: size.val, ModTime: mtime.val})
+	}
+	if partial, err := ben.valAt("partial"); err == nil {
+		for _, obj := range partial.list {
+			index, err1 := obj.valAt("piece")
+			blocks, err2 := obj.valAt("blocks")
+			data, err3 := obj.valAt("data")
+			if err1 != nil || err2 != nil || err3 != nil || index.val < 0 || index.val >= int64(tf.NumPieces()) {
+				continue
+			}
+			size := tf.PieceSize(int(index.val))
+			pp := newPartialPiece(size)
+			if len(data.str) != size || len(blocks.str) != len(pp.blocks) {
+				continue
+			}
+			copy(pp.data, data.str)
+			copy(pp.blocks, blocks.str)
+			for b := range numBlocks(size) {
+				if pp.blocks.HasPiece(b) {
+					pp.received += min(REQUEST_BLOCK_SIZE, size-b*REQUEST_BLOCK_SIZE)
+				}
+			}
+			rd.partial[int(index.val)] = pp
+		}
+	}
+	if peers, err := ben.valAt("peers"); err == nil {
+		for _, obj := range peers.list {
+			rd.peers = append(rd.peers, obj.str)
+		}
+	}
+	if trackers, err := ben.valAt("trackers"); err == nil {
+		for _, obj := range trackers.list {
+			url, err := obj.valAt("url")
+			if err != nil {
+				continue
+			}
+			ts := &trackerState{}
+			if v, err := obj.valAt("last announce"); err == nil && v.val > 0 {
+				ts.LastAnnounce = time.Unix(v.val, 0)
+			}
+			if v, err := obj.valAt("peers"); err == nil {
+				ts.Peers = int(v.val)
+			}
+			if v, err := obj.valAt("failures"); err == nil {
+				ts.Failures = int(v.val)
+			}
+			rd.trackers[url.str] = ts
+		}
+	}
+	return rd, nil
+}
+
+func (d *Downloader) resumePath() (string, error) {
+	dir := d.cfg.ResumeDir
+	if dir == "" {
+		dir = d.cfg.DownloadDir
+	}
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create resume directory %s: %v", dir, err)
+	}
+	return confinePath(dir, "."+hex.EncodeToString(d.tf.InfoHash[:])+".resume")
+}
+
+// saveResume writes the resume file through a temporary file so a crash
+// mid-write leaves the previous one intact.
+func (d *Downloader) saveResume() error {
+	fs, ok := d.storage.(FileStater)
+	if !ok {
+		return nil
+	}
+	path, err := d.resumePath()
+	if err != nil {
+		return err
+	}
+	d.diskMu.Lock()
+	states, err := fs.FileStates()
+	d.mu.Lock()
+	rd := &resumeData{
+		infoHash: d.tf.InfoHash,
+		bitfield: append(Bitfield{}, d.field...),
+		files:    states,
+		partial:  make(map[int]*partialPiece, len(d.partial)),
+	}
+	for index, pp := range d.partial {
+		rd.partial[index] = &partialPiece{
+			data:     append([]byte{}, pp.data...),
+			blocks:   append(Bitfield{}, pp.blocks...),
+			sources:  make([]*PeerCon, len(pp.sources)),
+			received: pp.received,
+		}
+	}
+	d.mu.Unlock()
+	d.diskMu.Unlock()
+	if err != nil {
+		return err
+	}
+	d.seenMu.Lock()
+	for addr := range d.seenPeers {
+		if len(rd.peers) >= MAX_RESUME_PEERS {
+			break
+		}
+		rd.peers = append(rd.peers, addr)
+	}
+	slices.Sort(rd.peers)
+	rd.trackers = make(map[string]*trackerState, len(d.trackers))
+	for url, ts := range d.trackers {
+		copied := *ts
+		rd.trackers[url] = &copied
+	}
+	d.seenMu.Unlock()
+	data, err := rd.marshal()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write resume data: %v", err)
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write resume data: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write resume data: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write resume data: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d *Downloader) saveResumeLoop() {
+	ticker := time.NewTicker(d.cfg.ResumeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.downloadOver:
+			return
+		case <-ticker.C:
+			if err := d.saveResume(); err != nil {
+				fmt.Println("\nfailed to save resume data:", err)
+			}
+		}
+	}
+}
+
+// restoreResume fills a fresh downloader from its resume file and returns
+// the peers it remembered. When the files on disk no longer match what was
+// recorded, or the resume file is unreadable, every piece is hashed again
+// instead. Without a resume file the download starts from scratch, unless
+// we are seeding, when the data already on disk is hashed.
+func (d *Downloader) restoreResume() []string {
+	fs, ok := d.storage.(FileStater)
+	if !ok {
+		return nil
+	}
+	path, err := d.resumePath()
+	if err != nil {
+		return nil
+	}
+	rd, err := loadResume(path, d.tf)
+	states, statErr := fs.FileStates()
+	switch {
+	case os.IsNotExist(err) && !d.cfg.Seed:
+		return nil
+	case os.IsNotExist(err):
+		fmt.Println("No resume data, checking existing data...")
+		d.recheck()
+	case err != nil || statErr != nil || !slices.Equal(states, rd.files):
+		fmt.Println("Resume data is out of date, checking existing data...")
+		d.recheck()
+	default:
+		copy(d.field, rd.bitfield)
+		for i := range d.tf.NumPieces() {
+			if d.field.HasPiece(i) {
+				d.piecesDone++
+			}
+		}
+		for index, pp := range rd.partial {
+			if !d.field.HasPiece(index) {
+				d.partial[index] = pp
+			}
+		}
+	}
+	if pr, ok := d.storage.(PieceRestorer); ok {
+		if err := pr.RestorePieces(d.field); err != nil {
+			fmt.Println("failed to restore completed pieces:", err)
+		}
+	}
+	if rd == nil {
+		return nil
+	}
+	d.trackers = rd.trackers
+	return rd.peers
+}
+
+// recheck hashes every wanted piece already in storage and marks the good
+// ones.
+func (d *Downloader) recheck() {
+	report := verifyStorage(d.tf, d.storage, d.piecePrio, d.cfg.DiskWorkers, 0, nil)
+	for _, i := range report.List(PIECE_GOOD) {
+		d.field.SetPiece(i)
+		d.piecesDone++
+	}
+}
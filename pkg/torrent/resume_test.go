@@ -0,0 +1,53 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// seedDownloader is a downloader over files already written to dir, as
+// when seeding data that was downloaded elsewhere.
+func seedDownloader(t *testing.T, seed bool) *Downloader {
+	t.Helper()
+	files := []testFile{
+		{[]string{"a"}, randomBytes(10000)},
+		{[]string{"b"}, randomBytes(30000)},
+	}
+	tf, _ := makeTorrent(t, "t", 16384, files)
+	dir := t.TempDir()
+	for _, f := range files {
+		path := filepath.Join(dir, "t", f.path[0])
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, f.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := testConfig(t)
+	cfg.Storage = FileStorage{}
+	cfg.DownloadDir = dir
+	cfg.Seed = seed
+	return newTestDownloader(t, tf, cfg)
+}
+
+func TestSeedWithoutResumeRechecks(t *testing.T) {
+	d := seedDownloader(t, true)
+	if done, wanted := d.Progress(); done != wanted {
+		t.Fatalf("%d of %d pieces found on disk", done, wanted)
+	}
+	if left := d.bytesLeft(); left != 0 {
+		t.Fatalf("announcing %d bytes left for complete data", left)
+	}
+}
+
+func TestDownloadWithoutResumeStartsFresh(t *testing.T) {
+	d := seedDownloader(t, false)
+	if done, _ := d.Progress(); done != 0 {
+		t.Fatalf("%d pieces marked without a resume file", done)
+	}
+	if left := d.bytesLeft(); left != int64(d.tf.Length) {
+		t.Fatalf("announcing %d bytes left, want %d", left, d.tf.Length)
+	}
+}
@@ -0,0 +1,137 @@
+package torrent
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// queuedPiece is a block we are uploading, kept apart from control
+// messages so it can be cancelled until it is written.
+type queuedPiece struct {
+	index, begin, length int
+	msg                  []byte
+}
+
+// sendQueue holds a peer's outgoing messages for its writer goroutine.
+// Control messages always go out before queued blocks, so a CHOKE or
+// REQUEST never waits behind uploads.
+type sendQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	control [][]byte
+	pieces  []queuedPiece
+	closed  bool
+}
+
+func newSendQueue() *sendQueue {
+	q := &sendQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *sendQueue) push(msg []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return net.ErrClosed
+	}
+	q.control = append(q.control, msg)
+	q.cond.Signal()
+	return nil
+}
+
+func (q *sendQueue) pushPiece(qp queuedPiece) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return net.ErrClosed
+	}
+	q.pieces = append(q.pieces, qp)
+	q.cond.Signal()
+	return nil
+}
+
+// cancel drops a queued block, reporting whether it was still queued.
+func (q *sendQueue) cancel(index, begin, length int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, qp := range q.pieces {
+		if qp.index == index && qp.begin == begin && qp.length == length {
+			q.pieces = append(q.pieces[:i], q.pieces[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// purge drops every queued block drop selects and returns them.
+func (q *sendQueue) purge(drop func(queuedPiece) bool) []queuedPiece {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var dropped []queuedPiece
+	kept := q.pieces[:0]
+	for _, qp := range q.pieces {
+		if drop(qp) {
+			dropped = append(dropped, qp)
+		} else {
+			kept = append(kept, qp)
+		}
+	}
+	q.pieces = kept
+	return dropped
+}
+
+func (q *sendQueue) queuedPieces() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pieces)
+}
+
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// next blocks until there is something to send and returns it as one
+// buffer: every pending control message followed by at most one block.
+func (q *sendQueue) next() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed && len(q.control) == 0 && len(q.pieces) == 0 {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+	var buf []byte
+	for _, msg := range q.control {
+		buf = append(buf, msg...)
+	}
+	q.control = q.control[:0]
+	if len(q.pieces) > 0 {
+		buf = append(buf, q.pieces[0].msg...)
+		q.pieces = q.pieces[1:]
+	}
+	return buf, true
+}
+
+// writeLoop is the only goroutine that writes to the peer once the
+// handshake is done. A failed write closes the connection so the reader
+// notices too.
+func (p *PeerCon) writeLoop() {
+	for {
+		buf, ok := p.out.next()
+		if !ok {
+			return
+		}
+		p.lastSend.Store(time.Now().UnixNano())
+		if err := p.con.Send(buf); err != nil {
+			p.out.close()
+			p.con.Close()
+			return
+		}
+	}
+}
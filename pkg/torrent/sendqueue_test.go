@@ -0,0 +1,112 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockData is what the test uploads for a block, so the receiver can
+// tell a block that was damaged or interleaved with another message.
+func blockData(index, begin int) []byte {
+	return bytes.Repeat([]byte{byte(index), byte(begin >> 8)}, 64)
+}
+
+// TestSendQueueConcurrent pushes control messages and blocks, cancels
+// blocks and chokes from several goroutines while writeLoop drains the
+// queue. Run with -race. Every block must arrive intact, be cancelled, or
+// be rejected by the choke.
+func TestSendQueueConcurrent(t *testing.T) {
+	const blocks = 400
+	tf, _ := makeTorrent(t, "t", REQUEST_BLOCK_SIZE, []testFile{{nil, randomBytes(REQUEST_BLOCK_SIZE)}})
+	d := testDownloader(t, tf)
+	p, remote := pipePeer(t, d)
+	p.peerFast = true
+	go p.writeLoop()
+	defer p.out.close()
+
+	var cancelled atomic.Int32
+	var wg sync.WaitGroup
+	wg.Add(5)
+	go func() {
+		defer wg.Done()
+		for i := range blocks {
+			p.SendPiece(uint32(i), uint32(i%4*256), blockData(i, i%4*256))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := range blocks / 2 {
+			p.SendHave(i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		rng := rand.New(rand.NewPCG(1, 2))
+		for range blocks {
+			i := rng.IntN(blocks)
+			if p.out.cancel(i, i%4*256, 128) {
+				cancelled.Add(1)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			p.SendChoke()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			p.SendUnchoke()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	delivered, rejected := 0, 0
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			msg := readWire(t, remote)
+			if msg == nil {
+				continue
+			}
+			switch msg.ID {
+			case PIECE:
+				index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+				begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+				if !bytes.Equal(msg.Payload[8:], blockData(index, begin)) {
+					t.Errorf("block %d damaged", index)
+					return
+				}
+				delivered++
+			case REJECT_REQUEST:
+				rejected++
+			case HAVE, CHOKE, UNCHOKE:
+			case EXTENDED:
+				return
+			default:
+				t.Errorf("unexpected message %d", msg.ID)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	for p.out.queuedPieces() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Control messages overtake blocks, so the marker is only sent once
+	// every block has been handed to the writer.
+	p.SendMessage(&Message{ID: EXTENDED, Payload: []byte{99}})
+	<-readDone
+	if got := delivered + rejected + int(cancelled.Load()); got != blocks {
+		t.Fatalf("%d delivered, %d rejected, %d cancelled: %d blocks, want %d", delivered, rejected, cancelled.Load(), got, blocks)
+	}
+}
@@ -0,0 +1,135 @@
+package torrent
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Server struct {
+	mu       sync.Mutex
+	torrents map[string]*Downloader
+}
+
+func NewServer() *Server {
+	return &Server{
+		torrents: make(map[string]*Downloader),
+	}
+}
+
+func (s *Server) Add(d *Downloader) string {
+	key := hex.EncodeToString(d.tf.InfoHash[:])
+	s.mu.Lock()
+	s.torrents[key] = d
+	s.mu.Unlock()
+	return key
+}
+
+func (s *Server) Remove(d *Downloader) {
+	s.mu.Lock()
+	delete(s.torrents, hex.EncodeToString(d.tf.InfoHash[:]))
+	s.mu.Unlock()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, filePath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if key == "" {
+		s.listTorrents(w)
+		return
+	}
+	s.mu.Lock()
+	d, ok := s.torrents[strings.ToLower(key)]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if filePath == "" {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		s.listFiles(w, key, d)
+		return
+	}
+	index := -1
+	for i, f := range d.tf.Files {
+		if !f.Padding && f.SymlinkPath == "" && filepath.ToSlash(f.Path) == filePath {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveFile(w, r, d, index)
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, d *Downloader, index int) {
+	// HEAD only needs the size, so it must not start fetching a skipped
+	// file.
+	reader, err := d.newReader(index, r.Method != http.MethodHead)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	// A client that goes away must not leave a Read waiting for pieces.
+	stop := context.AfterFunc(r.Context(), func() { reader.Close() })
+	defer stop()
+	name := path.Base(filepath.ToSlash(d.tf.Files[index].Path))
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	http.ServeContent(w, r, name, time.Time{}, reader)
+}
+
+func (s *Server) listTorrents(w http.ResponseWriter) {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.torrents))
+	for k := range s.torrents {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<!DOCTYPE html>\n<title>gotorrent</title>\n<ul>")
+	for _, k := range keys {
+		d := s.torrents[k]
+		done, wanted := d.Progress()
+		fmt.Fprintf(w, "<li><a href=\"/%s/\">%s</a> (%d/%d pieces)</li>\n", k, html.EscapeString(d.tf.Name), done, wanted)
+	}
+	s.mu.Unlock()
+	fmt.Fprintln(w, "</ul>")
+}
+
+func (s *Server) listFiles(w http.ResponseWriter, key string, d *Downloader) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s</title>\n<ul>\n", html.EscapeString(d.tf.Name))
+	for _, f := range d.tf.Files {
+		if f.Padding || f.SymlinkPath != "" {
+			continue
+		}
+		p := filepath.ToSlash(f.Path)
+		u := &url.URL{Path: "/" + key + "/" + p}
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> (%d bytes)</li>\n", u.EscapedPath(), html.EscapeString(p), f.Length)
+	}
+	fmt.Fprintln(w, "</ul>")
+}
@@ -0,0 +1,195 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func serveTorrent(t *testing.T) (*Downloader, []byte, string) {
+	t.Helper()
+	files := []testFile{
+		{[]string{"a.txt"}, randomBytes(20000)},
+		{[]string{"b.bin"}, randomBytes(30000)},
+	}
+	tf, all := makeTorrent(t, "t", 16384, files)
+	d := testDownloader(t, tf)
+	s := NewServer()
+	s.Add(d)
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return d, all, srv.URL + "/" + hex.EncodeToString(tf.InfoHash[:])
+}
+
+func TestServeRange(t *testing.T) {
+	d, all, base := serveTorrent(t)
+	storeAll(d, all)
+	tests := []struct {
+		path, rng, ctype, crange string
+		status                   int
+		want                     []byte
+	}{
+		{"/t/a.txt", "", "text/plain; charset=utf-8", "", http.StatusOK, all[:20000]},
+		{"/t/b.bin", "", "application/octet-stream", "", http.StatusOK, all[20000:]},
+		{"/t/b.bin", "bytes=100-199", "application/octet-stream", "bytes 100-199/30000", http.StatusPartialContent, all[20100:20200]},
+		{"/t/b.bin", "bytes=-10", "application/octet-stream", "bytes 29990-29999/30000", http.StatusPartialContent, all[49990:]},
+		{"/t/b.bin", "bytes=40000-", "", "bytes */30000", http.StatusRequestedRangeNotSatisfiable, nil},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, base+tt.path, nil)
+		if tt.rng != "" {
+			req.Header.Set("Range", tt.rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.path, tt.rng, resp.StatusCode, tt.status)
+			continue
+		}
+		if got := resp.Header.Get("Content-Range"); got != tt.crange {
+			t.Errorf("%s %s: Content-Range %q, want %q", tt.path, tt.rng, got, tt.crange)
+		}
+		if tt.want == nil {
+			continue
+		}
+		if got := resp.Header.Get("Content-Type"); got != tt.ctype {
+			t.Errorf("%s: Content-Type %q, want %q", tt.path, got, tt.ctype)
+		}
+		if resp.ContentLength != int64(len(tt.want)) || !bytes.Equal(body, tt.want) {
+			t.Errorf("%s %s: got %d bytes (Content-Length %d), want %d", tt.path, tt.rng, len(body), resp.ContentLength, len(tt.want))
+		}
+	}
+}
+
+func TestServeWaitsForPiece(t *testing.T) {
+	d, all, base := serveTorrent(t)
+	// b.bin starts in piece 1 and ends in piece 3.
+	storeAll(d, all, 2)
+	req, _ := http.NewRequest(http.MethodGet, base+"/t/b.bin", nil)
+	req.Header.Set("Range", "bytes=15000-15099")
+	done := make(chan []byte)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- nil
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		done <- body
+	}()
+	select {
+	case <-done:
+		t.Fatal("read returned before its piece arrived")
+	case <-time.After(200 * time.Millisecond):
+	}
+	storeAll(d, all)
+	select {
+	case body := <-done:
+		if !bytes.Equal(body, all[35000:35100]) {
+			t.Fatal("wrong bytes after the piece arrived")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked after its piece arrived")
+	}
+}
+
+func TestServeUnknownFile(t *testing.T) {
+	_, _, base := serveTorrent(t)
+	resp, err := http.Get(base + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status %d, want 404", resp.StatusCode)
+	}
+}
+
+// A client that disconnects while its read waits for a piece closes the
+// reader, so the piece stops being urgent.
+func TestServeClientGone(t *testing.T) {
+	d, all, base := serveTorrent(t)
+	storeAll(d, all, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, base+"/t/b.bin", nil)
+	req.Header.Set("Range", "bytes=15000-15099")
+	go func() {
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	d.mu.Lock()
+	urgent := d.urgentPieces()
+	d.mu.Unlock()
+	if len(urgent) == 0 {
+		t.Fatal("blocked read left no urgent piece")
+	}
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		readers := len(d.readers)
+		d.mu.Unlock()
+		if readers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("reader still open after the client went away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// HEAD never un-skips a file, and a GET un-skips it only while it reads.
+func TestServeSkippedFile(t *testing.T) {
+	d, all, base := serveTorrent(t)
+	storeAll(d, all)
+	if err := d.SetFilePriority(1, PRIORITY_SKIP); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Head(base + "/t/b.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 30000 {
+		t.Fatalf("HEAD: status %d, Content-Length %d", resp.StatusCode, resp.ContentLength)
+	}
+	if d.FilePriority(1) != PRIORITY_SKIP {
+		t.Fatal("HEAD un-skipped the file")
+	}
+	r, err := d.NewReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.FilePriority(1) == PRIORITY_SKIP {
+		t.Fatal("reader did not un-skip the file")
+	}
+	resp, err = http.Get(base + "/t/b.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, all[20000:]) {
+		t.Fatal("wrong bytes from a skipped file")
+	}
+	if d.FilePriority(1) == PRIORITY_SKIP {
+		t.Fatal("file skipped again while another reader is open")
+	}
+	r.Close()
+	if d.FilePriority(1) != PRIORITY_SKIP {
+		t.Fatal("file not skipped again once its readers closed")
+	}
+}
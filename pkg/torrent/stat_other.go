@@ -0,0 +1,25 @@
+//go:build !unix
+
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+)
+
+func allocatedSize(fi os.FileInfo) int64 {
+	return fi.Size()
+}
+
+// sameDevice compares volumes, the closest we get to a device number here.
+func sameDevice(a, b string) bool {
+	if _, err := os.Stat(a); err != nil {
+		return false
+	}
+	if _, err := os.Stat(b); err != nil {
+		return false
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && filepath.VolumeName(absA) == filepath.VolumeName(absB)
+}
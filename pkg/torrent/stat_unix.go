@@ -0,0 +1,28 @@
+//go:build unix
+
+package torrent
+
+import (
+	"os"
+	"syscall"
+)
+
+func allocatedSize(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return fi.Size()
+}
+
+// sameDevice reports whether a and b are on the same filesystem, so a file
+// can be renamed from one to the other.
+func sameDevice(a, b string) bool {
+	sa, errA := os.Stat(a)
+	sb, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	da, okA := sa.Sys().(*syscall.Stat_t)
+	db, okB := sb.Sys().(*syscall.Stat_t)
+	return okA && okB && da.Dev == db.Dev
+}
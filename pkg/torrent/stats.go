@@ -7,7 +7,7 @@ import (
 )
 
 type Stats struct {
-	TotalSize 			 int64
+	TotalSize            int64
 	PexProcessed         atomic.Int32
 	PexAdded             atomic.Int32
 	PeersProcessed       atomic.Int32
@@ -15,7 +15,7 @@ type Stats struct {
 	PeersDenied          atomic.Int32
 	StartTime            time.Time
 	GlobalBitfield       Bitfield
-	TotalWritten         int64
+	TotalWritten         atomic.Int64
 	CurrentlyDownloading atomic.Int32
 	Failed               atomic.Int32
 	NumPeers             atomic.Int32
@@ -27,14 +27,19 @@ type Stats struct {
 	BitfieldMiss         atomic.Int32
 	ValidTrackers        atomic.Int32
 	PeersProvided        atomic.Int32
+	PeersBanned          atomic.Int32
+	BlockedOutbound      atomic.Int32
+	BlockedInbound       atomic.Int32
+	InboundPeers         atomic.Int32
 }
 
 func (d *Downloader) printStats() {
 	elapsed := time.Since(d.Stats.StartTime).Seconds()
 	var avgSpeed float64
 	if elapsed > 0 {
-		avgSpeed = float64(d.Stats.TotalWritten) / elapsed
+		avgSpeed = float64(d.Stats.TotalWritten.Load()) / elapsed
 	}
+	done, wanted := d.Progress()
 
 	fmt.Print("\033[H\033[2J")
 
@@ -64,10 +69,12 @@ BITFIELD & ERRORS
 ---------------------------------------------------------
 Bitfield Recv: %-8d | Bitfield Miss: %-8d
 Failed:        %-8d | Not Found:     %-8d
+Banned:        %-8d | Inbound:       %-8d
+Blocked Out:   %-8d | Blocked In:    %-8d
 =========================================================
 `,
-		d.piecesDone, len(d.tf.PieceHashes),
-		formatBytes(float64(d.Stats.TotalWritten)),
+		done, wanted,
+		formatBytes(float64(d.Stats.TotalWritten.Load())),
 		formatBytes(avgSpeed),
 		time.Since(d.Stats.StartTime).Round(time.Second),
 
@@ -81,6 +88,8 @@ Failed:        %-8d | Not Found:     %-8d
 
 		d.Stats.BitfieldRecv.Load(), d.Stats.BitfieldMiss.Load(),
 		d.Stats.Failed.Load(), d.Stats.NotFound.Load(),
+		d.Stats.PeersBanned.Load(), d.Stats.InboundPeers.Load(),
+		d.Stats.BlockedOutbound.Load(), d.Stats.BlockedInbound.Load(),
 	)
 }
 func formatBytes(b float64) string {
@@ -0,0 +1,242 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type Storage interface {
+	OpenTorrent(tf *TorrentFile, cfg *Config) (TorrentStorage, error)
+}
+
+// TorrentStorage addresses data by piece index and offset within the piece.
+// Padding and file boundaries are the implementation's concern.
+type TorrentStorage interface {
+	ReadAt(index int, p []byte, begin int64) (int, error)
+	WriteAt(index int, p []byte, begin int64) (int, error)
+	MarkComplete(index int) error
+	Close() error
+}
+
+// FileSkipper is implemented by storages that can avoid allocating space for
+// files the user does not want.
+type FileSkipper interface {
+	SetSkipped(file int, skip bool) error
+}
+
+// Finalizer is implemented by storages with work to do once every wanted
+// piece has been verified.
+type Finalizer interface {
+	Finalize() error
+}
+
+// FileState is what resume data remembers about a backing file to tell
+// whether it changed while we were not running. A missing file has the zero
+// state.
+type FileState struct {
+	Size    int64
+	ModTime int64
+}
+
+// FileStater is implemented by storages that keep data on disk between runs.
+// Only they get resume data. FileStates flushes pending writes first so the
+// states match what is on disk.
+type FileStater interface {
+	FileStates() ([]FileState, error)
+}
+
+// PieceRestorer is implemented by storages that track completed pieces
+// themselves and must hear about pieces restored from resume data, which
+// never pass through MarkComplete.
+type PieceRestorer interface {
+	RestorePieces(have Bitfield) error
+}
+
+func statFile(path string) (FileState, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return FileState{}, nil
+	}
+	if err != nil {
+		return FileState{}, err
+	}
+	return FileState{Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}, nil
+}
+
+type FileStorage struct{}
+
+func (FileStorage) OpenTorrent(tf *TorrentFile, cfg *Config) (TorrentStorage, error) {
+	return NewTorrentWriter(tf, cfg)
+}
+
+type MemoryStorage struct{}
+
+func (MemoryStorage) OpenTorrent(tf *TorrentFile, cfg *Config) (TorrentStorage, error) {
+	return &memoryTorrent{
+		tf:     tf,
+		pieces: make(map[int][]byte),
+	}, nil
+}
+
+type memoryTorrent struct {
+	tf     *TorrentFile
+	mu     sync.Mutex
+	pieces map[int][]byte
+}
+
+func (m *memoryTorrent) piece(index int) ([]byte, error) {
+	if index < 0 || index >= m.tf.NumPieces() {
+		return nil, fmt.Errorf("piece %d out of range", index)
+	}
+	buf, ok := m.pieces[index]
+	if !ok {
+		buf = make([]byte, m.tf.PieceSize(index))
+		m.pieces[index] = buf
+	}
+	return buf, nil
+}
+
+func (m *memoryTorrent) ReadAt(index int, p []byte, begin int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	buf, err := m.piece(index)
+	if err != nil {
+		return 0, err
+	}
+	if begin < 0 || begin+int64(len(p)) > int64(len(buf)) {
+		return 0, fmt.Errorf("read past end of piece %d", index)
+	}
+	return copy(p, buf[begin:]), nil
+}
+
+func (m *memoryTorrent) WriteAt(index int, p []byte, begin int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	buf, err := m.piece(index)
+	if err != nil {
+		return 0, err
+	}
+	if begin < 0 || begin+int64(len(p)) > int64(len(buf)) {
+		return 0, fmt.Errorf("write past end of piece %d", index)
+	}
+	return copy(buf[begin:], p), nil
+}
+
+func (m *memoryTorrent) MarkComplete(index int) error {
+	return nil
+}
+
+func (m *memoryTorrent) Close() error {
+	return nil
+}
+
+// BlobStorage keeps the whole torrent, padding included, in one file. With
+// an empty Path the blob is named after the info hash inside DownloadDir.
+type BlobStorage struct {
+	Path string
+}
+
+func (b BlobStorage) OpenTorrent(tf *TorrentFile, cfg *Config) (TorrentStorage, error) {
+	path := b.Path
+	if path == "" {
+		root := cfg.DownloadDir
+		if root == "" {
+			root = "."
+		}
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create download directory %s: %v", root, err)
+		}
+		p, err := confinePath(root, blobName(tf))
+		if err != nil {
+			return nil, err
+		}
+		path = p
+	}
+	need := int64(tf.Length)
+	if fi, err := os.Stat(path); err == nil {
+		need -= min(allocatedSize(fi), need)
+	}
+	if err := checkFreeSpace(filepath.Dir(path), need); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob %s: %v", path, err)
+	}
+	if err := allocateFile(f, int64(tf.Length), cfg.Allocation); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to allocate space for %s: %v", path, err)
+	}
+	return &blobTorrent{tf: tf, f: f}, nil
+}
+
+// blobName names the blob of a BlobStorage without a Path.
+func blobName(tf *TorrentFile) string {
+	return hex.EncodeToString(tf.InfoHash[:]) + ".blob"
+}
+
+type blobTorrent struct {
+	tf *TorrentFile
+	f  *os.File
+}
+
+func (b *blobTorrent) offset(index int, begin int64, n int) (int64, error) {
+	if index < 0 || index >= b.tf.NumPieces() || begin < 0 || begin+int64(n) > int64(b.tf.PieceSize(index)) {
+		return 0, fmt.Errorf("range outside piece %d", index)
+	}
+	return int64(index)*int64(b.tf.PieceLength) + begin, nil
+}
+
+func (b *blobTorrent) ReadAt(index int, p []byte, begin int64) (int, error) {
+	off, err := b.offset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return b.f.ReadAt(p, off)
+}
+
+func (b *blobTorrent) WriteAt(index int, p []byte, begin int64) (int, error) {
+	off, err := b.offset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return b.f.WriteAt(p, off)
+}
+
+func (b *blobTorrent) MarkComplete(index int) error {
+	return nil
+}
+
+func (b *blobTorrent) FileStates() ([]FileState, error) {
+	if err := b.f.Sync(); err != nil {
+		return nil, err
+	}
+	fi, err := b.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return []FileState{{Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}}, nil
+}
+
+func (b *blobTorrent) Close() error {
+	if err := b.f.Sync(); err != nil {
+		b.f.Close()
+		return err
+	}
+	return b.f.Close()
+}
+
+func readPiece(s TorrentStorage, index int, begin int, length int) ([]byte, error) {
+	buf := make([]byte, length)
+	n, err := s.ReadAt(index, buf, int64(begin))
+	if n == length {
+		return buf, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("could only read %d bytes out of %d", n, length)
+	}
+	return nil, err
+}
@@ -0,0 +1,99 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// storageTorrent has three files whose boundaries fall inside pieces 0
+// and 2, and a short last piece.
+func storageTorrent(t *testing.T) (*TorrentFile, []byte) {
+	t.Helper()
+	return makeTorrent(t, "t", 16384, []testFile{
+		{[]string{"a"}, randomBytes(10000)},
+		{[]string{"b"}, randomBytes(30000)},
+		{[]string{"c"}, randomBytes(5000)},
+	})
+}
+
+func TestStorageRoundTrip(t *testing.T) {
+	storages := map[string]Storage{
+		"memory": MemoryStorage{},
+		"blob":   BlobStorage{},
+		"file":   FileStorage{},
+	}
+	for name, st := range storages {
+		t.Run(name, func(t *testing.T) {
+			tf, all := storageTorrent(t)
+			cfg := DefaultConfig()
+			cfg.DownloadDir = t.TempDir()
+			s, err := st.OpenTorrent(tf, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			// Blocks of 5000 bytes cross every file boundary somewhere.
+			for i := range tf.NumPieces() {
+				piece := all[i*tf.PieceLength : i*tf.PieceLength+tf.PieceSize(i)]
+				for off := 0; off < len(piece); off += 5000 {
+					end := min(off+5000, len(piece))
+					if n, err := s.WriteAt(i, piece[off:end], int64(off)); err != nil || n != end-off {
+						t.Fatalf("write piece %d at %d: %d, %v", i, off, n, err)
+					}
+				}
+			}
+			for i := range tf.NumPieces() {
+				got, err := readPiece(s, i, 0, tf.PieceSize(i))
+				if err != nil || !bytes.Equal(got, all[i*tf.PieceLength:i*tf.PieceLength+tf.PieceSize(i)]) {
+					t.Fatalf("piece %d did not round trip: %v", i, err)
+				}
+			}
+			// a ends 10000 bytes into piece 0; b ends 7384 bytes into piece 2.
+			got, err := readPiece(s, 2, 7000, 1000)
+			if err != nil || !bytes.Equal(got, all[2*16384+7000:2*16384+8000]) {
+				t.Fatalf("read across the b/c boundary: %v", err)
+			}
+			last := tf.NumPieces() - 1
+			if _, err := readPiece(s, last, 0, tf.PieceSize(last)+1); err == nil {
+				t.Fatal("read past the end of the last piece")
+			}
+			if _, err := s.WriteAt(last, make([]byte, 10), int64(tf.PieceSize(last)-5)); err == nil {
+				t.Fatal("write past the end of the last piece")
+			}
+			if _, err := readPiece(s, tf.NumPieces(), 0, 1); err == nil {
+				t.Fatal("read of a piece out of range")
+			}
+		})
+	}
+}
+
+// A blob cut short on disk gives a short read, which readPiece reports.
+func TestBlobShortRead(t *testing.T) {
+	tf, all := storageTorrent(t)
+	cfg := DefaultConfig()
+	cfg.DownloadDir = t.TempDir()
+	path := filepath.Join(cfg.DownloadDir, "short.blob")
+	s, err := BlobStorage{Path: path}.OpenTorrent(tf, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.WriteAt(0, all[:16384], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, 16384+100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPiece(s, 0, 0, 16384); err != nil {
+		t.Fatalf("piece before the cut: %v", err)
+	}
+	buf := make([]byte, 1000)
+	if n, err := s.ReadAt(1, buf, 0); err == nil || n != 100 {
+		t.Fatalf("short read gave %d bytes, %v", n, err)
+	}
+	if _, err := readPiece(s, 1, 0, 1000); err == nil {
+		t.Fatal("short read reported as complete")
+	}
+}
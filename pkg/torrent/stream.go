@@ -0,0 +1,210 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+type fileReader struct {
+	d      *Downloader
+	index  int
+	start  int64
+	length int64
+	pos    int64
+	closed bool
+	// unskipped is set on the reader that owns a skipped file we started
+	// fetching for it, and hands the file back to PRIORITY_SKIP on close.
+	unskipped bool
+}
+
+// NewReader opens file fileIndex for streaming; reads block until the
+// pieces they need arrive. A skipped file is fetched while the reader is
+// open and skipped again once it closes. Pieces are only fetched while the
+// download runs, so once it is complete a file that was skipped cannot be
+// read.
+func (d *Downloader) NewReader(fileIndex int) (io.ReadSeekCloser, error) {
+	return d.newReader(fileIndex, true)
+}
+
+// newReader opens a reader that, when fetch is false, leaves priorities
+// alone, for callers such as HEAD requests that only need the size.
+func (d *Downloader) newReader(fileIndex int, fetch bool) (*fileReader, error) {
+	if fileIndex < 0 || fileIndex >= len(d.tf.Files) {
+		return nil, fmt.Errorf("file index %d out of range", fileIndex)
+	}
+	f := d.tf.Files[fileIndex]
+	if f.Padding || f.SymlinkPath != "" {
+		return nil, fmt.Errorf("file %d has no readable contents", fileIndex)
+	}
+	r := &fileReader{
+		d:      d,
+		index:  fileIndex,
+		start:  d.tf.FileOffset(fileIndex),
+		length: int64(f.Length),
+	}
+	if fetch && d.FilePriority(fileIndex) == PRIORITY_SKIP {
+		if d.uploadOnly() && !d.haveFile(fileIndex) {
+			return nil, fmt.Errorf("file %d was skipped and the download is complete", fileIndex)
+		}
+		if err := d.SetFilePriority(fileIndex, PRIORITY_NORMAL); err != nil {
+			return nil, err
+		}
+		r.unskipped = true
+	}
+	d.mu.Lock()
+	d.readers[r] = struct{}{}
+	d.mu.Unlock()
+	return r, nil
+}
+
+// haveFile reports whether every piece of file index is complete.
+func (d *Downloader) haveFile(index int) bool {
+	start := d.tf.FileOffset(index)
+	end := start + int64(d.tf.Files[index].Length)
+	pl := int64(d.tf.PieceLength)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := start / pl; i < (end+pl-1)/pl; i++ {
+		if !d.field.HasPiece(int(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	r.d.mu.Lock()
+	if r.closed {
+		r.d.mu.Unlock()
+		return 0, errors.New("reader closed")
+	}
+	pos := r.pos
+	r.d.mu.Unlock()
+	if pos >= r.length {
+		return 0, io.EOF
+	}
+	pieceLen := int64(r.d.tf.PieceLength)
+	global := r.start + pos
+	index := int(global / pieceLen)
+	if err := r.d.waitPiece(r, index); err != nil {
+		return 0, err
+	}
+	begin := global - int64(index)*pieceLen
+	n := min(int64(len(p)), pieceLen-begin, r.length-pos)
+	if _, err := r.d.storage.ReadAt(index, p[:n], begin); err != nil {
+		return 0, err
+	}
+	r.d.mu.Lock()
+	r.pos += n
+	r.d.mu.Unlock()
+	return int(n), nil
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	r.d.mu.Lock()
+	defer r.d.mu.Unlock()
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.length + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position %d", pos)
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// Close wakes a Read blocked on a piece. When this reader un-skipped its
+// file and no other reader of the file is open, the file is skipped again.
+func (r *fileReader) Close() error {
+	r.d.mu.Lock()
+	if r.closed {
+		r.d.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	delete(r.d.readers, r)
+	r.d.pieceCond.Broadcast()
+	restore := r.unskipped
+	if restore {
+		for other := range r.d.readers {
+			if other.index == r.index {
+				other.unskipped = true
+				restore = false
+				break
+			}
+		}
+	}
+	r.d.mu.Unlock()
+	if restore {
+		return r.d.SetFilePriority(r.index, PRIORITY_SKIP)
+	}
+	return nil
+}
+
+// waitPiece blocks until piece index is complete or r is closed. Once the
+// download is complete nothing fetches pieces any more, so a missing piece
+// is an error.
+func (d *Downloader) waitPiece(r *fileReader, index int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for !d.field.HasPiece(index) {
+		if r.closed {
+			return errors.New("reader closed")
+		}
+		select {
+		case <-d.downloadOver:
+			return fmt.Errorf("piece %d will not be downloaded", index)
+		default:
+		}
+		d.pieceCond.Wait()
+	}
+	return nil
+}
+
+// urgentPieces lists the pieces just ahead of every open reader, nearest
+// first. Caller must hold d.mu.
+func (d *Downloader) urgentPieces() []int {
+	var urgent []int
+	pieceLen := int64(d.tf.PieceLength)
+	for r := range d.readers {
+		if r.pos >= r.length {
+			continue
+		}
+		first := int((r.start + r.pos) / pieceLen)
+		last := int((r.start + r.length - 1) / pieceLen)
+		for i := first; i <= last && i < first+d.cfg.ReadAhead; i++ {
+			if !d.field.HasPiece(i) {
+				urgent = append(urgent, i)
+			}
+		}
+	}
+	return urgent
+}
+
+// sequentialPiece picks the most important piece inside the read-ahead
+// window that starts at the first missing wanted piece. Caller must hold d.mu.
+func (d *Downloader) sequentialPiece(available func(int) bool) int {
+	lo := 0
+	for lo < d.tf.NumPieces() && (d.piecePrio[lo] == PRIORITY_SKIP || d.field.HasPiece(lo)) {
+		lo++
+	}
+	best := -1
+	for i := lo; i < d.tf.NumPieces() && i < lo+d.cfg.ReadAhead; i++ {
+		if d.piecePrio[i] == PRIORITY_SKIP || (best >= 0 && d.piecePrio[i] <= d.piecePrio[best]) {
+			continue
+		}
+		if available(i) {
+			best = i
+		}
+	}
+	return best
+}
@@ -0,0 +1,114 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func streamTorrent(t *testing.T) (*Downloader, []byte) {
+	t.Helper()
+	files := []testFile{
+		{[]string{"a"}, randomBytes(20000)},
+		{[]string{"b"}, randomBytes(30000)},
+	}
+	tf, all := makeTorrent(t, "t", 16384, files)
+	return testDownloader(t, tf), all
+}
+
+func TestReaderSeekAndRead(t *testing.T) {
+	d, all := streamTorrent(t)
+	storeAll(d, all)
+	r, err := d.NewReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, all[20000:]) {
+		t.Fatalf("read whole file: %v", err)
+	}
+	if pos, err := r.Seek(-100, io.SeekEnd); err != nil || pos != 29900 {
+		t.Fatalf("seek to %d: %v", pos, err)
+	}
+	got, err = io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, all[49900:]) {
+		t.Fatalf("read after seek: %v", err)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("seek before the start allowed")
+	}
+	if _, err := d.NewReader(2); err == nil {
+		t.Fatal("reader opened past the last file")
+	}
+}
+
+func TestReaderBlocksUntilClosed(t *testing.T) {
+	d, all := streamTorrent(t)
+	storeAll(d, all, 2)
+	r, err := d.NewReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Seek(15000, io.SeekStart)
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 100))
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("read returned before its piece arrived")
+	case <-time.After(100 * time.Millisecond):
+	}
+	r.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("read on a closed reader succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close did not wake the blocked read")
+	}
+}
+
+// Pieces are only fetched while the download runs, so once it is complete
+// a skipped file cannot be opened, and a read of a piece that is still
+// missing fails instead of blocking for ever.
+func TestReaderAfterCompletion(t *testing.T) {
+	d, all := streamTorrent(t)
+	if err := d.SetFilePriority(1, PRIORITY_SKIP); err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.newReader(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	storeAll(d, all, 2, 3)
+	select {
+	case <-d.downloadOver:
+	default:
+		t.Fatal("download not complete with every wanted piece")
+	}
+	if _, err := d.NewReader(1); err == nil {
+		t.Fatal("opened a skipped file after the download completed")
+	}
+	if d.FilePriority(1) != PRIORITY_SKIP {
+		t.Fatal("priority changed by a reader that could not open")
+	}
+	r.Seek(15000, io.SeekStart)
+	if _, err := r.Read(make([]byte, 100)); err == nil {
+		t.Fatal("read of a missing piece succeeded after completion")
+	}
+	if f, err := d.NewReader(0); err != nil {
+		t.Fatal(err)
+	} else {
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || !bytes.Equal(got, all[:20000]) {
+			t.Fatalf("complete file unreadable after completion: %v", err)
+		}
+	}
+}
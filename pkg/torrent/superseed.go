@@ -0,0 +1,148 @@
+package torrent
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// superSeeder implements superseeding (BEP 16). Peers are shown no pieces
+// in our bitfield; each is told about a single piece with HAVE and only
+// gets another once that piece has been seen at some other peer, so the
+// origin spends its upload on as many distinct pieces as it can.
+type superSeeder struct {
+	mu    sync.Mutex
+	peers map[*PeerCon]*superPeer
+	// given counts how often each piece has been revealed.
+	given []int
+}
+
+type superPeer struct {
+	// piece is the piece currently revealed to the peer, -1 if none.
+	piece    int
+	revealed []int
+}
+
+func newSuperSeeder(numPieces int) *superSeeder {
+	return &superSeeder{peers: make(map[*PeerCon]*superPeer), given: make([]int, numPieces)}
+}
+
+// superSeeding reports whether a new peer should be superseeded, which is
+// only once there is nothing left for us to download.
+func (d *Downloader) superSeeding() bool {
+	if d.super == nil {
+		return false
+	}
+	select {
+	case <-d.downloadOver:
+		return true
+	default:
+		return false
+	}
+}
+
+// add reveals the first piece to a new peer.
+func (s *superSeeder) add(d *Downloader, p *PeerCon) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[p] = &superPeer{piece: -1}
+	s.refresh(d)
+}
+
+func (s *superSeeder) remove(d *Downloader, p *PeerCon) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, p)
+	s.refresh(d)
+}
+
+// allowed reports whether the peer may request the piece, i.e. whether we
+// ever told it we have it.
+func (s *superSeeder) allowed(p *PeerCon, index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp, ok := s.peers[p]
+	if !ok {
+		return false
+	}
+	for _, i := range sp.revealed {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+// update is called whenever a peer announces pieces. A bitfield that
+// already holds the piece we revealed to the sender means the reveal was
+// wasted, so it gets a different one.
+func (s *superSeeder) update(d *Downloader, q *PeerCon, bitfield bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sp, ok := s.peers[q]; ok && bitfield && sp.piece >= 0 && q.peerPieces().HasPiece(sp.piece) {
+		s.given[sp.piece]--
+		sp.piece = -1
+	}
+	s.refresh(d)
+}
+
+// refresh reveals a new piece to every peer whose current one has
+// propagated: another peer has it, or the peer has it and no other peer
+// is left to pass it on to.
+func (s *superSeeder) refresh(d *Downloader) {
+	have := make(map[*PeerCon]Bitfield, len(s.peers))
+	for p := range s.peers {
+		have[p] = p.peerPieces()
+	}
+	for p, sp := range s.peers {
+		if sp.piece >= 0 {
+			seen, lacking := false, false
+			for q, bits := range have {
+				if q == p {
+					continue
+				}
+				if bits.HasPiece(sp.piece) {
+					seen = true
+				} else {
+					lacking = true
+				}
+			}
+			if !seen && (lacking || !have[p].HasPiece(sp.piece)) {
+				continue
+			}
+		}
+		s.reveal(d, p, sp, have)
+	}
+}
+
+// reveal sends the peer HAVE for the piece we have that it lacks which is
+// rarest among connected peers and has been revealed least.
+func (s *superSeeder) reveal(d *Downloader, p *PeerCon, sp *superPeer, have map[*PeerCon]Bitfield) {
+	d.mu.Lock()
+	ours := append(Bitfield{}, d.field...)
+	d.mu.Unlock()
+	n := len(s.given)
+	best, bestScore := -1, 0
+	start := rand.IntN(max(n, 1))
+	for k := range n {
+		i := (start + k) % n
+		if !ours.HasPiece(i) || have[p].HasPiece(i) || i == sp.piece {
+			continue
+		}
+		score := s.given[i]
+		for _, bits := range have {
+			if bits.HasPiece(i) {
+				score++
+			}
+		}
+		if best < 0 || score < bestScore {
+			best, bestScore = i, score
+		}
+	}
+	sp.piece = best
+	if best < 0 {
+		return
+	}
+	s.given[best]++
+	sp.revealed = append(sp.revealed, best)
+	p.SendHave(best)
+}
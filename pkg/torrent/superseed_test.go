@@ -0,0 +1,128 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// superPeers returns a superseeding downloader that has all four pieces of
+// its torrent, and n peers with their write loops running.
+func superPeers(t *testing.T, n int) (*Downloader, []*PeerCon, []net.Conn) {
+	t.Helper()
+	tf, all := makeTorrent(t, "t", 16384, []testFile{{nil, randomBytes(4 * 16384)}})
+	cfg := testConfig(t)
+	cfg.SuperSeed = true
+	d := newTestDownloader(t, tf, cfg)
+	storeAll(d, all)
+	var peers []*PeerCon
+	var remotes []net.Conn
+	for range n {
+		p, remote := pipePeer(t, d)
+		p.superseed = true
+		go p.writeLoop()
+		t.Cleanup(p.out.close)
+		peers = append(peers, p)
+		remotes = append(remotes, remote)
+	}
+	return d, peers, remotes
+}
+
+// readHave reads the HAVE a superseeded peer is sent.
+func readHave(t *testing.T, conn net.Conn) int {
+	t.Helper()
+	msg := readWire(t, conn)
+	if msg == nil || msg.ID != HAVE {
+		t.Fatalf("got %v, want HAVE", msg)
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload))
+}
+
+func noMessage(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("unexpected message: %v", err)
+	}
+}
+
+// peerHas records that p announced the piece, in a bitfield or with HAVE.
+func peerHas(d *Downloader, p *PeerCon, index int, bitfield bool) {
+	p.bitMu.Lock()
+	p.peerBitfield.SetPiece(index)
+	p.bitMu.Unlock()
+	d.super.update(d, p, bitfield)
+}
+
+// Each peer is shown one piece, a different one while others remain, and
+// may only request what it was shown.
+func TestSuperSeedReveal(t *testing.T) {
+	d, peers, remotes := superPeers(t, 2)
+	a, b := peers[0], peers[1]
+	d.super.add(d, a)
+	x := readHave(t, remotes[0])
+	d.super.add(d, b)
+	y := readHave(t, remotes[1])
+	if x == y {
+		t.Fatalf("both peers shown piece %d", x)
+	}
+	if !d.super.allowed(a, x) || d.super.allowed(a, y) || d.super.allowed(b, x) || !d.super.allowed(b, y) {
+		t.Fatal("peers allowed pieces they were not shown")
+	}
+	a.peerFast = true
+	a.amChoking.Store(false)
+	if err := a.handleRequest(d, y, 0, REQUEST_BLOCK_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readWire(t, remotes[0]); msg == nil || msg.ID != REJECT_REQUEST {
+		t.Fatalf("request for an unrevealed piece got %v, want REJECT", msg)
+	}
+	if err := a.handleRequest(d, x, 0, REQUEST_BLOCK_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readWire(t, remotes[0]); msg == nil || msg.ID != PIECE {
+		t.Fatalf("request for a revealed piece got %v, want PIECE", msg)
+	}
+	d.super.remove(d, a)
+	if d.super.allowed(a, x) {
+		t.Fatal("removed peer still allowed its piece")
+	}
+}
+
+// A peer gets its next piece only once its current one shows up at
+// another peer; having it itself is not enough while others lack it.
+func TestSuperSeedRotatesWhenSeenElsewhere(t *testing.T) {
+	d, peers, remotes := superPeers(t, 2)
+	a, b := peers[0], peers[1]
+	d.super.add(d, a)
+	x := readHave(t, remotes[0])
+	d.super.add(d, b)
+	readHave(t, remotes[1])
+	peerHas(d, a, x, false)
+	noMessage(t, remotes[0])
+	peerHas(d, b, x, false)
+	z := readHave(t, remotes[0])
+	if z == x {
+		t.Fatal("same piece revealed again")
+	}
+	noMessage(t, remotes[1])
+	if !d.super.allowed(a, x) || !d.super.allowed(a, z) {
+		t.Fatal("earlier reveal forgotten")
+	}
+}
+
+// A bitfield that already holds the revealed piece wastes the reveal, so
+// the peer is shown another.
+func TestSuperSeedWastedReveal(t *testing.T) {
+	d, peers, remotes := superPeers(t, 2)
+	a, b := peers[0], peers[1]
+	d.super.add(d, a)
+	readHave(t, remotes[0])
+	d.super.add(d, b)
+	y := readHave(t, remotes[1])
+	peerHas(d, b, y, true)
+	if z := readHave(t, remotes[1]); z == y {
+		t.Fatal("same piece revealed again")
+	}
+}
@@ -60,6 +60,21 @@ type Peer struct {
 	port uint16
 }
 
+func parsePeerAddr(address string) (Peer, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return Peer{}, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return Peer{}, fmt.Errorf("invalid port in %q", address)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return Peer{}, fmt.Errorf("invalid ip in %q", address)
+	}
+	return Peer{IP: ip, port: uint16(port)}, nil
+}
 func UnmarshalPeers(data []byte) []Peer {
 	const peerSize = 6
 	numPeers := len(data) / peerSize
@@ -71,7 +86,19 @@ func UnmarshalPeers(data []byte) []Peer {
 	}
 	return peers
 }
-func (t *UDPTracker) getPeers(tf *TorrentFile) ([]Peer, error) {
+
+// udpEvents are the BEP 15 codes of announce events. BEP 15 has none for
+// "paused" (BEP 21), so it gets 4 as libtorrent sends it.
+var udpEvents = map[string]uint32{
+	"":          0,
+	"completed": 1,
+	"started":   2,
+	"stopped":   3,
+	"paused":    4,
+}
+
+// getPeers announces to the tracker like HTTPConnector.getPeers.
+func (t *UDPTracker) getPeers(left int64, infoHash [20]byte, port uint16, event string) ([]Peer, error) {
 	if t.connection_id == 0 {
 		if err := t.connect(); err != nil {
 			return nil, err
@@ -82,18 +109,18 @@ func (t *UDPTracker) getPeers(tf *TorrentFile) ([]Peer, error) {
 	binary.Write(packet, binary.BigEndian, uint64(t.connection_id))
 	binary.Write(packet, binary.BigEndian, uint32(1))
 	binary.Write(packet, binary.BigEndian, tid)
-	packet.Write(tf.InfoHash[:])
+	packet.Write(infoHash[:])
 	peerID := []byte(genPeerID("-GT0001-XXXXXXXXXXXX"))
 	packet.Write(peerID)
 	binary.Write(packet, binary.BigEndian, uint64(0))
-	binary.Write(packet, binary.BigEndian, uint64(tf.Length))
+	binary.Write(packet, binary.BigEndian, uint64(left))
 	binary.Write(packet, binary.BigEndian, uint64(0))
-	binary.Write(packet, binary.BigEndian, uint32(0))
+	binary.Write(packet, binary.BigEndian, udpEvents[event])
 	binary.Write(packet, binary.BigEndian, uint32(0))
 	randkey := rand.Uint32()
 	binary.Write(packet, binary.BigEndian, randkey)
 	binary.Write(packet, binary.BigEndian, int32(-1))
-	binary.Write(packet, binary.BigEndian, uint16(6881))
+	binary.Write(packet, binary.BigEndian, port)
 	err := t.uc.Send(packet.Bytes())
 	if err != nil {
 		return nil, err
@@ -135,7 +162,9 @@ func (ht *HTTPTracker) SendRequest(hr *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
-func (ht *HTTPConnector) getPeers(tf *TorrentFile) ([]Peer, error) {
+// getPeers announces to the tracker with the bytes we have left. event is
+// sent when not empty, e.g. "paused" for a partial seed (BEP 21).
+func (ht *HTTPConnector) getPeers(left int64, infoHash [20]byte, port uint16, event string) ([]Peer, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	base, err := url.Parse(ht.baseURL)
@@ -144,13 +173,16 @@ func (ht *HTTPConnector) getPeers(tf *TorrentFile) ([]Peer, error) {
 	}
 	peerID := []byte(genPeerID("-GT0001-XXXXXXXXXXXX"))
 	params := url.Values{}
-	params.Set("info_hash", string(tf.InfoHash[:]))
+	params.Set("info_hash", string(infoHash[:]))
 	params.Set("peer_id", string(peerID[:]))
-	params.Set("port", "6881")
+	params.Set("port", strconv.Itoa(int(port)))
 	params.Set("uploaded", "0")
 	params.Set("downloaded", "0")
 	params.Set("compact", "1")
-	params.Set("left", strconv.Itoa(tf.Length))
+	params.Set("left", strconv.FormatInt(left, 10))
+	if event != "" {
+		params.Set("event", event)
+	}
 	base.RawQuery = params.Encode()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.String(), nil)
 	if err != nil {
@@ -0,0 +1,80 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestHTTPAnnounceSendsLeft(t *testing.T) {
+	var query map[string][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte("d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer srv.Close()
+	for _, left := range []int64{0, 12345} {
+		if _, err := NewHTTPConnector(srv.URL).getPeers(left, [20]byte{1}, 6881, "paused"); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := query["left"], strconv.FormatInt(left, 10); len(got) != 1 || got[0] != want {
+			t.Errorf("left=%q, want %s", got, want)
+		}
+		if got := query["event"]; len(got) != 1 || got[0] != "paused" {
+			t.Errorf("event=%q, want paused", got)
+		}
+	}
+}
+
+// TestUDPAnnounceSendsPaused runs an announce against a fake BEP 15
+// tracker and checks the left and event fields it receives.
+func TestUDPAnnounceSendsPaused(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	announces := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := append([]byte{}, buf[:n]...)
+			resp := make([]byte, 16)
+			copy(resp[4:8], req[12:16])
+			if binary.BigEndian.Uint32(req[8:12]) == 0 {
+				binary.BigEndian.PutUint64(resp[8:], 42)
+			} else {
+				binary.BigEndian.PutUint32(resp[0:4], 1)
+				resp = append(resp, 0, 0, 0, 0)
+				resp = append(resp, 127, 0, 0, 1, 0x1a, 0xe1)
+				announces <- req
+			}
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+	tr, err := NewUDPTracker("udp://" + conn.LocalAddr().String() + "/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, err := tr.getPeers(12345, [20]byte{1}, 6881, "paused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].port != 6881 {
+		t.Fatalf("peers %v", peers)
+	}
+	req := <-announces
+	if left := binary.BigEndian.Uint64(req[64:72]); left != 12345 {
+		t.Errorf("left=%d, want 12345", left)
+	}
+	if event := binary.BigEndian.Uint32(req[80:84]); event != udpEvents["paused"] {
+		t.Errorf("event=%d, want %d", event, udpEvents["paused"])
+	}
+}
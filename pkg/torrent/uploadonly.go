@@ -0,0 +1,77 @@
+package torrent
+
+// uploadOnly reports whether we have every piece we want and will only
+// upload from now on (BEP 21).
+func (d *Downloader) uploadOnly() bool {
+	select {
+	case <-d.downloadOver:
+		return true
+	default:
+		return false
+	}
+}
+
+// partialSeed reports whether we are upload only without having the whole
+// torrent, because some files were skipped.
+func (d *Downloader) partialSeed() bool {
+	if !d.uploadOnly() {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.piecesDone < d.tf.NumPieces()
+}
+
+// wantsFrom reports whether bits holds a piece we still want.
+func (d *Downloader) wantsFrom(bits Bitfield) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range d.tf.NumPieces() {
+		if bits.HasPiece(i) && !d.field.HasPiece(i) && d.piecePrio[i] != PRIORITY_SKIP {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Downloader) wantsPiece(index int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.field.HasPiece(index) && d.piecePrio[index] != PRIORITY_SKIP
+}
+
+// updateInterest tells the peer whether it has a piece we want, sending
+// INTERESTED or NOT_INTERESTED only when that changes. Callers work it out
+// from what the peer announced, and again once the pieces it has are
+// finished or no longer wanted.
+func (p *PeerCon) updateInterest(want bool) error {
+	p.interestMu.Lock()
+	defer p.interestMu.Unlock()
+	if p.amInterested.Swap(want) == want {
+		return nil
+	}
+	if want {
+		return p.SendInterested()
+	}
+	return p.SendMessage(&Message{ID: NOT_INTERESTED})
+}
+
+// useless reports whether an upload only peer has nothing we want, so its
+// connection slot is better spent on someone else.
+func (p *PeerCon) useless(d *Downloader) bool {
+	return p.peerUploadOnly.Load() && !d.wantsFrom(p.peerPieces())
+}
+
+// becomeUploadOnly is called for every connected peer once the download
+// completes: we lose interest, tell peers that understand upload_only and
+// drop upload only peers, since neither side wants anything.
+func (p *PeerCon) becomeUploadOnly(d *Downloader) {
+	if p.peerUploadOnly.Load() {
+		p.con.Close()
+		return
+	}
+	p.updateInterest(false)
+	if p.SupportsExtension("upload_only") {
+		p.SendExtended("upload_only", []byte{1})
+	}
+}
@@ -0,0 +1,777 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// uTP (BEP 29) runs reliable, ordered streams over UDP with LEDBAT
+// congestion control, which backs off as soon as it sees queuing delay
+// build up so bulk transfers leave room for interactive traffic. Every
+// stream shares one UDP socket and is told apart by address and
+// connection id.
+
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2
+	utpReset = 3
+	utpSyn   = 4
+)
+
+const utpExtSack = 1
+
+const (
+	utpHeaderLen   = 20
+	utpMaxPayload  = 1380
+	utpRecvWindow  = 1 << 20
+	utpMaxWindow   = 1 << 20
+	utpTargetDelay = 100000 // microseconds
+	utpMinRTO      = 500 * time.Millisecond
+	utpMaxRTO      = 8 * time.Second
+	utpSynRetries  = 3
+	utpMaxResends  = 8
+	utpTick        = 50 * time.Millisecond
+	utpLinger      = 30 * time.Second
+	utpBaseWindow  = 2 * time.Minute
+	utpMaxOOO      = 1024
+	utpSackBytes   = 32
+)
+
+type utpHeader struct {
+	typ       uint8
+	connID    uint16
+	timestamp uint32
+	tsDiff    uint32
+	wnd       uint32
+	seq       uint16
+	ack       uint16
+	// sack has a bit for each packet after ack+1 that has arrived, least
+	// significant bit first.
+	sack []byte
+}
+
+func (h *utpHeader) marshal(payload []byte) []byte {
+	ext := 0
+	if len(h.sack) > 0 {
+		ext = 2 + len(h.sack)
+	}
+	buf := make([]byte, utpHeaderLen+ext+len(payload))
+	buf[0] = h.typ<<4 | 1
+	if ext > 0 {
+		buf[1] = utpExtSack
+		buf[utpHeaderLen+1] = byte(len(h.sack))
+		copy(buf[utpHeaderLen+2:], h.sack)
+	}
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.tsDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wnd)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack)
+	copy(buf[utpHeaderLen+ext:], payload)
+	return buf
+}
+
+// parseUTP decodes a packet, skipping extension headers other than
+// selective ack.
+func parseUTP(b []byte) (utpHeader, []byte, error) {
+	var h utpHeader
+	if len(b) < utpHeaderLen || b[0]&0x0f != 1 || b[0]>>4 > utpSyn {
+		return h, nil, fmt.Errorf("not a utp packet")
+	}
+	h.typ = b[0] >> 4
+	h.connID = binary.BigEndian.Uint16(b[2:4])
+	h.timestamp = binary.BigEndian.Uint32(b[4:8])
+	h.tsDiff = binary.BigEndian.Uint32(b[8:12])
+	h.wnd = binary.BigEndian.Uint32(b[12:16])
+	h.seq = binary.BigEndian.Uint16(b[16:18])
+	h.ack = binary.BigEndian.Uint16(b[18:20])
+	ext := b[1]
+	rest := b[utpHeaderLen:]
+	for ext != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return h, nil, fmt.Errorf("truncated utp extension")
+		}
+		if ext == utpExtSack {
+			h.sack = rest[2 : 2+int(rest[1])]
+		}
+		ext = rest[0]
+		rest = rest[2+int(rest[1]):]
+	}
+	return h, rest, nil
+}
+
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+type utpKey struct {
+	addr string
+	id   uint16
+}
+
+type utpSocket struct {
+	pc     net.PacketConn
+	mu     sync.Mutex
+	conns  map[utpKey]*utpConn
+	accept chan *utpConn
+	// accepting is set by the first Accept; until then incoming
+	// connections are reset.
+	accepting atomic.Bool
+	closed    chan struct{}
+	once      sync.Once
+	start     time.Time
+}
+
+func listenUTP(addr string) (*utpSocket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newUTPSocket(pc), nil
+}
+
+func newUTPSocket(pc net.PacketConn) *utpSocket {
+	s := &utpSocket{
+		pc:     pc,
+		conns:  make(map[utpKey]*utpConn),
+		accept: make(chan *utpConn, CONFIRMED_PEER_QUEUE),
+		closed: make(chan struct{}),
+		start:  time.Now(),
+	}
+	go s.readLoop()
+	return s
+}
+
+func (s *utpSocket) now() uint32 {
+	return uint32(time.Since(s.start).Microseconds())
+}
+
+func (s *utpSocket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+func (s *utpSocket) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+		s.mu.Lock()
+		conns := make([]*utpConn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+	})
+	return err
+}
+
+func (s *utpSocket) Accept() (net.Conn, error) {
+	s.accepting.Store(true)
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *utpSocket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			s.Close()
+			return
+		}
+		h, payload, err := parseUTP(buf[:n])
+		if err != nil {
+			continue
+		}
+		payload = append([]byte{}, payload...)
+		key := utpKey{addr: addr.String(), id: h.connID}
+		if h.typ == utpSyn {
+			key.id = h.connID + 1
+		}
+		s.mu.Lock()
+		c, ok := s.conns[key]
+		if !ok && h.typ == utpSyn && s.accepting.Load() {
+			c = s.newConn(addr, h.connID+1, h.connID)
+			c.seq = randomSeq()
+			c.ack = h.seq
+			c.state = utpConnected
+			close(c.connected)
+			s.conns[key] = c
+			select {
+			case s.accept <- c:
+			default:
+				delete(s.conns, key)
+				s.mu.Unlock()
+				c.sendControl(utpReset)
+				continue
+			}
+			go c.tick()
+		}
+		s.mu.Unlock()
+		if c != nil {
+			c.receive(h, payload)
+		} else if h.typ != utpReset {
+			rst := utpHeader{typ: utpReset, connID: h.connID, timestamp: s.now(), ack: h.seq}
+			s.pc.WriteTo(rst.marshal(nil), addr)
+		}
+	}
+}
+
+// newConn builds a connection; caller holds s.mu.
+func (s *utpSocket) newConn(raddr net.Addr, recvID, sendID uint16) *utpConn {
+	c := &utpConn{
+		s:         s,
+		raddr:     raddr,
+		recvID:    recvID,
+		sendID:    sendID,
+		ooo:       make(map[uint16][]byte),
+		cwnd:      utpMaxPayload * 2,
+		peerWnd:   utpRecvWindow,
+		rto:       time.Second,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func randomSeq() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// Dial opens a stream to addr, giving up after timeout.
+func (s *utpSocket) Dial(addr *net.UDPAddr, timeout time.Duration) (net.Conn, error) {
+	s.mu.Lock()
+	var c *utpConn
+	for range 16 {
+		id := randomSeq()
+		key := utpKey{addr: addr.String(), id: id}
+		if _, taken := s.conns[key]; !taken {
+			c = s.newConn(addr, id, id+1)
+			s.conns[key] = c
+			break
+		}
+	}
+	s.mu.Unlock()
+	if c == nil {
+		return nil, fmt.Errorf("no free utp connection id")
+	}
+	c.mu.Lock()
+	c.seq = 1
+	c.synSentAt = time.Now()
+	c.sendPacket(utpSyn, nil)
+	c.seq++
+	c.mu.Unlock()
+	go c.tick()
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		return nil, c.err
+	case <-time.After(timeout):
+		c.fail(os.ErrDeadlineExceeded)
+		return nil, fmt.Errorf("utp dial %s: %w", addr, os.ErrDeadlineExceeded)
+	}
+}
+
+const (
+	utpConnecting = iota
+	utpConnected
+	utpClosed
+)
+
+type utpPacket struct {
+	typ     uint8
+	seq     uint16
+	payload []byte
+	sentAt  time.Time
+	sends   int
+	sacked  bool
+}
+
+type utpConn struct {
+	s      *utpSocket
+	raddr  net.Addr
+	recvID uint16
+	sendID uint16
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	state     int
+	seq       uint16
+	ack       uint16
+	unacked   []*utpPacket
+	inflight  int
+	recvBuf   []byte
+	ooo       map[uint16][]byte
+	finRecv   bool
+	finSeq    uint16
+	eof       bool
+	finSent   bool
+	lingerEnd time.Time
+	err       error
+	synSentAt time.Time
+	synSends  int
+
+	cwnd    float64
+	peerWnd uint32
+	rtt     time.Duration
+	rttVar  time.Duration
+	rto     time.Duration
+	lastAck uint16
+	dupAcks int
+	// recovering is set from a loss until everything sent before it,
+	// up to recoverSeq, is acknowledged.
+	recovering bool
+	recoverSeq uint16
+	reply      uint32
+	baseDelay  uint32
+	baseSince  time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	connected     chan struct{}
+	done          chan struct{}
+	doneOnce      sync.Once
+}
+
+// header stamps a header for a packet sent now. Caller holds c.mu.
+func (c *utpConn) header(typ uint8, seq uint16) utpHeader {
+	h := utpHeader{
+		typ:       typ,
+		connID:    c.sendID,
+		timestamp: c.s.now(),
+		tsDiff:    c.reply,
+		wnd:       uint32(max(0, utpRecvWindow-len(c.recvBuf))),
+		seq:       seq,
+		ack:       c.ack,
+	}
+	if typ == utpSyn {
+		h.connID = c.recvID
+	}
+	if typ == utpState && len(c.ooo) > 0 {
+		sack := make([]byte, utpSackBytes)
+		used := 0
+		for seq := range c.ooo {
+			bit := int(seq - c.ack - 2)
+			if bit >= 0 && bit < utpSackBytes*8 {
+				sack[bit/8] |= 1 << (bit % 8)
+				used = max(used, bit/32*4+4)
+			}
+		}
+		if used > 0 {
+			h.sack = sack[:used]
+		}
+	}
+	return h
+}
+
+// sendPacket sends one packet numbered c.seq. Caller holds c.mu.
+func (c *utpConn) sendPacket(typ uint8, payload []byte) {
+	h := c.header(typ, c.seq)
+	c.s.pc.WriteTo(h.marshal(payload), c.raddr)
+}
+
+func (c *utpConn) resend(p *utpPacket) {
+	h := c.header(p.typ, p.seq)
+	p.sentAt = time.Now()
+	p.sends++
+	c.s.pc.WriteTo(h.marshal(p.payload), c.raddr)
+}
+
+func (c *utpConn) sendControl(typ uint8) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendPacket(typ, nil)
+}
+
+func (c *utpConn) fail(err error) {
+	c.doneOnce.Do(func() {
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = err
+		}
+		c.state = utpClosed
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		close(c.done)
+		c.s.mu.Lock()
+		delete(c.s.conns, utpKey{addr: c.raddr.String(), id: c.recvID})
+		c.s.mu.Unlock()
+	})
+}
+
+func (c *utpConn) receive(h utpHeader, payload []byte) {
+	if h.typ == utpReset {
+		c.fail(syscall.ECONNRESET)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reply = c.s.now() - h.timestamp
+	c.peerWnd = h.wnd
+	if h.typ == utpSyn {
+		// Our answer to the SYN was lost; repeat it.
+		c.sendPacket(utpState, nil)
+		return
+	}
+	if c.state == utpConnecting {
+		if h.typ != utpState {
+			return
+		}
+		c.ack = h.seq - 1
+		c.state = utpConnected
+		c.rtt = time.Since(c.synSentAt)
+		c.rttVar = c.rtt / 2
+		c.updateRTO()
+		close(c.connected)
+	}
+	c.processAck(h)
+	switch h.typ {
+	case utpData, utpFin:
+		c.receiveData(h, payload)
+		c.sendPacket(utpState, nil)
+	}
+	c.cond.Broadcast()
+}
+
+// processAck drops acknowledged packets and feeds LEDBAT. Caller holds c.mu.
+func (c *utpConn) processAck(h utpHeader) {
+	acked := 0
+	var newest *utpPacket
+	for len(c.unacked) > 0 && !seqLess(h.ack, c.unacked[0].seq) {
+		newest = c.unacked[0]
+		c.unacked = c.unacked[1:]
+		if !newest.sacked {
+			acked += len(newest.payload)
+			c.inflight -= len(newest.payload)
+		}
+	}
+	acked += c.processSack(h)
+	if newest != nil {
+		// Only the packet that triggered the ack gives a clean sample;
+		// older ones may have waited behind a hole.
+		if newest.sends == 1 && newest.seq == h.ack {
+			c.sampleRTT(time.Since(newest.sentAt))
+		} else {
+			c.updateRTO()
+		}
+		c.dupAcks = 0
+		c.lastAck = h.ack
+		if c.recovering {
+			// A partial ack means the next packet was lost as well.
+			if seqLess(h.ack, c.recoverSeq) && len(c.unacked) > 0 && !c.unacked[0].sacked {
+				c.resend(c.unacked[0])
+			} else {
+				c.recovering = false
+			}
+		}
+		c.ledbat(h.tsDiff, acked)
+		return
+	}
+	c.ledbat(h.tsDiff, acked)
+	if h.typ == utpState && h.ack == c.lastAck && len(c.unacked) > 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 && !c.recovering {
+			c.enterRecovery()
+			c.resend(c.unacked[0])
+			c.cwnd = max(c.cwnd/2, utpMaxPayload)
+		}
+	}
+}
+
+// processSack marks selectively acknowledged packets and resends any
+// packet that three later ones have overtaken, at most once per round
+// trip. It returns the bytes newly acknowledged.
+func (c *utpConn) processSack(h utpHeader) int {
+	if len(h.sack) == 0 {
+		return 0
+	}
+	acked := 0
+	for _, p := range c.unacked {
+		bit := int(p.seq - h.ack - 2)
+		if p.sacked || bit < 0 || bit >= len(h.sack)*8 {
+			continue
+		}
+		if h.sack[bit/8]&(1<<(bit%8)) != 0 {
+			p.sacked = true
+			acked += len(p.payload)
+			c.inflight -= len(p.payload)
+		}
+	}
+	later := 0
+	lost := false
+	for i := len(c.unacked) - 1; i >= 0; i-- {
+		p := c.unacked[i]
+		if p.sacked {
+			later++
+			continue
+		}
+		if later >= 3 && time.Since(p.sentAt) > c.rtt {
+			c.resend(p)
+			lost = true
+		}
+	}
+	if lost && !c.recovering {
+		c.enterRecovery()
+		c.cwnd = max(c.cwnd/2, utpMaxPayload)
+	}
+	return acked
+}
+
+func (c *utpConn) enterRecovery() {
+	c.recovering = true
+	c.recoverSeq = c.seq - 1
+}
+
+func (c *utpConn) sampleRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.updateRTO()
+}
+
+func (c *utpConn) updateRTO() {
+	c.rto = min(max(c.rtt+4*c.rttVar, utpMinRTO), utpMaxRTO)
+}
+
+// ledbat grows the window while the measured queuing delay stays below
+// the target and shrinks it once it goes over.
+func (c *utpConn) ledbat(delay uint32, acked int) {
+	if delay == 0 || acked == 0 {
+		return
+	}
+	if c.baseDelay == 0 || delay < c.baseDelay || time.Since(c.baseSince) > utpBaseWindow {
+		c.baseDelay = delay
+		c.baseSince = time.Now()
+	}
+	queuing := float64(delay - c.baseDelay)
+	offTarget := (utpTargetDelay - queuing) / utpTargetDelay
+	c.cwnd += offTarget * float64(acked) * utpMaxPayload / c.cwnd
+	c.cwnd = min(max(c.cwnd, utpMaxPayload), utpMaxWindow)
+}
+
+// receiveData queues a data or FIN packet and moves everything now in
+// order into recvBuf. Caller holds c.mu.
+func (c *utpConn) receiveData(h utpHeader, payload []byte) {
+	if h.typ == utpFin {
+		c.finRecv = true
+		c.finSeq = h.seq
+	}
+	// Only packets inside the receive window are kept, so the buffer never
+	// holds more than utpMaxOOO of them and ack+1 always fits.
+	if !seqLess(c.ack, h.seq) || h.seq-c.ack > utpMaxOOO {
+		return
+	}
+	c.ooo[h.seq] = payload
+	for {
+		next := c.ack + 1
+		data, ok := c.ooo[next]
+		if !ok {
+			break
+		}
+		delete(c.ooo, next)
+		c.ack = next
+		c.recvBuf = append(c.recvBuf, data...)
+	}
+	if c.finRecv && c.ack == c.finSeq {
+		c.eof = true
+	}
+}
+
+// tick drives retransmission and wakes callers waiting on a deadline.
+func (c *utpConn) tick() {
+	ticker := time.NewTicker(utpTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		var failErr error
+		switch {
+		case c.state == utpConnecting:
+			if time.Since(c.synSentAt) > c.rto {
+				c.synSends++
+				if c.synSends >= utpSynRetries {
+					failErr = os.ErrDeadlineExceeded
+					break
+				}
+				c.rto = min(c.rto*2, utpMaxRTO)
+				c.synSentAt = time.Now()
+				seq := c.seq
+				c.seq = 1
+				c.sendPacket(utpSyn, nil)
+				c.seq = seq
+			}
+		case c.finSent && (len(c.unacked) == 0 || time.Now().After(c.lingerEnd)):
+			failErr = net.ErrClosed
+		case len(c.unacked) > 0 && time.Since(c.unacked[0].sentAt) > c.rto:
+			p := c.unacked[0]
+			if p.sends >= utpMaxResends {
+				failErr = os.ErrDeadlineExceeded
+				break
+			}
+			c.rto = min(c.rto*2, utpMaxRTO)
+			c.cwnd = utpMaxPayload
+			c.enterRecovery()
+			c.resend(p)
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		if failErr != nil {
+			c.fail(failErr)
+			return
+		}
+	}
+}
+
+// wait blocks until ready returns true, the connection fails or the
+// deadline passes. Caller holds c.mu.
+func (c *utpConn) wait(ready func() bool, deadline *time.Time) error {
+	for !ready() {
+		if c.err != nil {
+			return c.err
+		}
+		if !deadline.IsZero() && time.Now().After(*deadline) {
+			return os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+	return nil
+}
+
+func (c *utpConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.wait(func() bool { return len(c.recvBuf) > 0 || c.eof || c.finSent }, &c.readDeadline)
+	if c.finSent {
+		return 0, net.ErrClosed
+	}
+	if len(c.recvBuf) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	wasFull := utpRecvWindow-len(c.recvBuf) < utpMaxPayload
+	n := copy(p, c.recvBuf)
+	c.recvBuf = c.recvBuf[n:]
+	if wasFull {
+		c.sendPacket(utpState, nil)
+	}
+	return n, nil
+}
+
+func (c *utpConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(p) {
+		chunk := min(len(p)-written, utpMaxPayload)
+		err := c.wait(func() bool {
+			window := min(int(c.cwnd), int(c.peerWnd))
+			return c.finSent || c.inflight == 0 || c.inflight+chunk <= window
+		}, &c.writeDeadline)
+		if err != nil {
+			return written, err
+		}
+		if c.finSent {
+			return written, net.ErrClosed
+		}
+		payload := append([]byte{}, p[written:written+chunk]...)
+		pkt := &utpPacket{typ: utpData, seq: c.seq, payload: payload, sentAt: time.Now(), sends: 1}
+		c.sendPacket(utpData, payload)
+		c.seq++
+		c.unacked = append(c.unacked, pkt)
+		c.inflight += chunk
+		written += chunk
+	}
+	return written, nil
+}
+
+// Close sends FIN behind any unacknowledged data and returns. The
+// connection stays registered, retransmitting, until the FIN is
+// acknowledged or utpLinger passes.
+func (c *utpConn) Close() error {
+	c.mu.Lock()
+	if c.state != utpConnected || c.err != nil {
+		c.mu.Unlock()
+		c.fail(net.ErrClosed)
+		return nil
+	}
+	if !c.finSent {
+		c.finSent = true
+		c.lingerEnd = time.Now().Add(utpLinger)
+		c.unacked = append(c.unacked, &utpPacket{typ: utpFin, seq: c.seq, sentAt: time.Now(), sends: 1})
+		c.sendPacket(utpFin, nil)
+		c.seq++
+		c.cond.Broadcast()
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr  { return c.s.Addr() }
+func (c *utpConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
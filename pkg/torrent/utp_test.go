@@ -0,0 +1,229 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lossyConn is a PacketConn that drops, delays and so reorders the
+// packets written to it. drop, when set, decides about each packet before
+// the random loss does.
+type lossyConn struct {
+	net.PacketConn
+	mu      sync.Mutex
+	rng     *rand.Rand
+	loss    float64
+	jitter  time.Duration
+	drop    func(b []byte) bool
+	sent    atomic.Int64
+	dropped atomic.Int64
+}
+
+func newLossyConn(t *testing.T, seed uint64, loss float64, jitter time.Duration) *lossyConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no loopback udp:", err)
+	}
+	return &lossyConn{PacketConn: pc, rng: rand.New(rand.NewPCG(seed, seed)), loss: loss, jitter: jitter}
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.sent.Add(1)
+	c.mu.Lock()
+	drop := (c.drop != nil && c.drop(b)) || c.rng.Float64() < c.loss
+	var delay time.Duration
+	if c.jitter > 0 {
+		delay = time.Duration(c.rng.Int64N(int64(c.jitter)))
+	}
+	c.mu.Unlock()
+	if drop {
+		c.dropped.Add(1)
+		return len(b), nil
+	}
+	if delay == 0 {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	buf := bytes.Clone(b)
+	time.AfterFunc(delay, func() { c.PacketConn.WriteTo(buf, addr) })
+	return len(b), nil
+}
+
+// utpPair connects a stream from one socket to another over lossy links.
+func utpPair(t *testing.T, a, b *lossyConn) (net.Conn, net.Conn) {
+	t.Helper()
+	sa, sb := newUTPSocket(a), newUTPSocket(b)
+	t.Cleanup(func() {
+		sa.Close()
+		sb.Close()
+	})
+	// Until Accept runs the socket resets incoming streams.
+	sb.accepting.Store(true)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := sb.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	dialed, err := sa.Dial(b.LocalAddr().(*net.UDPAddr), 10*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	select {
+	case c, ok := <-accepted:
+		if !ok {
+			t.Fatal("accept failed")
+		}
+		return dialed, c
+	case <-time.After(10 * time.Second):
+		t.Fatal("nothing accepted")
+	}
+	return nil, nil
+}
+
+// transfer sends data from one end and checks the other reads back exactly
+// the same bytes in order, then sees EOF once the sender closes.
+func transfer(t *testing.T, from, to net.Conn, data []byte) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := from.Write(data)
+		if err == nil {
+			err = from.Close()
+		}
+		errc <- err
+	}()
+	to.SetReadDeadline(time.Now().Add(60 * time.Second))
+	got, err := io.ReadAll(to)
+	if err != nil {
+		t.Fatalf("read after %d bytes: %v", len(got), err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		i := 0
+		for i < min(len(got), len(data)) && got[i] == data[i] {
+			i++
+		}
+		t.Fatalf("received %d bytes, want %d; first difference at %d", len(got), len(data), i)
+	}
+}
+
+func TestUTPTransfer(t *testing.T) {
+	tests := []struct {
+		name   string
+		loss   float64
+		jitter time.Duration
+	}{
+		{"clean", 0, 0},
+		{"loss", 0.05, 0},
+		{"reorder", 0, 20 * time.Millisecond},
+		{"loss and reorder", 0.05, 20 * time.Millisecond},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newLossyConn(t, uint64(i)+1, tt.loss, tt.jitter)
+			b := newLossyConn(t, uint64(i)+100, tt.loss, tt.jitter)
+			dialed, accepted := utpPair(t, a, b)
+			transfer(t, dialed, accepted, randomBytes(256<<10))
+			if tt.loss > 0 && a.dropped.Load() == 0 {
+				t.Error("no packets were lost")
+			}
+		})
+	}
+}
+
+func TestUTPBothDirections(t *testing.T) {
+	a := newLossyConn(t, 7, 0.02, 5*time.Millisecond)
+	b := newLossyConn(t, 8, 0.02, 5*time.Millisecond)
+	dialed, accepted := utpPair(t, a, b)
+	up, down := randomBytes(64<<10), randomBytes(64<<10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		accepted.Write(down)
+	}()
+	dialed.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got := make([]byte, len(down))
+	if _, err := io.ReadFull(dialed, got); err != nil || !bytes.Equal(got, down) {
+		t.Fatalf("accepting side's data arrived damaged: %v", err)
+	}
+	wg.Wait()
+	transfer(t, dialed, accepted, up)
+}
+
+// Losing every packet for a while stalls the stream until the
+// retransmission timer fires, after which it must pick up where it left.
+func TestUTPRecoversFromOutage(t *testing.T) {
+	const outage = 1500 * time.Millisecond
+	a := newLossyConn(t, 11, 0, 0)
+	b := newLossyConn(t, 12, 0, 0)
+	var began atomic.Int64
+	drop := func([]byte) bool {
+		if a.sent.Load() < 100 {
+			return false
+		}
+		began.CompareAndSwap(0, time.Now().UnixNano())
+		return time.Since(time.Unix(0, began.Load())) < outage
+	}
+	a.drop, b.drop = drop, drop
+	dialed, accepted := utpPair(t, a, b)
+	start := time.Now()
+	transfer(t, dialed, accepted, randomBytes(512<<10))
+	if a.dropped.Load() == 0 {
+		t.Fatal("no packets lost to the outage")
+	}
+	if time.Since(start) < outage {
+		t.Fatal("transfer finished during the outage")
+	}
+}
+
+// A lost SYN is sent again once the dial's retransmission timer fires.
+func TestUTPSynRetransmit(t *testing.T) {
+	a := newLossyConn(t, 21, 0, 0)
+	b := newLossyConn(t, 22, 0, 0)
+	var syns atomic.Int32
+	a.drop = func(p []byte) bool {
+		return p[0]>>4 == utpSyn && syns.Add(1) == 1
+	}
+	dialed, accepted := utpPair(t, a, b)
+	if syns.Load() < 2 {
+		t.Fatalf("connected after %d SYNs, want a retransmitted one", syns.Load())
+	}
+	transfer(t, dialed, accepted, randomBytes(4096))
+}
+
+// Packets far ahead of the receive window are dropped instead of filling
+// the out of order buffer, so the next in-order packet is always taken.
+func TestUTPReceiveWindow(t *testing.T) {
+	for _, ack := range []uint16{100, 65530} {
+		c := &utpConn{ack: ack, ooo: make(map[uint16][]byte)}
+		for i := range 2 * utpMaxOOO {
+			c.receiveData(utpHeader{typ: utpData, seq: ack + utpMaxOOO + 1 + uint16(i)}, []byte{9})
+		}
+		if len(c.ooo) != 0 {
+			t.Fatalf("ack %d: %d packets beyond the window buffered", ack, len(c.ooo))
+		}
+		c.receiveData(utpHeader{typ: utpData, seq: ack + 3}, []byte("c"))
+		c.receiveData(utpHeader{typ: utpData, seq: ack + utpMaxOOO}, []byte("z"))
+		c.receiveData(utpHeader{typ: utpData, seq: ack + 1}, []byte("a"))
+		c.receiveData(utpHeader{typ: utpData, seq: ack + 2}, []byte("b"))
+		if string(c.recvBuf) != "abc" || c.ack != ack+3 {
+			t.Fatalf("ack %d: received %q up to %d", ack, c.recvBuf, c.ack)
+		}
+		if len(c.ooo) != 1 {
+			t.Fatalf("ack %d: packet at the window edge not kept", ack)
+		}
+	}
+}
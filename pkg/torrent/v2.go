@@ -0,0 +1,464 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"slices"
+	"time"
+)
+
+const (
+	HASH_REQUEST MessageID = 21
+	HASHES       MessageID = 22
+	HASH_REJECT  MessageID = 23
+)
+
+const merkleBlockSize = 16384
+
+type v2PieceRef struct {
+	file  int
+	piece int
+}
+
+func merkleParent(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+func nextPow2(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// merkleRoot pads leaves to width with pad and hashes pairs up to the root.
+func merkleRoot(leaves [][32]byte, width int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, width)
+	copy(layer, leaves)
+	for i := len(leaves); i < width; i++ {
+		layer[i] = pad
+	}
+	for len(layer) > 1 {
+		next := make([][32]byte, len(layer)/2)
+		for i := range next {
+			next[i] = merkleParent(layer[2*i], layer[2*i+1])
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+// zeroSubtree is the root of a tree of n zero leaves, n being a power of two.
+func zeroSubtree(n int) [32]byte {
+	var h [32]byte
+	for ; n > 1; n /= 2 {
+		h = merkleParent(h, h)
+	}
+	return h
+}
+
+func blockHashes(data []byte) [][32]byte {
+	var leaves [][32]byte
+	for off := 0; off < len(data); off += merkleBlockSize {
+		end := min(off+merkleBlockSize, len(data))
+		leaves = append(leaves, sha256.Sum256(data[off:end]))
+	}
+	return leaves
+}
+
+func (tf *TorrentFile) blocksPerPiece() int {
+	return tf.PieceLength / merkleBlockSize
+}
+
+func (tf *TorrentFile) verifyPieceV2(index int, data []byte) bool {
+	if index < 0 || index >= len(tf.v2Pieces) {
+		return false
+	}
+	ref := tf.v2Pieces[index]
+	f := tf.Files[ref.file]
+	fileData := data
+	if remaining := f.Length - ref.piece*tf.PieceLength; remaining < len(fileData) {
+		fileData = fileData[:remaining]
+	}
+	leaves := blockHashes(fileData)
+	if f.Length <= tf.PieceLength {
+		root := merkleRoot(leaves, nextPow2(len(leaves)), [32]byte{})
+		return root == f.PiecesRoot
+	}
+	tf.layerMu.RLock()
+	layer := tf.PieceLayers[f.PiecesRoot]
+	var want [32]byte
+	if ref.piece < len(layer) {
+		want = layer[ref.piece]
+	}
+	tf.layerMu.RUnlock()
+	return want != [32]byte{} && merkleRoot(leaves, tf.blocksPerPiece(), [32]byte{}) == want
+}
+
+// pieceHashKnown reports whether the piece can be checked against its
+// file's merkle tree: files of a single piece are checked against the
+// pieces root, others need their piece layer hash.
+func (tf *TorrentFile) pieceHashKnown(index int) bool {
+	if index < 0 || index >= len(tf.v2Pieces) {
+		return false
+	}
+	ref := tf.v2Pieces[index]
+	f := tf.Files[ref.file]
+	if f.Length <= tf.PieceLength {
+		return true
+	}
+	tf.layerMu.RLock()
+	defer tf.layerMu.RUnlock()
+	layer := tf.PieceLayers[f.PiecesRoot]
+	return ref.piece < len(layer) && layer[ref.piece] != [32]byte{}
+}
+
+func (tf *TorrentFile) checkPieceLayer(f FileInfo, layer [][32]byte) error {
+	want := (f.Length + tf.PieceLength - 1) / tf.PieceLength
+	if len(layer) != want {
+		return fmt.Errorf("piece layer has %d hashes, expected %d", len(layer), want)
+	}
+	pad := zeroSubtree(tf.blocksPerPiece())
+	if merkleRoot(layer, nextPow2(len(layer)), pad) != f.PiecesRoot {
+		return fmt.Errorf("piece layer does not match pieces root")
+	}
+	return nil
+}
+
+func parseFileTree(node bencodeObject, prefix []string, out *[]FileInfo) error {
+	if node.objType != DICT {
+		return fmt.Errorf("file tree node is not a dictionary")
+	}
+	for _, p := range node.dict {
+		if p.key == "" {
+			if len(prefix) == 0 {
+				return fmt.Errorf("file entry at the root of the file tree")
+			}
+			path, err := sanitizePath(prefix)
+			if err != nil {
+				return err
+			}
+			lenObj, err := p.value.valAt("length")
+			if err != nil || lenObj.val < 0 {
+				return fmt.Errorf("invalid length for %s", path)
+			}
+			fi := FileInfo{Path: path, Length: int(lenObj.val)}
+			if err := parseFileAttr(p.value, &fi); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			if fi.Length > 0 {
+				rootObj, err := p.value.valAt("pieces root")
+				if err != nil || len(rootObj.str) != 32 {
+					return fmt.Errorf("missing pieces root for %s", path)
+				}
+				copy(fi.PiecesRoot[:], rootObj.str)
+			}
+			*out = append(*out, fi)
+			continue
+		}
+		child := append(append([]string{}, prefix...), p.key)
+		if err := parseFileTree(p.value, child, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parsePieceLayers(obj bencodeObject) (map[[32]byte][][32]byte, error) {
+	layers := make(map[[32]byte][][32]byte)
+	if obj.objType != DICT {
+		return layers, nil
+	}
+	for _, p := range obj.dict {
+		if len(p.key) != 32 || len(p.value.str)%32 != 0 {
+			return nil, fmt.Errorf("invalid piece layer entry")
+		}
+		var root [32]byte
+		copy(root[:], p.key)
+		hashes := make([][32]byte, len(p.value.str)/32)
+		for i := range hashes {
+			copy(hashes[i][:], p.value.str[i*32:(i+1)*32])
+		}
+		layers[root] = hashes
+	}
+	return layers, nil
+}
+
+// layoutV2 places every file on a piece boundary, adding virtual padding
+// between files the way hybrid torrents do with explicit pad files.
+func layoutV2(files []FileInfo, pieceLength int) []FileInfo {
+	var out []FileInfo
+	for i, f := range files {
+		out = append(out, f)
+		if rem := f.Length % pieceLength; rem != 0 && i != len(files)-1 {
+			out = append(out, FileInfo{
+				Path:    fmt.Sprintf(".pad/%d", pieceLength-rem),
+				Length:  pieceLength - rem,
+				Padding: true,
+			})
+		}
+	}
+	return out
+}
+
+func (tf *TorrentFile) buildV2Pieces() error {
+	tf.v2Pieces = make([]v2PieceRef, tf.NumPieces())
+	offset := 0
+	for i, f := range tf.Files {
+		if f.Padding || f.Length == 0 {
+			offset += f.Length
+			continue
+		}
+		if offset%tf.PieceLength != 0 {
+			return fmt.Errorf("file %s is not aligned to a piece boundary", f.Path)
+		}
+		first := offset / tf.PieceLength
+		n := (f.Length + tf.PieceLength - 1) / tf.PieceLength
+		for j := range n {
+			if first+j < len(tf.v2Pieces) {
+				tf.v2Pieces[first+j] = v2PieceRef{file: i, piece: j}
+			}
+		}
+		if f.Length > tf.PieceLength {
+			// A missing piece layer starts out all unknown and is
+			// filled in from HASHES replies.
+			layer, ok := tf.PieceLayers[f.PiecesRoot]
+			if !ok {
+				tf.PieceLayers[f.PiecesRoot] = make([][32]byte, n)
+			} else if err := tf.checkPieceLayer(f, layer); err != nil {
+				return fmt.Errorf("%s: %v", f.Path, err)
+			}
+		}
+		offset += f.Length
+	}
+	return nil
+}
+
+func (tf *TorrentFile) fileByRoot(root [32]byte) (FileInfo, bool) {
+	for _, f := range tf.Files {
+		if !f.Padding && f.PiecesRoot == root {
+			return f, true
+		}
+	}
+	return FileInfo{}, false
+}
+
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   uint32
+	Index       uint32
+	Length      uint32
+	ProofLayers uint32
+}
+
+func (r *HashRequest) serialize() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(r.PiecesRoot[:])
+	binary.Write(buf, binary.BigEndian, r.BaseLayer)
+	binary.Write(buf, binary.BigEndian, r.Index)
+	binary.Write(buf, binary.BigEndian, r.Length)
+	binary.Write(buf, binary.BigEndian, r.ProofLayers)
+	return buf.Bytes()
+}
+
+func parseHashRequest(payload []byte) (*HashRequest, error) {
+	if len(payload) < 48 {
+		return nil, fmt.Errorf("hash request too short")
+	}
+	r := &HashRequest{}
+	copy(r.PiecesRoot[:], payload[:32])
+	r.BaseLayer = binary.BigEndian.Uint32(payload[32:36])
+	r.Index = binary.BigEndian.Uint32(payload[36:40])
+	r.Length = binary.BigEndian.Uint32(payload[40:44])
+	r.ProofLayers = binary.BigEndian.Uint32(payload[44:48])
+	return r, nil
+}
+
+// pieceTree returns every layer of the merkle tree built on top of the piece
+// layer of f, starting with the padded piece layer and ending with the root.
+// It fails while any piece hash of f is still unknown.
+func (tf *TorrentFile) pieceTree(f FileInfo) ([][][32]byte, bool) {
+	tf.layerMu.RLock()
+	layer, ok := tf.PieceLayers[f.PiecesRoot]
+	layer = append([][32]byte{}, layer...)
+	tf.layerMu.RUnlock()
+	if !ok || slices.Contains(layer, [32]byte{}) {
+		return nil, false
+	}
+	pad := zeroSubtree(tf.blocksPerPiece())
+	base := make([][32]byte, nextPow2(len(layer)))
+	copy(base, layer)
+	for i := len(layer); i < len(base); i++ {
+		base[i] = pad
+	}
+	tree := [][][32]byte{base}
+	for cur := base; len(cur) > 1; {
+		next := make([][32]byte, len(cur)/2)
+		for i := range next {
+			next[i] = merkleParent(cur[2*i], cur[2*i+1])
+		}
+		tree = append(tree, next)
+		cur = next
+	}
+	return tree, true
+}
+
+// answerHashRequest serves requests against the piece layer only, which is
+// the only layer stored in the torrent file.
+func (tf *TorrentFile) answerHashRequest(r *HashRequest) ([][32]byte, error) {
+	f, ok := tf.fileByRoot(r.PiecesRoot)
+	if !ok {
+		return nil, fmt.Errorf("unknown pieces root")
+	}
+	if r.BaseLayer != uint32(bits.TrailingZeros(uint(tf.blocksPerPiece()))) {
+		return nil, fmt.Errorf("unsupported base layer %d", r.BaseLayer)
+	}
+	tree, ok := tf.pieceTree(f)
+	if !ok {
+		return nil, fmt.Errorf("no piece layer for file")
+	}
+	base := tree[0]
+	if r.Length < 2 || r.Length&(r.Length-1) != 0 || r.Index%r.Length != 0 ||
+		int(r.Index) >= len(base) || int(r.Index+r.Length) > len(base) {
+		return nil, fmt.Errorf("invalid hash range")
+	}
+	hashes := append([][32]byte{}, base[r.Index:r.Index+r.Length]...)
+	level := bits.TrailingZeros(uint(r.Length))
+	node := int(r.Index / r.Length)
+	for i := uint32(0); i < r.ProofLayers && level < len(tree)-1; i++ {
+		hashes = append(hashes, tree[level][node^1])
+		node /= 2
+		level++
+	}
+	return hashes, nil
+}
+
+// verifyHashes checks a HASHES reply against the file's pieces root. The
+// reply must cover the piece layer and carry exactly the uncle hashes that
+// lead from its range to the root, so hashes from another layer of the
+// tree cannot pass for piece hashes.
+func (tf *TorrentFile) verifyHashes(r *HashRequest, hashes [][32]byte) bool {
+	f, ok := tf.fileByRoot(r.PiecesRoot)
+	if !ok || r.BaseLayer != uint32(bits.TrailingZeros(uint(tf.blocksPerPiece()))) {
+		return false
+	}
+	width := nextPow2((f.Length + tf.PieceLength - 1) / tf.PieceLength)
+	if r.Length < 1 || r.Length&(r.Length-1) != 0 || r.Index%r.Length != 0 ||
+		int(r.Length) > width || int(r.Index+r.Length) > width {
+		return false
+	}
+	proof := bits.TrailingZeros(uint(width / int(r.Length)))
+	if len(hashes) != int(r.Length)+proof {
+		return false
+	}
+	cur := merkleRoot(hashes[:r.Length], int(r.Length), [32]byte{})
+	node := int(r.Index / r.Length)
+	for _, uncle := range hashes[r.Length:] {
+		if node%2 == 0 {
+			cur = merkleParent(cur, uncle)
+		} else {
+			cur = merkleParent(uncle, cur)
+		}
+		node /= 2
+	}
+	return node == 0 && cur == f.PiecesRoot
+}
+
+// awaitPieceHash makes sure a pure v2 piece can be verified before it is
+// downloaded, asking a v2 peer for the missing piece layer hashes and
+// waiting up to HASH_WAIT for them.
+func (d *Downloader) awaitPieceHash(p *PeerCon, index int) bool {
+	if d.tf.HasV1 || !d.tf.HasV2 || d.tf.pieceHashKnown(index) {
+		return true
+	}
+	if !p.peerV2 || p.SendHashRequest(d.tf.pieceHashRequest(index)) != nil {
+		return false
+	}
+	deadline := time.Now().Add(HASH_WAIT)
+	for time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		if d.tf.pieceHashKnown(index) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PeerCon) SendHashRequest(r *HashRequest) error {
+	return p.SendMessage(&Message{ID: HASH_REQUEST, Payload: r.serialize()})
+}
+
+func (p *PeerCon) handleHashRequest(payload []byte) error {
+	r, err := parseHashRequest(payload)
+	if err != nil {
+		return err
+	}
+	hashes, err := p.tf.answerHashRequest(r)
+	if err != nil {
+		return p.SendMessage(&Message{ID: HASH_REJECT, Payload: r.serialize()})
+	}
+	buf := bytes.NewBuffer(r.serialize())
+	for _, h := range hashes {
+		buf.Write(h[:])
+	}
+	return p.SendMessage(&Message{ID: HASHES, Payload: buf.Bytes()})
+}
+
+func (p *PeerCon) handleHashes(payload []byte) error {
+	r, err := parseHashRequest(payload)
+	if err != nil {
+		return err
+	}
+	rest := payload[48:]
+	if len(rest)%32 != 0 {
+		return fmt.Errorf("hashes payload not a multiple of 32 bytes")
+	}
+	hashes := make([][32]byte, len(rest)/32)
+	for i := range hashes {
+		copy(hashes[i][:], rest[i*32:(i+1)*32])
+	}
+	if !p.tf.verifyHashes(r, hashes) {
+		return fmt.Errorf("hashes do not match pieces root")
+	}
+	p.tf.storeHashes(r, hashes)
+	return nil
+}
+
+// storeHashes keeps the piece layer hashes of a verified HASHES reply so
+// the pieces they cover can be checked. Hashes already known are never
+// replaced.
+func (tf *TorrentFile) storeHashes(r *HashRequest, hashes [][32]byte) {
+	if r.BaseLayer != uint32(bits.TrailingZeros(uint(tf.blocksPerPiece()))) {
+		return
+	}
+	tf.layerMu.Lock()
+	defer tf.layerMu.Unlock()
+	layer := tf.PieceLayers[r.PiecesRoot]
+	for i := range int(r.Length) {
+		if idx := int(r.Index) + i; idx < len(layer) && layer[idx] == ([32]byte{}) {
+			layer[idx] = hashes[i]
+		}
+	}
+}
+
+// pieceHashRequest asks for the piece layer hashes around a piece, with
+// the uncle hashes needed to check them against the pieces root.
+func (tf *TorrentFile) pieceHashRequest(index int) *HashRequest {
+	ref := tf.v2Pieces[index]
+	f := tf.Files[ref.file]
+	width := nextPow2((f.Length + tf.PieceLength - 1) / tf.PieceLength)
+	length := min(width, HASH_REQUEST_SPAN)
+	return &HashRequest{
+		PiecesRoot:  f.PiecesRoot,
+		BaseLayer:   uint32(bits.TrailingZeros(uint(tf.blocksPerPiece()))),
+		Index:       uint32(ref.piece / length * length),
+		Length:      uint32(length),
+		ProofLayers: uint32(bits.TrailingZeros(uint(width / length))),
+	}
+}
@@ -0,0 +1,149 @@
+package torrent
+
+import (
+	"math/bits"
+	"testing"
+)
+
+// v2Torrent builds a single file v2 torrent over data, with or without its
+// piece layers.
+func v2Torrent(t *testing.T, data []byte, pieceLen int, withLayers bool) *TorrentFile {
+	t.Helper()
+	bpp := pieceLen / merkleBlockSize
+	var layer [][32]byte
+	for off := 0; off < len(data); off += pieceLen {
+		layer = append(layer, merkleRoot(blockHashes(data[off:min(off+pieceLen, len(data))]), bpp, [32]byte{}))
+	}
+	root := merkleRoot(layer, nextPow2(len(layer)), zeroSubtree(bpp))
+	file := bencodeDict(pair{"", bencodeDict(pair{"length", bencodeInt(int64(len(data)))}, pair{"pieces root", bencodeString(string(root[:]))})})
+	info := bencodeDict(
+		pair{"file tree", bencodeDict(pair{"f.bin", file})},
+		pair{"meta version", bencodeInt(2)},
+		pair{"name", bencodeString("f.bin")},
+		pair{"piece length", bencodeInt(int64(pieceLen))},
+	)
+	top := []pair{{"info", info}}
+	if withLayers {
+		var concat []byte
+		for _, h := range layer {
+			concat = append(concat, h[:]...)
+		}
+		top = append(top, pair{"piece layers", bencodeDict(pair{string(root[:]), bencodeString(string(concat))})})
+	}
+	ben := bencodeDict(top...)
+	s, _ := ben.Marshal()
+	tf, err := parseTorrent([]byte(s))
+	if err != nil {
+		t.Fatalf("couldnt parse v2 torrent: %v", err)
+	}
+	return tf
+}
+
+func TestHashesFillMissingPieceLayer(t *testing.T) {
+	pieceLen := 2 * merkleBlockSize
+	data := randomBytes(5*pieceLen + 1000)
+	full := v2Torrent(t, data, pieceLen, true)
+	bare := v2Torrent(t, data, pieceLen, false)
+	piece := func(i int) []byte { return data[i*pieceLen : min((i+1)*pieceLen, len(data))] }
+
+	if !full.VerifyPiece(3, piece(3)) {
+		t.Fatal("piece does not verify against the torrent's piece layer")
+	}
+	if bare.pieceHashKnown(3) || bare.VerifyPiece(3, piece(3)) {
+		t.Fatal("piece verified without its piece layer hash")
+	}
+	r := bare.pieceHashRequest(3)
+	hashes, err := full.answerHashRequest(r)
+	if err != nil {
+		t.Fatalf("couldnt answer hash request: %v", err)
+	}
+	payload := r.serialize()
+	for _, h := range hashes {
+		payload = append(payload, h[:]...)
+	}
+	if err := (&PeerCon{tf: bare}).handleHashes(payload); err != nil {
+		t.Fatalf("hashes reply rejected: %v", err)
+	}
+	for i := range bare.NumPieces() {
+		if !bare.VerifyPiece(i, piece(i)) {
+			t.Fatalf("piece %d does not verify after storing hashes", i)
+		}
+	}
+	if bare.VerifyPiece(2, piece(3)) {
+		t.Fatal("wrong data verified")
+	}
+	forged := append([][32]byte{}, hashes...)
+	forged[0][0] ^= 1
+	if bare.verifyHashes(r, forged) {
+		t.Fatal("forged hashes verified")
+	}
+}
+
+func TestNegativeFileLengthRejected(t *testing.T) {
+	info := bencodeDict(
+		pair{"files", bencodeList(bencodeDict(pair{"length", bencodeInt(-5)}, pair{"path", bencodeList(bencodeString("a"))}))},
+		pair{"name", bencodeString("t")},
+		pair{"piece length", bencodeInt(16384)},
+		pair{"pieces", bencodeString("")},
+	)
+	ben := bencodeDict(pair{"info", info})
+	s, _ := ben.Marshal()
+	if _, err := parseTorrent([]byte(s)); err == nil {
+		t.Fatal("negative file length accepted")
+	}
+	info = bencodeDict(
+		pair{"length", bencodeInt(-1)},
+		pair{"name", bencodeString("t")},
+		pair{"piece length", bencodeInt(16384)},
+		pair{"pieces", bencodeString("")},
+	)
+	ben = bencodeDict(pair{"info", info})
+	s, _ = ben.Marshal()
+	if _, err := parseTorrent([]byte(s)); err == nil {
+		t.Fatal("negative length accepted")
+	}
+}
+
+// A reply made of hashes from a higher layer of the tree, with too short a
+// proof, hashes up to the pieces root but must not pass for piece hashes.
+func TestHashesShortProofRejected(t *testing.T) {
+	pieceLen := 2 * merkleBlockSize
+	data := randomBytes(5*pieceLen + 1000)
+	full := v2Torrent(t, data, pieceLen, true)
+	bare := v2Torrent(t, data, pieceLen, false)
+	f, _ := full.fileByRoot(full.Files[0].PiecesRoot)
+	tree, ok := full.pieceTree(f)
+	if !ok {
+		t.Fatal("no piece tree")
+	}
+	base := uint32(bits.TrailingZeros(uint(full.blocksPerPiece())))
+	children := tree[len(tree)-2]
+	forged := []*HashRequest{
+		{PiecesRoot: f.PiecesRoot, BaseLayer: base, Index: 0, Length: 2},
+		{PiecesRoot: f.PiecesRoot, BaseLayer: base + 2, Index: 0, Length: 2},
+	}
+	for _, r := range forged {
+		payload := r.serialize()
+		for _, h := range children {
+			payload = append(payload, h[:]...)
+		}
+		for _, tf := range []*TorrentFile{full, bare} {
+			if err := (&PeerCon{tf: tf}).handleHashes(payload); err == nil {
+				t.Fatalf("short proof with base layer %d accepted", r.BaseLayer)
+			}
+		}
+	}
+	if bare.pieceHashKnown(0) {
+		t.Fatal("forged hashes stored")
+	}
+	piece := data[:pieceLen]
+	if !full.VerifyPiece(0, piece) {
+		t.Fatal("good piece no longer verifies")
+	}
+	// Even a reply that verified could not replace a known hash.
+	r := &HashRequest{PiecesRoot: f.PiecesRoot, BaseLayer: base, Index: 0, Length: 2}
+	full.storeHashes(r, [][32]byte{{1}, {2}})
+	if !full.VerifyPiece(0, piece) {
+		t.Fatal("known piece hash overwritten")
+	}
+}
@@ -1,32 +1,405 @@
 package torrent
 
 import (
-	"bytes"
-	"crypto/sha1"
 	"fmt"
+	"io"
+	"os"
+	"sync"
 )
 
-func Verify(tf *TorrentFile) error {
-	w, err := NewTorrentWriter(tf, nil)
+type PieceState int
+
+const (
+	PIECE_GOOD PieceState = iota
+	PIECE_BAD
+	PIECE_MISSING
+	PIECE_SKIPPED
+)
+
+func (ps PieceState) String() string {
+	switch ps {
+	case PIECE_GOOD:
+		return "good"
+	case PIECE_BAD:
+		return "bad"
+	case PIECE_MISSING:
+		return "missing"
+	case PIECE_SKIPPED:
+		return "skipped"
+	}
+	return fmt.Sprintf("state(%d)", int(ps))
+}
+
+type VerifyOptions struct {
+	// Workers hash pieces in parallel, Config.DiskWorkers when zero.
+	Workers int
+	// ReadAhead is how many pieces may be read ahead of the hashers.
+	ReadAhead int
+	// Progress, when set, is called after every piece from one goroutine.
+	Progress func(checked int, total int)
+}
+
+type FileReport struct {
+	Path     string
+	Length   int
+	Verified int64
+}
+
+func (fr FileReport) Percent() float64 {
+	if fr.Length == 0 {
+		return 100
+	}
+	return float64(fr.Verified) * 100 / float64(fr.Length)
+}
+
+type VerifyReport struct {
+	Pieces []PieceState
+	Files  []FileReport
+}
+
+func (r *VerifyReport) Count(state PieceState) int {
+	n := 0
+	for _, ps := range r.Pieces {
+		if ps == state {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *VerifyReport) List(state PieceState) []int {
+	var list []int
+	for i, ps := range r.Pieces {
+		if ps == state {
+			list = append(list, i)
+		}
+	}
+	return list
+}
+
+// OK reports whether every piece that was checked is good.
+func (r *VerifyReport) OK() bool {
+	return r.Count(PIECE_BAD) == 0 && r.Count(PIECE_MISSING) == 0
+}
+
+// Good returns a bitfield of the pieces that passed.
+func (r *VerifyReport) Good() Bitfield {
+	bf := make(Bitfield, len(r.Pieces)/8+1)
+	for i, ps := range r.Pieces {
+		if ps == PIECE_GOOD {
+			bf.SetPiece(i)
+		}
+	}
+	return bf
+}
+
+// VerifyTorrent hashes every wanted piece in cfg.Storage and reports the
+// state of each piece and how much of every file checked out. Bad pieces
+// do not stop the check. File and blob storage are only read: nothing is
+// created or allocated, and absent files count as missing.
+func VerifyTorrent(tf *TorrentFile, cfg *Config, opts *VerifyOptions) (*VerifyReport, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = FileStorage{}
+	}
+	s, err := openReadOnly(tf, cfg)
 	if err != nil {
-		return fmt.Errorf("failed to initialize writer: %v", err)
+		return nil, fmt.Errorf("failed to open storage: %v", err)
+	}
+	defer s.Close()
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = cfg.DiskWorkers
+	}
+	return verifyStorage(tf, s, tf.piecePriorities(cfg.filePriority), workers, opts.ReadAhead, opts.Progress), nil
+}
+
+// Verify checks the torrent's data and returns an error describing what is
+// wrong with it, if anything.
+func Verify(tf *TorrentFile, cfg *Config) error {
+	report, err := VerifyTorrent(tf, cfg, nil)
+	if err != nil {
+		return err
+	}
+	if !report.OK() {
+		return fmt.Errorf("verification failed: %d bad and %d missing pieces", report.Count(PIECE_BAD), report.Count(PIECE_MISSING))
+	}
+	return nil
+}
+
+type readResult struct {
+	index int
+	data  []byte
+	err   error
+}
+
+// verifyStorage reads pieces in order on one goroutine, which keeps disk
+// access sequential, while workers hash up to readAhead pieces behind it.
+func verifyStorage(tf *TorrentFile, s TorrentStorage, prio []FilePriority, workers int, readAhead int, progress func(int, int)) *VerifyReport {
+	if workers <= 0 {
+		workers = DISK_WORKERS
+	}
+	if readAhead <= 0 {
+		readAhead = VERIFY_READ_AHEAD
+	}
+	numPieces := tf.NumPieces()
+	report := &VerifyReport{Pieces: make([]PieceState, numPieces)}
+	total := 0
+	for i := range numPieces {
+		if prio[i] == PRIORITY_SKIP {
+			report.Pieces[i] = PIECE_SKIPPED
+		} else {
+			total++
+		}
 	}
-	fmt.Printf("Verifying %d pieces...\n", len(tf.PieceHashes))
-	for i, expectedHash := range tf.PieceHashes {
-		pieceLen := tf.PieceLength
-		if i == len(tf.PieceHashes)-1 {
-			pieceLen = tf.Length - (i * tf.PieceLength)
+
+	reads := make(chan readResult, readAhead)
+	go func() {
+		defer close(reads)
+		for i := range numPieces {
+			if prio[i] == PRIORITY_SKIP {
+				continue
+			}
+			data, err := readPiece(s, i, 0, tf.PieceSize(i))
+			reads <- readResult{index: i, data: data, err: err}
+		}
+	}()
+
+	type hashResult struct {
+		index int
+		state PieceState
+	}
+	results := make(chan hashResult, workers)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range reads {
+				state := PIECE_BAD
+				switch {
+				case r.err == nil && tf.VerifyPiece(r.index, r.data):
+					state = PIECE_GOOD
+				case r.err != nil || allZero(r.data):
+					state = PIECE_MISSING
+				}
+				results <- hashResult{index: r.index, state: state}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	checked := 0
+	for r := range results {
+		report.Pieces[r.index] = r.state
+		checked++
+		if progress != nil {
+			progress(checked, total)
+		}
+	}
+	report.Files = fileReports(tf, report.Pieces)
+	return report
+}
+
+// allZero tells never-written pieces in preallocated files apart from
+// corrupt ones.
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func fileReports(tf *TorrentFile, pieces []PieceState) []FileReport {
+	pieceLen := int64(tf.PieceLength)
+	reports := make([]FileReport, 0, len(tf.Files))
+	offset := int64(0)
+	for _, f := range tf.Files {
+		start, end := offset, offset+int64(f.Length)
+		offset = end
+		if f.Padding {
+			continue
+		}
+		fr := FileReport{Path: f.Path, Length: f.Length}
+		for p := start / pieceLen; p*pieceLen < end; p++ {
+			if pieces[p] != PIECE_GOOD {
+				continue
+			}
+			fr.Verified += min(end, (p+1)*pieceLen) - max(start, p*pieceLen)
+		}
+		reports = append(reports, fr)
+	}
+	return reports
+}
+
+// openReadOnly opens file and blob storage for reading only. Other storages
+// are opened as usual.
+func openReadOnly(tf *TorrentFile, cfg *Config) (TorrentStorage, error) {
+	root := cfg.DownloadDir
+	if root == "" {
+		root = "."
+	}
+	r := &readOnlyTorrent{tf: tf}
+	switch st := cfg.Storage.(type) {
+	case FileStorage:
+		stageRoot := root
+		if cfg.IncompleteDir != "" {
+			stageRoot = cfg.IncompleteDir
 		}
-		data, err := w.Read(i, 0, pieceLen)
+		partPath, err := confinePath(stageRoot, "."+tf.Name+".parts")
 		if err != nil {
-			return fmt.Errorf("failed to read piece %d: %v (file missing or corrupt?)", i, err)
+			return nil, err
+		}
+		if r.part, err = openIfExists(partPath); err != nil {
+			r.Close()
+			return nil, err
 		}
-		hash := sha1.Sum(data)
-		if !bytes.Equal(hash[:], expectedHash[:]) {
-			return fmt.Errorf("verification failed at piece %d: hash mismatch", i)
+		for i, f := range tf.Files {
+			span := readOnlySpan{length: int64(f.Length), padding: f.Padding}
+			switch {
+			case f.Padding || f.SymlinkPath != "":
+			case cfg.filePriority(i) == PRIORITY_SKIP:
+				span.part = true
+			default:
+				// A staged file is used until it has been moved.
+				rel := f.Path
+				if cfg.PartSuffix {
+					rel += PART_SUFFIX
+				}
+				final, err := confinePath(root, f.Path)
+				if err != nil {
+					r.Close()
+					return nil, err
+				}
+				stage, err := confinePath(stageRoot, rel)
+				if err != nil {
+					r.Close()
+					return nil, err
+				}
+				for _, path := range []string{stage, final} {
+					if span.f, err = openIfExists(path); err != nil || span.f != nil {
+						break
+					}
+				}
+				if err != nil {
+					r.Close()
+					return nil, err
+				}
+			}
+			r.spans = append(r.spans, span)
+		}
+		return r, nil
+	case BlobStorage:
+		path := st.Path
+		if path == "" {
+			p, err := confinePath(root, blobName(tf))
+			if err != nil {
+				return nil, err
+			}
+			path = p
+		}
+		f, err := openIfExists(path)
+		if err != nil {
+			return nil, err
 		}
-		fmt.Printf("\rVerified: %d/%d pieces", i+1, len(tf.PieceHashes))
+		r.spans = []readOnlySpan{{f: f, length: int64(tf.Length)}}
+		return r, nil
+	}
+	return cfg.Storage.OpenTorrent(tf, cfg)
+}
+
+// openIfExists opens path for reading, returning nil when it is absent.
+func openIfExists(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|openNoFollow, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return f, err
+}
+
+// readOnlySpan is one backing file of a readOnlyTorrent, in torrent order.
+// Skipped files are read from the partfile and padding reads as zeros.
+type readOnlySpan struct {
+	f       *os.File
+	length  int64
+	padding bool
+	part    bool
+}
+
+// readOnlyTorrent reads torrent data where a download left it without ever
+// writing. Reads touching an absent file fail, so its pieces count as
+// missing.
+type readOnlyTorrent struct {
+	tf    *TorrentFile
+	spans []readOnlySpan
+	part  *os.File
+}
+
+func (r *readOnlyTorrent) ReadAt(index int, p []byte, begin int64) (int, error) {
+	if index < 0 || index >= r.tf.NumPieces() || begin < 0 || begin+int64(len(p)) > int64(r.tf.PieceSize(index)) {
+		return 0, fmt.Errorf("range outside piece %d", index)
+	}
+	off := int64(index)*int64(r.tf.PieceLength) + begin
+	n := 0
+	start := int64(0)
+	for _, s := range r.spans {
+		end := start + s.length
+		if n < len(p) && off+int64(n) < end {
+			pos := off + int64(n)
+			chunk := p[n:min(len(p), n+int(end-pos))]
+			var err error
+			switch {
+			case s.padding:
+				clear(chunk)
+			case s.part && r.part != nil:
+				_, err = r.part.ReadAt(chunk, pos)
+			case s.part || s.f == nil:
+				err = os.ErrNotExist
+			default:
+				_, err = s.f.ReadAt(chunk, pos-start)
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return n, err
+			}
+			n += len(chunk)
+		}
+		start = end
+	}
+	if n < len(p) {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+func (r *readOnlyTorrent) WriteAt(index int, p []byte, begin int64) (int, error) {
+	return 0, fmt.Errorf("storage is read only")
+}
+
+func (r *readOnlyTorrent) MarkComplete(index int) error {
+	return nil
+}
+
+func (r *readOnlyTorrent) Close() error {
+	for _, s := range r.spans {
+		if s.f != nil {
+			s.f.Close()
+		}
+	}
+	if r.part != nil {
+		r.part.Close()
 	}
-	fmt.Println("\nVerification successful! Files are intact.")
 	return nil
 }
@@ -0,0 +1,101 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// verifyTree writes the files of a three file torrent under dir and
+// returns the torrent. a ends inside piece 0 and c starts inside piece 2.
+func verifyTree(t *testing.T, dir string) *TorrentFile {
+	t.Helper()
+	files := []testFile{
+		{[]string{"a"}, randomBytes(10000)},
+		{[]string{"b"}, randomBytes(30000)},
+		{[]string{"c"}, randomBytes(20000)},
+	}
+	tf, _ := makeTorrent(t, "t", 16384, files)
+	for _, f := range files {
+		path := filepath.Join(dir, "t", f.path[0])
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, f.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tf
+}
+
+func TestVerifyTorrent(t *testing.T) {
+	tests := []struct {
+		name    string
+		damage  func(dir string) error
+		bad     []int
+		missing []int
+	}{
+		{name: "good"},
+		{name: "corrupted byte", damage: func(dir string) error {
+			// b starts 10000 bytes in, so its byte 20000 is in piece 1.
+			path := filepath.Join(dir, "t", "b")
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			data[20000] ^= 1
+			return os.WriteFile(path, data, 0644)
+		}, bad: []int{1}},
+		{name: "missing file", damage: func(dir string) error {
+			return os.Remove(filepath.Join(dir, "t", "c"))
+		}, missing: []int{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tf := verifyTree(t, dir)
+			if tt.damage != nil {
+				if err := tt.damage(dir); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := DefaultConfig()
+			cfg.DownloadDir = dir
+			report, err := VerifyTorrent(tf, cfg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := report.List(PIECE_BAD); !slices.Equal(got, tt.bad) {
+				t.Errorf("bad pieces %v, want %v", got, tt.bad)
+			}
+			if got := report.List(PIECE_MISSING); !slices.Equal(got, tt.missing) {
+				t.Errorf("missing pieces %v, want %v", got, tt.missing)
+			}
+			if report.OK() != (tt.bad == nil && tt.missing == nil) {
+				t.Errorf("OK() = %v", report.OK())
+			}
+			if _, err := os.Stat(filepath.Join(dir, "t", "c")); tt.missing != nil && !os.IsNotExist(err) {
+				t.Error("verify created the missing file")
+			}
+		})
+	}
+}
+
+// Verifying data that is not there changes nothing on disk.
+func TestVerifyCreatesNothing(t *testing.T) {
+	tf := verifyTree(t, t.TempDir())
+	for _, st := range []Storage{FileStorage{}, BlobStorage{}} {
+		cfg := DefaultConfig()
+		cfg.DownloadDir = filepath.Join(t.TempDir(), "absent")
+		cfg.Storage = st
+		report, err := VerifyTorrent(tf, cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := report.Count(PIECE_MISSING); n != tf.NumPieces() {
+			t.Errorf("%T: %d of %d pieces missing", st, n, tf.NumPieces())
+		}
+		if _, err := os.Stat(cfg.DownloadDir); !os.IsNotExist(err) {
+			t.Errorf("%T: verify created the download directory", st)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// httpSource fetches whole pieces over HTTP. Web seeds and HTTP seeds are
+// driven by the same picker as peers, one piece at a time.
+type httpSource interface {
+	fetchPiece(ctx context.Context, index int) ([]byte, error)
+}
+
+// webSeed is a GetRight style web seed (BEP 19): a plain HTTP server
+// holding the torrent's files under the url-list URL.
+type webSeed struct {
+	url    string
+	tf     *TorrentFile
+	client *http.Client
+}
+
+func newWebSeed(u string, tf *TorrentFile) *webSeed {
+	return &webSeed{url: u, tf: tf, client: &http.Client{Timeout: WEBSEED_TIMEOUT}}
+}
+
+// fileURL is where the server keeps file i. A single file torrent's URL
+// names the file itself unless it ends in a slash; otherwise the torrent
+// name and file path are appended.
+func (ws *webSeed) fileURL(i int) string {
+	f := ws.tf.Files[i]
+	if len(ws.tf.Files) == 1 && f.Path == ws.tf.Name && !strings.HasSuffix(ws.url, "/") {
+		return ws.url
+	}
+	parts := strings.Split(filepath.ToSlash(f.Path), "/")
+	for j, p := range parts {
+		parts[j] = url.PathEscape(p)
+	}
+	base := ws.url
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + strings.Join(parts, "/")
+}
+
+// fetchPiece reads the piece with one Range request per file it spans,
+// laid out exactly as TorrentWriter stores it. Padding files are zeros and
+// are never requested.
+func (ws *webSeed) fetchPiece(ctx context.Context, index int) ([]byte, error) {
+	start := int64(index) * int64(ws.tf.PieceLength)
+	data := make([]byte, ws.tf.PieceSize(index))
+	end := start + int64(len(data))
+	offset := int64(0)
+	for i, f := range ws.tf.Files {
+		fileEnd := offset + int64(f.Length)
+		if fileEnd > start && offset < end && !f.Padding && f.SymlinkPath == "" {
+			from := max(start, offset)
+			to := min(end, fileEnd)
+			if err := ws.fetchRange(ctx, i, from-offset, data[from-start:to-start]); err != nil {
+				return nil, err
+			}
+		}
+		offset = fileEnd
+	}
+	return data, nil
+}
+
+func (ws *webSeed) fetchRange(ctx context.Context, i int, begin int64, buf []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ws.fileURL(i), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", begin, begin+int64(len(buf))-1))
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && begin == 0 && len(buf) == ws.tf.Files[i].Length:
+		// A server that ignores Range is fine when we want the whole file.
+	default:
+		return fmt.Errorf("web seed returned %s for %s", resp.Status, req.URL)
+	}
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return fmt.Errorf("couldnt read from web seed: %v", err)
+	}
+	return nil
+}
+
+// runHTTPSource downloads pieces from src until the torrent is complete.
+// Each failure, including a piece that fails its hash check, doubles the
+// pause before the next attempt, starting from base; a good piece resets
+// it. A seed that says it is busy is left alone for as long as it asks
+// instead. Pieces are hashed here, so the disk workers do not hash them
+// again.
+func (d *Downloader) runHTTPSource(src httpSource, base time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-d.downloadOver
+		cancel()
+	}()
+	all := make(Bitfield, len(d.field))
+	for i := range d.tf.NumPieces() {
+		all.SetPiece(i)
+	}
+	backoff := base
+	for {
+		index, found := d.PickPiece(all)
+		if !found {
+			select {
+			case <-d.downloadOver:
+				return
+			case <-time.After(1 * time.Second):
+			}
+			continue
+		}
+		d.Stats.CurrentlyDownloading.Add(1)
+		data, err := src.fetchPiece(ctx, index)
+		d.Stats.CurrentlyDownloading.Add(-1)
+		if err == nil && !d.tf.VerifyPiece(index, data) {
+			err = fmt.Errorf("piece %d failed hash check", index)
+		}
+		if err != nil {
+			d.mu.Lock()
+			d.requested.ClearPiece(index)
+			d.mu.Unlock()
+			wait := backoff
+			var busy *retryAfterError
+			if errors.As(err, &busy) {
+				wait = busy.wait
+			} else {
+				d.Stats.Failed.Add(1)
+				backoff = min(2*backoff, MAX_WEBSEED_BACKOFF)
+			}
+			select {
+			case <-d.downloadOver:
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+		backoff = base
+		// Blocks peers sent for this piece earlier are no longer needed.
+		d.mu.Lock()
+		delete(d.partial, index)
+		d.markAssembled(index)
+		d.mu.Unlock()
+		select {
+		case d.pieceQueue <- Piece{id: int64(index), data: data, verified: true}:
+		case <-d.downloadOver:
+			return
+		}
+	}
+}
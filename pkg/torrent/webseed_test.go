@@ -0,0 +1,126 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fileServer serves the files of a torrent by path, with Range support,
+// and records every request.
+type fileServer struct {
+	files map[string][]byte
+	mu    sync.Mutex
+	reqs  []string
+	// fail, when set, can answer a request instead.
+	fail func(w http.ResponseWriter) bool
+}
+
+func (fs *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	fs.reqs = append(fs.reqs, r.URL.Path+" "+r.Header.Get("Range"))
+	fail := fs.fail
+	fs.mu.Unlock()
+	if fail != nil && fail(w) {
+		return
+	}
+	data, ok := fs.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (fs *fileServer) requests() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]string{}, fs.reqs...)
+}
+
+func TestWebSeedPieceAcrossFiles(t *testing.T) {
+	files := []testFile{
+		{[]string{"a"}, randomBytes(10000)},
+		{[]string{"dir", "b c"}, randomBytes(30000)},
+	}
+	tf, all := makeTorrent(t, "t", 16384, files)
+	fs := &fileServer{files: map[string][]byte{"/seed/t/a": files[0].data, "/seed/t/dir/b c": files[1].data}}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	ws := newWebSeed(srv.URL+"/seed/", tf)
+	data, err := ws.fetchPiece(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, all[:16384]) {
+		t.Fatal("piece spanning two files assembled wrongly")
+	}
+	want := []string{"/seed/t/a bytes=0-9999", "/seed/t/dir/b c bytes=0-6383"}
+	if got := fs.requests(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("requests %q, want %q", got, want)
+	}
+	data, err = ws.fetchPiece(context.Background(), tf.NumPieces()-1)
+	if err != nil || !bytes.Equal(data, all[2*16384:]) {
+		t.Fatalf("last piece: %v", err)
+	}
+}
+
+func TestWebSeedSingleFileURL(t *testing.T) {
+	tf, all := makeTorrent(t, "file.bin", 16384, []testFile{{nil, randomBytes(20000)}})
+	fs := &fileServer{files: map[string][]byte{"/file.bin": all}}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	data, err := newWebSeed(srv.URL+"/file.bin", tf).fetchPiece(context.Background(), 1)
+	if err != nil || !bytes.Equal(data, all[16384:]) {
+		t.Fatalf("piece from a single file url: %v", err)
+	}
+}
+
+// A seed answering 5xx is retried after a pause that doubles with every
+// failure, and the download completes once it recovers.
+func TestWebSeedBackoff(t *testing.T) {
+	const base = 100 * time.Millisecond
+	tf, all := makeTorrent(t, "file.bin", 16384, []testFile{{nil, randomBytes(16384)}})
+	var mu sync.Mutex
+	var times []time.Time
+	fs := &fileServer{files: map[string][]byte{"/file.bin": all}}
+	fs.fail = func(w http.ResponseWriter) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		if len(times) <= 3 {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return true
+		}
+		return false
+	}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	d := testDownloader(t, tf)
+	go d.runHTTPSource(newWebSeed(srv.URL+"/file.bin", tf), base)
+	select {
+	case <-d.downloadOver:
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not complete after the seed recovered")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) != 4 {
+		t.Fatalf("%d requests, want 4", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		gap := times[i].Sub(times[i-1])
+		want := base << (i - 1)
+		if gap < want || gap > want+base {
+			t.Errorf("retry %d after %v, want about %v", i, gap, want)
+		}
+	}
+	if got := d.Stats.Failed.Load(); got != 3 {
+		t.Errorf("%d failures counted, want 3", got)
+	}
+}
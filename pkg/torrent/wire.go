@@ -0,0 +1,95 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// payloadLen is the exact payload size of every fixed-size message.
+var payloadLen = map[MessageID]int{
+	CHOKE:          0,
+	UNCHOKE:        0,
+	INTERESTED:     0,
+	NOT_INTERESTED: 0,
+	HAVE:           4,
+	REQUEST:        12,
+	CANCEL:         12,
+	HAVE_ALL:       0,
+	HAVE_NONE:      0,
+	SUGGEST_PIECE:  4,
+	REJECT_REQUEST: 12,
+	ALLOWED_FAST:   4,
+}
+
+func isFastMessage(id MessageID) bool {
+	return id >= SUGGEST_PIECE && id <= ALLOWED_FAST
+}
+
+// validateMessage checks a message against the wire protocol before it is
+// acted on. first is true until the peer has sent something other than an
+// extension handshake, which is the only time it may describe its pieces
+// with BITFIELD, HAVE_ALL or HAVE_NONE. Any error means the peer broke the
+// protocol and should be dropped.
+func (p *PeerCon) validateMessage(msg *Message, first bool) error {
+	if want, ok := payloadLen[msg.ID]; ok && len(msg.Payload) != want {
+		return fmt.Errorf("message %d has %d byte payload, want %d", msg.ID, len(msg.Payload), want)
+	}
+	if isFastMessage(msg.ID) && !p.peerFast {
+		return fmt.Errorf("fast extension message %d from non-fast peer", msg.ID)
+	}
+	switch msg.ID {
+	case BITFIELD, HAVE_ALL, HAVE_NONE:
+		if !first {
+			return fmt.Errorf("message %d after the first message", msg.ID)
+		}
+		if msg.ID == BITFIELD {
+			return validBitfield(msg.Payload, p.tf.NumPieces())
+		}
+	case PIECE:
+		if len(msg.Payload) < 8 {
+			return fmt.Errorf("piece message too short")
+		}
+		fallthrough
+	case HAVE, REQUEST, CANCEL, SUGGEST_PIECE, REJECT_REQUEST, ALLOWED_FAST:
+		if index := binary.BigEndian.Uint32(msg.Payload[0:4]); index >= uint32(p.tf.NumPieces()) {
+			return fmt.Errorf("message %d for piece %d out of range", msg.ID, index)
+		}
+	case EXTENDED:
+		if len(msg.Payload) < 1 {
+			return fmt.Errorf("empty extended message")
+		}
+	}
+	return nil
+}
+
+// validBitfield requires exactly one bit per piece, rounded up to whole
+// bytes, with the spare bits at the end cleared.
+func validBitfield(bf []byte, numPieces int) error {
+	if len(bf) != (numPieces+7)/8 {
+		return fmt.Errorf("bitfield is %d bytes, want %d", len(bf), (numPieces+7)/8)
+	}
+	if spare := numPieces % 8; spare != 0 && bf[len(bf)-1]&(0xff>>spare) != 0 {
+		return fmt.Errorf("bitfield has spare bits set")
+	}
+	return nil
+}
+
+// keepAlive sends an empty message whenever nothing else has been sent for
+// interval, so the peer does not drop us as idle.
+func (p *PeerCon) keepAlive(stop chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, p.lastSend.Load())) >= interval {
+				if p.SendMessage(nil) != nil {
+					return
+				}
+			}
+		}
+	}
+}
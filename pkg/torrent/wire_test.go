@@ -0,0 +1,183 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func rawMsg(id MessageID, payload ...byte) []byte {
+	return (&Message{ID: id, Payload: payload}).Serialize()
+}
+
+func haveMsg(index int) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return rawMsg(HAVE, payload...)
+}
+
+// TestWireSequences feeds scripted message sequences to DownloadLoop and
+// checks whether the peer is kept or dropped.
+func TestWireSequences(t *testing.T) {
+	// 20 pieces: a 3 byte bitfield whose last 4 bits are spare.
+	const numPieces = 20
+	oversized := make([]byte, 4)
+	binary.BigEndian.PutUint32(oversized, MAX_MSG_LEN+1)
+	tests := []struct {
+		name   string
+		fast   bool
+		script [][]byte
+		drop   bool
+		// check runs on a kept peer once the script has been read.
+		check func(t *testing.T, p *PeerCon)
+	}{
+		{name: "keep-alive", script: [][]byte{make([]byte, 4), make([]byte, 4)}},
+		{name: "bitfield", script: [][]byte{rawMsg(BITFIELD, 0xff, 0x00, 0xf0)}, check: func(t *testing.T, p *PeerCon) {
+			if !p.peerPieces().HasPiece(19) || p.peerPieces().HasPiece(8) {
+				t.Error("bitfield not applied")
+			}
+		}},
+		{name: "have before bitfield", script: [][]byte{haveMsg(3), haveMsg(19)}, check: func(t *testing.T, p *PeerCon) {
+			if !p.peerPieces().HasPiece(3) || !p.peerPieces().HasPiece(19) {
+				t.Error("HAVE from a peer without a bitfield ignored")
+			}
+		}},
+		{name: "extended handshake before bitfield", script: [][]byte{rawMsg(EXTENDED, 0, 'd', 'e'), rawMsg(BITFIELD, 0, 0, 0)}},
+		{name: "bitfield after have", script: [][]byte{haveMsg(3), rawMsg(BITFIELD, 0xff, 0xff, 0xf0)}, drop: true},
+		{name: "second bitfield", script: [][]byte{rawMsg(BITFIELD, 0, 0, 0), rawMsg(BITFIELD, 0, 0, 0)}, drop: true},
+		{name: "spare bits set", script: [][]byte{rawMsg(BITFIELD, 0xff, 0xff, 0xf8)}, drop: true},
+		{name: "short bitfield", script: [][]byte{rawMsg(BITFIELD, 0xff, 0xff)}, drop: true},
+		{name: "long bitfield", script: [][]byte{rawMsg(BITFIELD, 0xff, 0xff, 0xf0, 0)}, drop: true},
+		{name: "short have", script: [][]byte{rawMsg(HAVE, 0, 0, 1)}, drop: true},
+		{name: "have out of range", script: [][]byte{haveMsg(numPieces)}, drop: true},
+		{name: "short request", script: [][]byte{rawMsg(REQUEST, make([]byte, 11)...)}, drop: true},
+		{name: "long cancel", script: [][]byte{rawMsg(CANCEL, make([]byte, 13)...)}, drop: true},
+		{name: "choke with payload", script: [][]byte{rawMsg(CHOKE, 0)}, drop: true},
+		{name: "short piece", script: [][]byte{rawMsg(PIECE, 0, 0, 0, 0, 0, 0, 0)}, drop: true},
+		{name: "empty extended", script: [][]byte{rawMsg(EXTENDED)}, drop: true},
+		{name: "oversized length", script: [][]byte{oversized}, drop: true},
+		{name: "fast message from plain peer", script: [][]byte{rawMsg(HAVE_NONE)}, drop: true},
+		{name: "have all", fast: true, script: [][]byte{rawMsg(HAVE_ALL)}, check: func(t *testing.T, p *PeerCon) {
+			if !p.peerPieces().HasPiece(numPieces - 1) {
+				t.Error("HAVE_ALL not applied")
+			}
+		}},
+		{name: "have none then have", fast: true, script: [][]byte{rawMsg(HAVE_NONE), haveMsg(5)}},
+		{name: "have all after have", fast: true, script: [][]byte{haveMsg(5), rawMsg(HAVE_ALL)}, drop: true},
+		{name: "short reject", fast: true, script: [][]byte{rawMsg(REJECT_REQUEST, make([]byte, 8)...)}, drop: true},
+		{name: "interest", script: [][]byte{rawMsg(INTERESTED), rawMsg(NOT_INTERESTED), rawMsg(INTERESTED)}, check: func(t *testing.T, p *PeerCon) {
+			if p.amChoking.Load() {
+				t.Error("interested peer left choked")
+			}
+		}},
+		{name: "cancel unknown block", script: [][]byte{requestMsg(CANCEL, 1, 0, REQUEST_BLOCK_SIZE).Serialize()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf, _ := makeTorrent(t, "t", REQUEST_BLOCK_SIZE, []testFile{{nil, randomBytes(numPieces * REQUEST_BLOCK_SIZE)}})
+			d := testDownloader(t, tf)
+			p, remote := pipePeer(t, d)
+			p.peerFast = tt.fast
+			done := make(chan struct{})
+			go func() {
+				p.DownloadLoop(d)
+				close(done)
+			}()
+			go io.Copy(io.Discard, remote)
+			for _, b := range tt.script {
+				remote.SetWriteDeadline(time.Now().Add(time.Second))
+				if _, err := remote.Write(b); err != nil {
+					break
+				}
+			}
+			select {
+			case <-done:
+				if !tt.drop {
+					t.Fatal("peer dropped")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.drop {
+					t.Fatal("peer kept")
+				}
+				if tt.check != nil {
+					tt.check(t, p)
+				}
+			}
+		})
+	}
+}
+
+// A keep-alive goes out once nothing else has been sent for the interval,
+// and never while other messages keep the connection busy.
+func TestKeepAliveTiming(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	tf, _ := makeTorrent(t, "t", REQUEST_BLOCK_SIZE, []testFile{{nil, randomBytes(REQUEST_BLOCK_SIZE)}})
+	d := testDownloader(t, tf)
+	p, remote := pipePeer(t, d)
+	go p.writeLoop()
+	defer p.out.close()
+	stop := make(chan struct{})
+	defer close(stop)
+	p.lastSend.Store(time.Now().UnixNano())
+	go p.keepAlive(stop, interval)
+
+	busyUntil := time.Now().Add(3 * interval)
+	go func() {
+		for time.Now().Before(busyUntil) {
+			p.SendMessage(&Message{ID: UNCHOKE})
+			time.Sleep(interval / 4)
+		}
+	}()
+	for {
+		msg := readWire(t, remote)
+		if msg == nil {
+			if time.Now().Before(busyUntil) {
+				t.Fatal("keep-alive sent while other messages were going out")
+			}
+			break
+		}
+	}
+	idleSince := time.Unix(0, p.lastSend.Load())
+	start := time.Now()
+	if msg := readWire(t, remote); msg != nil {
+		t.Fatalf("got message %d, want a keep-alive", msg.ID)
+	}
+	if gap := time.Since(idleSince); gap < interval {
+		t.Fatalf("second keep-alive after %v idle, want at least %v", gap, interval)
+	}
+	if time.Since(start) > 2*interval {
+		t.Fatal("second keep-alive late")
+	}
+}
+
+// We become interested when the peer announces a piece we want and say
+// NOT_INTERESTED once everything it has is finished, before it ever
+// serves us.
+func TestInterestFollowsWantedPieces(t *testing.T) {
+	tf, all := makeTorrent(t, "t", REQUEST_BLOCK_SIZE, []testFile{{nil, randomBytes(4 * REQUEST_BLOCK_SIZE)}})
+	d := testDownloader(t, tf)
+	p, remote := pipePeer(t, d)
+	go p.DownloadLoop(d)
+	writeWire(t, remote, &Message{ID: HAVE, Payload: []byte{0, 0, 0, 1}})
+	for _, msg := range readUntil(t, remote, INTERESTED) {
+		if msg != nil && msg.ID == NOT_INTERESTED {
+			t.Fatal("NOT_INTERESTED before interest")
+		}
+	}
+	// Pieces 1 and 2 arrive from elsewhere; a HAVE for a piece we no
+	// longer want must not change anything on its own.
+	storeAll(d, all, 0, 3)
+	writeWire(t, remote, &Message{ID: HAVE, Payload: []byte{0, 0, 0, 2}}, &Message{ID: UNCHOKE})
+	go d.startRequestWorker(p, make(chan struct{}))
+	for _, msg := range readUntil(t, remote, NOT_INTERESTED) {
+		if msg != nil && msg.ID == REQUEST {
+			t.Fatal("requested a piece we already have")
+		}
+	}
+	if p.amInterested.Load() {
+		t.Fatal("still interested after NOT_INTERESTED")
+	}
+	writeWire(t, remote, &Message{ID: HAVE, Payload: []byte{0, 0, 0, 3}})
+	readUntil(t, remote, INTERESTED)
+}
@@ -8,40 +8,278 @@ import (
 )
 
 type TorrentWriter struct {
-	tf *TorrentFile
-	mu sync.Mutex
-	d  *Downloader
+	tf        *TorrentFile
+	mu        sync.Mutex
+	root      string
+	stageRoot string
+	// moveMu guards paths and moved; reads and writes hold it shared so a
+	// file is never renamed underneath them.
+	moveMu   sync.RWMutex
+	paths    []string
+	finals   []string
+	moved    []bool
+	have     Bitfield
+	eachFile bool
+	skipped  []bool
+	partPath string
+	handles  *handleCache
+	cache    *writeCache
+	alloc    AllocMode
 }
 
-func NewTorrentWriter(tf *TorrentFile, d *Downloader) (*TorrentWriter, error) {
-	for _, f := range tf.Files {
-		dir := filepath.Dir(f.Path)
-		if dir != "." && dir != "/" {
-			if err := os.MkdirAll(dir, 0755); err != nil {
-				return nil, fmt.Errorf("failed to create directory %s: %v", dir, err)
-			}
+func NewTorrentWriter(tf *TorrentFile, cfg *Config) (*TorrentWriter, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	root := cfg.DownloadDir
+	if root == "" {
+		root = "."
+	}
+	stageRoot := root
+	if cfg.IncompleteDir != "" {
+		stageRoot = cfg.IncompleteDir
+	}
+	for _, dir := range []string{root, stageRoot} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create download directory %s: %v", dir, err)
+		}
+	}
+	partPath, err := confinePath(stageRoot, "."+tf.Name+".parts")
+	if err != nil {
+		return nil, err
+	}
+	w := &TorrentWriter{
+		tf:        tf,
+		root:      root,
+		stageRoot: stageRoot,
+		paths:     make([]string, len(tf.Files)),
+		finals:    make([]string, len(tf.Files)),
+		moved:     make([]bool, len(tf.Files)),
+		have:      make(Bitfield, tf.NumPieces()/8+1),
+		eachFile:  cfg.MoveEachFile,
+		skipped:   make([]bool, len(tf.Files)),
+		partPath:  partPath,
+		handles:   newHandleCache(cfg.OpenFiles),
+		alloc:     cfg.Allocation,
+	}
+	w.cache = newWriteCache(cfg.WriteCacheSize, w.handles)
+	for i, f := range tf.Files {
+		final, err := confinePath(root, f.Path)
+		if err != nil {
+			return nil, err
 		}
-		file, err := os.OpenFile(f.Path, os.O_RDWR|os.O_CREATE, 0644)
+		rel := f.Path
+		if cfg.PartSuffix && !f.Padding && f.SymlinkPath == "" {
+			rel += PART_SUFFIX
+		}
+		stage, err := confinePath(stageRoot, rel)
 		if err != nil {
-			return nil, fmt.Errorf("failed to open file %s: %v", f.Path, err)
+			return nil, err
 		}
-		if err := file.Truncate(int64(f.Length)); err != nil {
-			file.Close()
-			return nil, fmt.Errorf("failed to allocate space for %s: %v", f.Path, err)
+		w.finals[i] = final
+		w.paths[i] = stage
+		if stage == final || f.Padding || f.SymlinkPath != "" {
+			w.paths[i] = final
+			w.moved[i] = true
+		} else {
+			// A file already moved by an earlier run is used where it is.
+			if _, err := os.Stat(stage); os.IsNotExist(err) {
+				if _, err := os.Stat(final); err == nil {
+					w.paths[i] = final
+					w.moved[i] = true
+				}
+			}
 		}
-		file.Close()
+		w.skipped[i] = cfg.filePriority(i) == PRIORITY_SKIP
+	}
+	if err := checkFreeSpace(stageRoot, requiredSpace(tf, cfg, w.paths)); err != nil {
+		return nil, err
+	}
+	// Across filesystems staged files are copied rather than renamed into
+	// the download directory, so it needs room for all of them as well.
+	if !sameDevice(stageRoot, root) {
+		if err := checkFreeSpace(root, requiredSpace(tf, cfg, w.finals)); err != nil {
+			return nil, err
+		}
+	}
+	for i, f := range tf.Files {
+		if f.Padding || f.SymlinkPath != "" || w.skipped[i] {
+			continue
+		}
+		if err := w.createFile(i); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+func (w *TorrentWriter) createFile(i int) error {
+	path := w.paths[i]
+	dir := filepath.Dir(path)
+	root := w.stageRoot
+	if w.moved[i] {
+		root = w.root
+	}
+	if err := checkNoSymlinkEscape(root, dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+	if err := checkNotSymlink(path); err != nil {
+		return err
 	}
-	return &TorrentWriter{
-		tf: tf,
-		d:  d,
-	}, nil
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|openNoFollow, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %v", path, err)
+	}
+	defer file.Close()
+	if err := allocateFile(file, int64(w.tf.Files[i].Length), w.alloc); err != nil {
+		return fmt.Errorf("failed to allocate space for %s: %v", path, err)
+	}
+	return nil
+}
+
+// SetSkipped moves a file in or out of the partfile. A skipped file is
+// removed from disk; only its bytes in the boundary pieces it shares with
+// other files are kept, in the partfile at their global torrent offset, and
+// unskipping copies them back out.
+func (w *TorrentWriter) SetSkipped(i int, skip bool) error {
+	w.moveMu.Lock()
+	defer w.moveMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.skipped[i] == skip {
+		return nil
+	}
+	f := w.tf.Files[i]
+	if f.Padding || f.SymlinkPath != "" {
+		w.skipped[i] = skip
+		return nil
+	}
+	start := w.tf.FileOffset(i)
+	if err := w.cache.flush(w.partPath, os.O_CREATE, false); err != nil {
+		return err
+	}
+	path := w.paths[i]
+	if skip {
+		if _, err := os.Stat(path); err == nil {
+			for _, r := range w.boundaryRanges(i) {
+				if err := w.copyRange(r[0], r[1]-r[0], func(buf []byte, off int64) error {
+					return w.cache.read(path, buf, off, false)
+				}, func(buf []byte, off int64) error {
+					return w.writePart(buf, start+off)
+				}); err != nil {
+					return err
+				}
+			}
+		}
+		w.cache.forget(path)
+		w.handles.forget(path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove skipped file %s: %v", path, err)
+		}
+		w.clearInterior(i)
+		w.skipped[i] = true
+		return nil
+	}
+	if err := w.createFile(i); err != nil {
+		return err
+	}
+	for _, r := range w.boundaryRanges(i) {
+		if err := w.copyRange(r[0], r[1]-r[0], func(buf []byte, off int64) error {
+			part, err := w.readPart(start+off, len(buf))
+			copy(buf, part)
+			return err
+		}, func(buf []byte, off int64) error {
+			return w.writeToFile(path, buf, off)
+		}); err != nil {
+			return err
+		}
+	}
+	w.skipped[i] = false
+	for _, s := range w.skipped {
+		if s {
+			return nil
+		}
+	}
+	w.handles.forget(w.partPath)
+	os.Remove(w.partPath)
+	return nil
+}
+
+// boundaryRanges returns the bytes of file i, as offsets within the file,
+// that lie in its first and last piece.
+func (w *TorrentWriter) boundaryRanges(i int) [][2]int64 {
+	start := w.tf.FileOffset(i)
+	end := start + int64(w.tf.Files[i].Length)
+	if end == start {
+		return nil
+	}
+	pl := int64(w.tf.PieceLength)
+	firstEnd := min(end, (start/pl+1)*pl)
+	lastStart := max(start, (end-1)/pl*pl)
+	if firstEnd >= lastStart {
+		return [][2]int64{{0, end - start}}
+	}
+	return [][2]int64{{0, firstEnd - start}, {lastStart - start, end - start}}
+}
+
+// interiorPieces returns the pieces that lie wholly inside file i, past its
+// boundary pieces. Nothing of them survives the file being skipped.
+func (tf *TorrentFile) interiorPieces(i int) (first, last int) {
+	start := tf.FileOffset(i)
+	end := start + int64(tf.Files[i].Length)
+	pl := int64(tf.PieceLength)
+	return int(start/pl) + 1, int((end-1)/pl) - 1
+}
+
+// clearInterior forgets the interior pieces of file i. w.mu is held.
+func (w *TorrentWriter) clearInterior(i int) {
+	first, last := w.tf.interiorPieces(i)
+	for p := first; p <= last; p++ {
+		w.have.ClearPiece(p)
+	}
+}
+
+// copyRange moves n bytes in PART_COPY_CHUNK pieces so a large file never
+// has to fit in memory.
+func (w *TorrentWriter) copyRange(off, n int64, read, write func(buf []byte, off int64) error) error {
+	buf := make([]byte, min(n, PART_COPY_CHUNK))
+	for done := int64(0); done < n; {
+		chunk := buf[:min(n-done, int64(len(buf)))]
+		if err := read(chunk, off+done); err != nil {
+			return err
+		}
+		if err := write(chunk, off+done); err != nil {
+			return err
+		}
+		done += int64(len(chunk))
+	}
+	return nil
+}
+
+func (w *TorrentWriter) isSkipped(i int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.skipped[i]
+}
+func (w *TorrentWriter) writePart(data []byte, offset int64) error {
+	return w.cache.write(w.partPath, data, offset, os.O_CREATE)
+}
+func (w *TorrentWriter) readPart(offset int64, length int) ([]byte, error) {
+	buf := make([]byte, length)
+	if err := w.cache.read(w.partPath, buf, offset, true); err != nil {
+		return nil, fmt.Errorf("failed to read partfile: %v", err)
+	}
+	return buf, nil
 }
 func (w *TorrentWriter) Write(index int, begin int, data []byte) error {
+	w.moveMu.RLock()
+	defer w.moveMu.RUnlock()
 	globalOffset := int64(index)*int64(w.tf.PieceLength) + int64(begin)
 	bytesToWrite := len(data)
-	total := len(data)
 	currentFileStart := int64(0)
-	for _, f := range w.tf.Files {
+	for i, f := range w.tf.Files {
 		fileLen := int64(f.Length)
 		fileEnd := currentFileStart + fileLen
 		if globalOffset >= currentFileStart && globalOffset < fileEnd {
@@ -50,19 +288,21 @@ func (w *TorrentWriter) Write(index int, begin int, data []byte) error {
 			if globalOffset+amount > fileEnd {
 				amount = fileEnd - globalOffset
 			}
-			err := w.writeToFile(f.Path, data[:amount], relativeOffset)
+			var err error
+			switch {
+			case f.Padding:
+			case w.isSkipped(i):
+				err = w.writePart(data[:amount], globalOffset)
+			default:
+				err = w.writeToFile(w.paths[i], data[:amount], relativeOffset)
+			}
 			if err != nil {
-				w.d.Stats.TotalWritten += 50
-				fmt.Printf("sad")
 				return err
 			}
 			globalOffset += amount
 			bytesToWrite -= int(amount)
 			data = data[amount:]
 			if bytesToWrite == 0 {
-				if w.d != nil {
-					w.d.Stats.TotalWritten += int64(total)
-				}
 				return nil
 			}
 		}
@@ -71,17 +311,177 @@ func (w *TorrentWriter) Write(index int, begin int, data []byte) error {
 	if bytesToWrite > 0 {
 		return fmt.Errorf("wrote everything but still had %d bytes left (file size mismatch?)", bytesToWrite)
 	}
-	if w.d != nil {
-		w.d.Stats.TotalWritten += int64(total)
+	return nil
+}
+func (w *TorrentWriter) WriteAt(index int, p []byte, begin int64) (int, error) {
+	if err := w.Write(index, int(begin), p); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
+func (w *TorrentWriter) ReadAt(index int, p []byte, begin int64) (int, error) {
+	data, err := w.Read(index, int(begin), len(p))
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, data), nil
+}
+
+// MarkComplete flushes and fsyncs every file the piece touches. With
+// MoveEachFile set, files whose pieces are now all complete are moved out of
+// the staging area.
+func (w *TorrentWriter) MarkComplete(index int) error {
+	start := int64(index) * int64(w.tf.PieceLength)
+	end := start + int64(w.tf.PieceSize(index))
+	offset := int64(0)
+	synced := false
+	var touched []int
+	w.moveMu.RLock()
+	for i, f := range w.tf.Files {
+		fileEnd := offset + int64(f.Length)
+		if fileEnd > start && offset < end && !f.Padding && f.SymlinkPath == "" {
+			var err error
+			if w.isSkipped(i) {
+				if !synced {
+					err = w.cache.flush(w.partPath, os.O_CREATE, true)
+					synced = true
+				}
+			} else {
+				err = w.cache.flush(w.paths[i], 0, true)
+				touched = append(touched, i)
+			}
+			if err != nil {
+				w.moveMu.RUnlock()
+				return err
+			}
+		}
+		offset = fileEnd
+	}
+	w.moveMu.RUnlock()
+	w.mu.Lock()
+	w.have.SetPiece(index)
+	w.mu.Unlock()
+	if !w.eachFile {
+		return nil
+	}
+	for _, i := range touched {
+		if !w.fileComplete(i) {
+			continue
+		}
+		if err := w.moveToFinal(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (w *TorrentWriter) fileComplete(i int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f := w.tf.Files[i]
+	if f.Length == 0 {
+		return true
+	}
+	offset := w.tf.FileOffset(i)
+	first := int(offset / int64(w.tf.PieceLength))
+	last := int((offset + int64(f.Length) - 1) / int64(w.tf.PieceLength))
+	for p := first; p <= last; p++ {
+		if !w.have.HasPiece(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// moveToFinal renames a staged file to its place under the download
+// directory.
+func (w *TorrentWriter) moveToFinal(i int) error {
+	w.moveMu.Lock()
+	defer w.moveMu.Unlock()
+	if w.moved[i] || w.isSkipped(i) {
+		return nil
+	}
+	src, dst := w.paths[i], w.finals[i]
+	if err := w.cache.flush(src, 0, true); err != nil {
+		return err
+	}
+	w.cache.forget(src)
+	w.handles.forget(src)
+	if err := checkNoSymlinkEscape(w.root, filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(dst), err)
+	}
+	if err := moveFile(src, dst); err != nil {
+		return err
+	}
+	w.paths[i] = dst
+	w.moved[i] = true
+	pruneEmptyDirs(filepath.Clean(w.stageRoot), filepath.Dir(src))
 	return nil
 }
+func (w *TorrentWriter) Flush() error {
+	for _, path := range w.cache.paths() {
+		flag := 0
+		if path == w.partPath {
+			flag = os.O_CREATE
+		}
+		if err := w.cache.flush(path, flag, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileStates reports every torrent file in order followed by the partfile.
+func (w *TorrentWriter) FileStates() ([]FileState, error) {
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	w.moveMu.RLock()
+	defer w.moveMu.RUnlock()
+	paths := append(append([]string{}, w.paths...), w.partPath)
+	states := make([]FileState, 0, len(paths))
+	for _, path := range paths {
+		st, err := statFile(path)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, st)
+	}
+	return states, nil
+}
+func (w *TorrentWriter) RestorePieces(have Bitfield) error {
+	w.mu.Lock()
+	copy(w.have, have)
+	w.mu.Unlock()
+	if !w.eachFile {
+		return nil
+	}
+	for i := range w.tf.Files {
+		if w.fileComplete(i) {
+			if err := w.moveToFinal(i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+func (w *TorrentWriter) Close() error {
+	if err := w.Flush(); err != nil {
+		w.handles.closeAll()
+		return err
+	}
+	return w.handles.closeAll()
+}
 func (w *TorrentWriter) Read(index int, begin int, length int) ([]byte, error) {
+	w.moveMu.RLock()
+	defer w.moveMu.RUnlock()
 	globalOffset := int64(index)*int64(w.tf.PieceLength) + int64(begin)
 	buf := make([]byte, length)
 	currentFileStart := int64(0)
 	bytesReadTotal := 0
-	for _, f := range w.tf.Files {
+	for i, f := range w.tf.Files {
 		fileLen := int64(f.Length)
 		fileEnd := currentFileStart + fileLen
 		if globalOffset >= currentFileStart && globalOffset < fileEnd {
@@ -90,11 +490,21 @@ func (w *TorrentWriter) Read(index int, begin int, length int) ([]byte, error) {
 			if globalOffset+amount > fileEnd {
 				amount = fileEnd - globalOffset
 			}
-			chunk, err := w.readFromFile(f.Path, relativeOffset, int(amount))
-			if err != nil {
-				return nil, err
+			switch {
+			case f.Padding:
+			case w.isSkipped(i):
+				part, err := w.readPart(globalOffset, int(amount))
+				if err != nil {
+					return nil, err
+				}
+				copy(buf[bytesReadTotal:], part)
+			default:
+				chunk, err := w.readFromFile(w.paths[i], relativeOffset, int(amount))
+				if err != nil {
+					return nil, err
+				}
+				copy(buf[bytesReadTotal:], chunk)
 			}
-			copy(buf[bytesReadTotal:], chunk)
 			globalOffset += amount
 			bytesReadTotal += int(amount)
 			if bytesReadTotal == length {
@@ -109,24 +519,89 @@ func (w *TorrentWriter) Read(index int, begin int, length int) ([]byte, error) {
 	return buf, nil
 }
 func (w *TorrentWriter) writeToFile(path string, data []byte, offset int64) error {
-	f, err := os.OpenFile(path, os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	_, err = f.WriteAt(data, offset)
-	return err
+	return w.cache.write(path, data, offset, 0)
 }
 func (w *TorrentWriter) readFromFile(path string, offset int64, length int) ([]byte, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
 	buf := make([]byte, length)
-	n, err := f.ReadAt(buf, offset)
-	if err != nil && n != length {
+	if err := w.cache.read(path, buf, offset, false); err != nil {
 		return nil, err
 	}
 	return buf, nil
 }
+
+// Finalize moves any files still staged into the download directory and
+// applies the attributes the torrent asks for.
+func (w *TorrentWriter) Finalize() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for i, f := range w.tf.Files {
+		if f.Padding || f.SymlinkPath != "" {
+			continue
+		}
+		if err := w.moveToFinal(i); err != nil {
+			return err
+		}
+	}
+	w.moveMu.RLock()
+	defer w.moveMu.RUnlock()
+	for i, f := range w.tf.Files {
+		if f.Padding || w.isSkipped(i) {
+			continue
+		}
+		path := w.paths[i]
+		if f.SymlinkPath != "" {
+			if err := w.createSymlink(path, f.SymlinkPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.Executable {
+			if err := os.Chmod(path, 0755); err != nil {
+				return fmt.Errorf("failed to mark %s executable: %v", path, err)
+			}
+		}
+		if f.Hidden {
+			if err := setHidden(path); err != nil {
+				return fmt.Errorf("failed to hide %s: %v", path, err)
+			}
+		}
+	}
+	return nil
+}
+func (w *TorrentWriter) createSymlink(path string, target string) error {
+	if len(w.tf.Files) > 1 || w.tf.Files[0].Path != w.tf.Name {
+		target = filepath.Join(w.tf.Name, target)
+	}
+	full, err := confinePath(w.root, target)
+	if err != nil {
+		return err
+	}
+	if err := checkNoSymlinkEscape(w.root, filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(filepath.Dir(path), full)
+	if err != nil {
+		return err
+	}
+	// Only a symlink left by an earlier run is replaced; anything else
+	// at the path is not ours to delete.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("cannot create symlink %s: path exists", path)
+		}
+		if existing, err := os.Readlink(path); err == nil && existing == rel {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to replace symlink %s: %v", path, err)
+		}
+	}
+	if err := os.Symlink(rel, path); err != nil {
+		return fmt.Errorf("failed to create symlink %s: %v", path, err)
+	}
+	return nil
+}
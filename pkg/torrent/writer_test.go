@@ -0,0 +1,183 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// symlinkTorrent has a file a and a symlink l pointing at it.
+func symlinkTorrent(t *testing.T) *TorrentFile {
+	t.Helper()
+	data := randomBytes(100)
+	info := bencodeDict(
+		pair{"files", bencodeList(
+			bencodeDict(pair{"length", bencodeInt(100)}, pair{"path", bencodeList(bencodeString("a"))}),
+			bencodeDict(pair{"attr", bencodeString("l")}, pair{"length", bencodeInt(0)}, pair{"path", bencodeList(bencodeString("l"))}, pair{"symlink path", bencodeList(bencodeString("a"))}),
+		)},
+		pair{"name", bencodeString("t")},
+		pair{"piece length", bencodeInt(16384)},
+		pair{"pieces", bencodeString(string(sha1Sum(data)))},
+	)
+	ben := bencodeDict(pair{"info", info})
+	s, _ := ben.Marshal()
+	tf, err := parseTorrent([]byte(s))
+	if err != nil {
+		t.Fatalf("couldnt parse symlink torrent: %v", err)
+	}
+	return tf
+}
+
+func TestSymlinkKeepsExistingFile(t *testing.T) {
+	root := t.TempDir()
+	tf := symlinkTorrent(t)
+	os.MkdirAll(filepath.Join(root, "t"), 0755)
+	os.WriteFile(filepath.Join(root, "t", "l"), []byte("mine"), 0644)
+	cfg := DefaultConfig()
+	cfg.DownloadDir = root
+	w, err := NewTorrentWriter(tf, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Finalize(); err == nil {
+		t.Fatal("symlink replaced an existing file")
+	}
+	if got, _ := os.ReadFile(filepath.Join(root, "t", "l")); string(got) != "mine" {
+		t.Fatalf("existing file changed to %q", got)
+	}
+}
+
+func TestSymlinkReplacesStaleSymlink(t *testing.T) {
+	root := t.TempDir()
+	tf := symlinkTorrent(t)
+	os.MkdirAll(filepath.Join(root, "t"), 0755)
+	if err := os.Symlink("elsewhere", filepath.Join(root, "t", "l")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	cfg := DefaultConfig()
+	cfg.DownloadDir = root
+	w, err := NewTorrentWriter(tf, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.Readlink(filepath.Join(root, "t", "l")); got != "a" {
+		t.Fatalf("symlink points at %q, want a", got)
+	}
+}
+
+func TestSkipKeepsOnlyBoundaryBytes(t *testing.T) {
+	// b spans pieces 0 to 4; pieces 1 to 3 lie wholly inside it.
+	files := []testFile{
+		{[]string{"a"}, randomBytes(10000)},
+		{[]string{"b"}, randomBytes(60000)},
+		{[]string{"c"}, randomBytes(10000)},
+	}
+	tf, all := makeTorrent(t, "t", 16384, files)
+	cfg := DefaultConfig()
+	cfg.DownloadDir = t.TempDir()
+	w, err := NewTorrentWriter(tf, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := range tf.NumPieces() {
+		begin := i * tf.PieceLength
+		if err := w.Write(i, 0, all[begin:begin+tf.PieceSize(i)]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.MarkComplete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.SetSkipped(1, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(w.paths[1]); !os.IsNotExist(err) {
+		t.Fatalf("skipped file still on disk: %v", err)
+	}
+	for _, i := range []int{0, 4} {
+		begin := i * tf.PieceLength
+		got, err := w.Read(i, 0, tf.PieceSize(i))
+		if err != nil || !bytes.Equal(got, all[begin:begin+tf.PieceSize(i)]) {
+			t.Fatalf("boundary piece %d lost after skipping: %v", i, err)
+		}
+		if !w.have.HasPiece(i) {
+			t.Fatalf("boundary piece %d dropped", i)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		if w.have.HasPiece(i) {
+			t.Fatalf("interior piece %d still marked as had", i)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	part, err := os.ReadFile(w.partPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(part[16384:65536], make([]byte, 65536-16384)) {
+		t.Fatal("interior pieces copied into the partfile")
+	}
+	if err := w.SetSkipped(1, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(w.paths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := files[1].data
+	head, tail := 16384-10000, 65536-10000
+	if !bytes.Equal(got[:head], b[:head]) || !bytes.Equal(got[tail:], b[tail:]) {
+		t.Fatal("boundary bytes not restored on unskip")
+	}
+}
+
+// A partfile that cannot be read fails reads and un-skipping instead of
+// handing out zeros.
+func TestUnreadablePartfile(t *testing.T) {
+	files := []testFile{
+		{[]string{"a"}, randomBytes(10000)},
+		{[]string{"b"}, randomBytes(30000)},
+	}
+	tf, all := makeTorrent(t, "t", 16384, files)
+	cfg := DefaultConfig()
+	cfg.DownloadDir = t.TempDir()
+	w, err := NewTorrentWriter(tf, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Write(0, 0, all[:16384]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetSkipped(1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	w.handles.forget(w.partPath)
+	if err := os.Remove(w.partPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(w.partPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Read(0, 0, 16384); err == nil {
+		t.Fatal("read of a skipped file succeeded without its partfile")
+	}
+	if err := w.SetSkipped(1, false); err == nil {
+		t.Fatal("un-skipped a file without reading its partfile")
+	}
+}